@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/statico/llmscript/internal/config"
+	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
+	"github.com/statico/llmscript/internal/script"
+)
+
+const cacheUsage = `Usage: %s cache <command> [arguments]
+
+Commands:
+  list                       List cached scripts, most recently used first
+  show <id>                  Show a cached entry and its scripts
+  verify [id...]             Re-run the test scripts of cached entries (all by default)
+  prune [--max-age=30d] [--max-size=10MB]
+                             Remove entries unused for too long, then the least
+                             recently used until the cache fits
+  rm <id>...                 Remove cached entries
+  clear                      Remove every cached entry
+  trust [<public-key> [name]]
+                             Trust scripts signed by a teammate's key, or
+                             show your key and the trusted keys
+
+IDs may be abbreviated to any unique prefix.
+`
+
+// runCacheCommand implements the "cache" subcommand.
+func runCacheCommand(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, cacheUsage, os.Args[0])
+		return errors.New("missing cache command")
+	}
+
+	cache, err := script.NewCache()
+	if err != nil {
+		return err
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		return cacheList(cache)
+	case "show":
+		if len(args) != 1 {
+			return errors.New("usage: cache show <id>")
+		}
+		return cacheShow(cache, args[0])
+	case "verify":
+		return cacheVerify(cfg, cache, args)
+	case "prune":
+		return cachePrune(cache, args)
+	case "rm":
+		if len(args) == 0 {
+			return errors.New("usage: cache rm <id>...")
+		}
+		for _, id := range args {
+			entry, err := cache.Find(id)
+			if err != nil {
+				return err
+			}
+			if err := cache.Remove(entry.ID); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %s\n", shortID(entry.ID))
+		}
+		return nil
+	case "trust":
+		return cacheTrust(cache.Keys(), args)
+	case "clear":
+		n, err := cache.Clear()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d cached scripts\n", n)
+		return nil
+	case "help", "-h", "--help":
+		fmt.Printf(cacheUsage, os.Args[0])
+		return nil
+	default:
+		fmt.Fprintf(os.Stderr, cacheUsage, os.Args[0])
+		return fmt.Errorf("unknown cache command: %s", command)
+	}
+}
+
+func cacheList(cache *script.Cache) error {
+	entries, err := cache.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Printf("The cache in %s is empty\n", cache.Dir())
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLAST USED\tHITS\tMODEL\tSIZE\tDESCRIPTION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			shortID(e.ID), formatTime(e.LastUsed), e.Hits, providerModel(e.CacheEntry),
+			sandbox.ByteSize(e.Size), preview(e.Description, 50))
+	}
+	return w.Flush()
+}
+
+func cacheShow(cache *script.Cache, id string) error {
+	e, err := cache.Find(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ID:        %s\n", e.ID)
+	fmt.Printf("Model:     %s\n", providerModel(e.CacheEntry))
+	fmt.Printf("Platform:  %s\n", e.Platform)
+	fmt.Printf("Created:   %s\n", formatTime(e.Created))
+	fmt.Printf("Last used: %s\n", formatTime(e.LastUsed))
+	fmt.Printf("Hits:      %d\n", e.Hits)
+	if err := cache.Verify(e.ID, &e.CacheEntry); err != nil {
+		fmt.Printf("Signature: rejected, %v\n", err)
+	} else {
+		fmt.Printf("Signature: trusted, %s\n", keyName(cache.Keys(), e.Signer))
+	}
+	fmt.Printf("\nDescription:\n%s\n", e.Description)
+	fmt.Printf("\nScript:\n%s\n", e.Scripts.MainScript)
+	fmt.Printf("\nTest script:\n%s\n", e.Scripts.TestScript)
+	return nil
+}
+
+func cacheVerify(cfg *config.Config, cache *script.Cache, ids []string) error {
+	var entries []script.StoredEntry
+	if len(ids) == 0 {
+		var err error
+		if entries, err = cache.List(); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		entry, err := cache.Find(id)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, *entry)
+	}
+
+	workDir, err := os.MkdirTemp("", "llmscript-*")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(workDir); err != nil {
+			log.Error("failed to remove working directory: %v", err)
+		}
+	}()
+
+	// Verifying doesn't generate anything, so no LLM provider is needed.
+	pipeline, err := script.NewPipeline(nil, script.Config{
+		Timeout: cfg.Timeout,
+		WorkDir: workDir,
+		NoCache: true,
+		Sandbox: cfg.Sandbox,
+		Limits:  cfg.Limits,
+		Watch:   cfg.Watch,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create pipeline: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	failed := 0
+	for _, e := range entries {
+		// Never run a script that isn't signed by a trusted key.
+		if err := cache.Verify(e.ID, &e.CacheEntry); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s  untrusted: %v\n", shortID(e.ID), err)
+			continue
+		}
+		err := pipeline.VerifyCached(ctx, &e.CacheEntry)
+		var setupErr *sandbox.SetupError
+		if errors.As(err, &setupErr) || ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s  %s\n", shortID(e.ID), preview(e.Description, 60))
+			log.Debug("Failure:\n%s", err)
+			continue
+		}
+		fmt.Printf("ok    %s  %s\n", shortID(e.ID), preview(e.Description, 60))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cached scripts are untrusted or failed their tests", failed, len(entries))
+	}
+	return nil
+}
+
+func cachePrune(cache *script.Cache, args []string) error {
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	maxAge := fs.String("max-age", "", "Remove entries not used within this long, e.g. 30d or 12h")
+	maxSize := fs.String("max-size", "", "Then remove least recently used entries until the cache is at most this big, e.g. 10MB")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *maxAge == "" && *maxSize == "" {
+		return errors.New("prune needs --max-age, --max-size or both")
+	}
+
+	var age time.Duration
+	if *maxAge != "" {
+		var err error
+		if age, err = parseAge(*maxAge); err != nil {
+			return err
+		}
+	}
+	var size sandbox.ByteSize
+	if *maxSize != "" {
+		var err error
+		if size, err = sandbox.ParseByteSize(*maxSize); err != nil {
+			return err
+		}
+	}
+
+	removed, err := cache.Prune(age, int64(size))
+	for _, e := range removed {
+		fmt.Printf("Removed %s  %s\n", shortID(e.ID), preview(e.Description, 60))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pruned %d cached scripts\n", len(removed))
+	return nil
+}
+
+func cacheTrust(keys *script.Keyring, args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("Your public key:\n  %s\n\nTrusted keys:\n", keys.PublicKey())
+		trusted := keys.Trusted()
+		ids := make([]string, 0, len(trusted))
+		for key := range trusted {
+			ids = append(ids, key)
+		}
+		sort.Strings(ids)
+		for _, key := range ids {
+			fmt.Printf("  %s  %s\n", key, trusted[key])
+		}
+		return nil
+	}
+
+	if err := keys.Trust(args[0], strings.Join(args[1:], " ")); err != nil {
+		return err
+	}
+	fmt.Printf("Trusting scripts signed by %s\n", args[0])
+	return nil
+}
+
+// keyName describes a trusted public key by its name, if it has one.
+func keyName(keys *script.Keyring, key string) string {
+	if name := keys.Trusted()[key]; name != "" {
+		return name + " (" + key + ")"
+	}
+	return key
+}
+
+// parseAge parses a duration, also accepting a number of days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
+
+func shortID(id string) string {
+	return id[:min(12, len(id))]
+}
+
+func providerModel(e script.CacheEntry) string {
+	switch {
+	case e.Provider == "":
+		return "-"
+	case e.Model == "":
+		return e.Provider
+	default:
+		return e.Provider + "/" + e.Model
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// preview returns the first line of s, shortened to at most n runes.
+func preview(s string, n int) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	if r := []rune(line); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return line
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/statico/llmscript/internal/config"
 	"github.com/statico/llmscript/internal/llm"
 	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/review"
+	"github.com/statico/llmscript/internal/sandbox"
 	"github.com/statico/llmscript/internal/script"
 )
 
@@ -22,22 +28,35 @@ var (
 	timeout     = flag.Duration("timeout", 30*time.Second, "Timeout for each script/test execution during testing")
 	maxFixes    = flag.Int("max-fixes", 10, "Maximum number of attempts to fix the script before regenerating")
 	maxAttempts = flag.Int("max-attempts", 3, "Maximum number of attempts to generate a working script")
-	llmProvider = flag.String("llm.provider", "", "LLM provider to use: ollama, claude, openai, openrouter, gemini (overrides config)")
+	candidates  = flag.Int("candidates", 1, "Generate this many scripts concurrently and keep the one passing the most of their tests (overrides config)")
+	llmProvider = flag.String("llm.provider", "", "LLM provider to use: ollama, claude, openai, openrouter, gemini, the name of an openai_compatible server, or a comma-separated fallback chain (overrides config)")
 	llmModel    = flag.String("llm.model", "", "LLM model to use (overrides config)")
 	extraPrompt = flag.String("prompt", "", "Additional prompt to provide to the LLM")
 	noCache     = flag.Bool("no-cache", false, "Skip using the cache for script generation")
 	printOnly   = flag.Bool("print", false, "Print the generated script without executing it")
+	confirm     = flag.Bool("confirm", false, "Show the generated script and its risky operations and ask before running it (overrides config)")
+	lockfile    = flag.Bool("lockfile", false, "Pin the generated script in <script-file>.lock (overrides config)")
+	dryRun      = flag.Bool("dry-run", false, "Run the generated script against a copy-on-write view of the current directory and report what it would do (Linux only)")
 )
 
 func main() {
+	// Must run first: a sandboxed test run re-executes this binary as the
+	// init process of its namespaces.
+	sandbox.Init()
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <script-file>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <script-file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s update <script-file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s resume <run-id>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s runs\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s cache <list|show|verify|prune|rm|clear|trust>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s script.txt\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s --llm.provider=claude --timeout=10 script.txt\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s --write-config\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s cache list\n", os.Args[0])
 	}
 	flag.Parse()
 
@@ -62,15 +81,49 @@ func main() {
 		log.Fatal("Failed to load config:", err)
 	}
 
-	applyFlagOverrides(cfg)
-
 	if len(flag.Args()) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) == "cache" {
+		if err := runCacheCommand(cfg, flag.Args()[1:]); err != nil {
+			log.Fatal("Cache command failed: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "update" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := runScript(cfg, flag.Arg(1), nil, true, nil); err != nil {
+			log.Fatal("Failed to update script: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "runs" {
+		if err := listRuns(); err != nil {
+			log.Fatal("Failed to list runs: %v", err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "resume" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := resumeRun(cfg, flag.Arg(1)); err != nil {
+			log.Fatal("Failed to resume run: %v", err)
+		}
+		return
+	}
+
 	scriptFile := flag.Args()[0]
-	if err := runScript(cfg, scriptFile); err != nil {
+	if err := runScript(cfg, scriptFile, flag.Args()[1:], false, nil); err != nil {
 		log.Fatal("Failed to run script:", err)
 	}
 }
@@ -87,18 +140,7 @@ func applyFlagOverrides(cfg *config.Config) {
 		log.Debug("Provider overridden by command line flag: %s", *llmProvider)
 	}
 	if set["llm.model"] {
-		switch cfg.LLM.Provider {
-		case "ollama":
-			cfg.LLM.Ollama.Model = *llmModel
-		case "claude", "anthropic":
-			cfg.LLM.Claude.Model = *llmModel
-		case "openai":
-			cfg.LLM.OpenAI.Model = *llmModel
-		case "openrouter":
-			cfg.LLM.OpenRouter.Model = *llmModel
-		case "gemini", "google":
-			cfg.LLM.Gemini.Model = *llmModel
-		}
+		cfg.LLM.SetModel(*llmModel)
 	}
 	if set["timeout"] {
 		cfg.Timeout = *timeout
@@ -109,30 +151,115 @@ func applyFlagOverrides(cfg *config.Config) {
 	if set["max-attempts"] {
 		cfg.MaxAttempts = *maxAttempts
 	}
+	if set["candidates"] {
+		cfg.Candidates = *candidates
+	}
 	if set["prompt"] {
 		cfg.ExtraPrompt = *extraPrompt
 	}
+	if set["confirm"] {
+		cfg.Confirm = *confirm
+	}
+	if set["lockfile"] {
+		cfg.Lockfile = *lockfile
+	}
 }
 
-func runScript(cfg *config.Config, scriptFile string) error {
-	log.Info("Reading script file: %s", scriptFile)
-	content, err := os.ReadFile(scriptFile)
+// runScript generates, tests and runs an llmscript file with args. A lock file
+// next to it is used instead of generating a script. With update set, the
+// script is always regenerated and its lock file rewritten, and nothing runs.
+// Generating is journaled so that an interrupted run can be resumed; a
+// journal of a resumed run replaces the script file's content with the one
+// the run started from.
+func runScript(cfg *config.Config, scriptFile string, args []string, update bool, journal *script.Journal) error {
+	var content []byte
+	if journal != nil {
+		content = []byte(journal.Run().Source)
+	} else {
+		log.Info("Reading script file: %s", scriptFile)
+		var err error
+		if content, err = os.ReadFile(scriptFile); err != nil {
+			return fmt.Errorf("failed to read script file: %w", err)
+		}
+	}
+
+	source, err := script.ParseSource(string(content))
 	if err != nil {
-		return fmt.Errorf("failed to read script file: %w", err)
-	}
-
-	log.Info("Creating LLM provider: %s", cfg.LLM.Provider)
-	provider, err := llm.NewProvider(llm.Config{
-		Provider:    cfg.LLM.Provider,
-		ExtraPrompt: cfg.ExtraPrompt,
-		Ollama:      cfg.LLM.Ollama,
-		Claude:      cfg.LLM.Claude,
-		OpenAI:      cfg.LLM.OpenAI,
-		Gemini:      cfg.LLM.Gemini,
-		OpenRouter:  cfg.LLM.OpenRouter,
-	})
+		return fmt.Errorf("failed to parse script file: %w", err)
+	}
+
+	// Settings precedence: config file, then the script's frontmatter, then
+	// command-line flags.
+	source.Frontmatter.Apply(cfg)
+	applyFlagOverrides(cfg)
+
+	// Validate the script's arguments against its declared interface before
+	// spending any time on generation.
+	var scriptArgs []string
+	if !update {
+		scriptArgs, err = source.ParseArgs(args)
+		if errors.Is(err, flag.ErrHelp) {
+			fmt.Print(source.Usage(filepath.Base(scriptFile)))
+			return nil
+		}
+		if err != nil {
+			fmt.Fprint(os.Stderr, source.Usage(filepath.Base(scriptFile)))
+			return fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+
+	// A lock file is authoritative: its script is used as is, and a lock
+	// file that no longer matches the source is an error rather than a
+	// reason to silently regenerate.
+	lockPath := script.LockfilePath(scriptFile)
+	keys, err := script.LoadKeyring()
 	if err != nil {
-		return fmt.Errorf("failed to create LLM provider: %w", err)
+		return err
+	}
+	var lock *script.Lockfile
+	if !update {
+		if lock, err = script.ReadLockfile(lockPath); err != nil {
+			return err
+		}
+		if lock != nil && !lock.Matches(source) {
+			return fmt.Errorf("%s is out of date with %s; run \"llmscript update %s\" to regenerate it", lockPath, scriptFile, scriptFile)
+		}
+		if lock != nil {
+			if err := lock.Verify(keys); err != nil {
+				return fmt.Errorf("refusing to run %s: %w; trust its author's key with \"llmscript cache trust\" or run \"llmscript update %s\" to regenerate it", lockPath, err, scriptFile)
+			}
+		}
+	}
+
+	var provider llm.Provider
+	var candidateProviders []llm.Provider
+	var run *script.Run
+	if lock == nil {
+		log.Info("Creating LLM provider: %s", cfg.LLM.Provider)
+		provider, err = newProvider(cfg, cfg.LLM)
+		if err != nil {
+			return fmt.Errorf("failed to create LLM provider: %w", err)
+		}
+		if cfg.Candidates > 1 {
+			if candidateProviders, err = newCandidateProviders(cfg); err != nil {
+				return err
+			}
+		}
+
+		if journal == nil {
+			absPath, err := filepath.Abs(scriptFile)
+			if err != nil {
+				return fmt.Errorf("failed to resolve script file: %w", err)
+			}
+			run = &script.Run{ScriptFile: absPath, Source: string(content), Args: args, Update: update, Settings: cfg.Fingerprint()}
+		} else if journal.Run().Settings != cfg.Fingerprint() {
+			log.Warn("The settings changed since run %s started; steps that no longer apply are dropped", journal.Run().ID)
+		}
+	} else if journal != nil {
+		// Nothing left to generate, the script is pinned.
+		if err := journal.Finish(nil); err != nil {
+			log.Warn("%v", err)
+		}
 	}
 
 	log.Info("Creating work directory")
@@ -150,7 +277,37 @@ func runScript(cfg *config.Config, scriptFile string) error {
 	}
 
 	log.Info("Creating pipeline")
-	pipeline, err := script.NewPipeline(provider, cfg.MaxFixes, cfg.MaxAttempts, cfg.Timeout, workDir, *noCache)
+	var remote script.Backend
+	if cfg.Cache.Remote != "" {
+		if remote, err = script.NewBackend(cfg.Cache.Remote, cfg.Cache.RemoteToken); err != nil {
+			return err
+		}
+	}
+
+	pipeline, err := script.NewPipeline(provider, script.Config{
+		MaxFixes:         cfg.MaxFixes,
+		MaxAttempts:      cfg.MaxAttempts,
+		Timeout:          cfg.Timeout,
+		WorkDir:          workDir,
+		NoCache:          *noCache || update,
+		Provider:         cfg.LLM.Provider,
+		Model:            cfg.LLM.Model(),
+		CacheSettings:    cfg.Fingerprint(),
+		Sandbox:          cfg.Sandbox,
+		Limits:           cfg.Limits,
+		Watch:            cfg.Watch,
+		PlatformMismatch: cfg.Cache.PlatformMismatch,
+		RemoteCache:      remote,
+		Pricing:          cfg.Pricing,
+		MaxCost:          cfg.MaxCost,
+		MaxTokens:        cfg.MaxTokens,
+		Candidates:       cfg.Candidates,
+		Parallel:         cfg.Parallel,
+
+		CandidateProviders: candidateProviders,
+		Run:                run,
+		Journal:            journal,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create pipeline: %w", err)
 	}
@@ -162,20 +319,46 @@ func runScript(cfg *config.Config, scriptFile string) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	log.Info("Generating and testing script")
-	generated, err := pipeline.GenerateAndTest(ctx, string(content))
-	if err != nil {
-		return fmt.Errorf("failed to generate working script: %w", err)
-	}
+	var scripts llm.ScriptPair
+	if lock != nil {
+		log.Info("Using script pinned in %s", lockPath)
+		scripts = lock.Scripts()
+	} else {
+		log.Info("Generating and testing script")
+		scripts, err = pipeline.GenerateAndTest(ctx, source)
+		if journal := pipeline.Journal(); journal != nil {
+			if err := journal.Finish(err); err != nil {
+				log.Warn("%v", err)
+			}
+			if err != nil {
+				log.Info("Resume this run with: llmscript resume %s", journal.Run().ID)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to generate working script: %w", err)
+		}
 
-	if *verbose {
-		log.Info("Generated script:\n%s", generated)
+		if update || cfg.Lockfile {
+			providerName, model := pipeline.LastBackend()
+			if providerName == "" {
+				providerName, model = cfg.LLM.Provider, cfg.LLM.Model()
+			}
+			lock := script.NewLockfile(source, scripts, providerName, model)
+			if err := lock.Sign(keys); err != nil {
+				return err
+			}
+			if err := lock.Write(lockPath); err != nil {
+				return err
+			}
+			log.Success("Pinned script in %s", lockPath)
+		}
+		if update {
+			return nil
+		}
 	}
 
-	// Write the script to a file
-	scriptPath := filepath.Join(workDir, "script.sh")
-	if err := os.WriteFile(scriptPath, []byte(generated), 0755); err != nil {
-		return fmt.Errorf("failed to write script: %w", err)
+	if *verbose {
+		log.Info("Generated script:\n%s", scripts.MainScript)
 	}
 
 	// Clear the spinner line before printing success message
@@ -183,24 +366,55 @@ func runScript(cfg *config.Config, scriptFile string) error {
 
 	// If --print flag is set, just print the script and exit
 	if *printOnly {
-		fmt.Println(generated)
+		fmt.Println(scripts.MainScript)
 		return nil
 	}
 
 	// Stop the spinner before executing the script
 	log.GetSpinner().Stop()
 
-	// Get any additional arguments after the script file
-	scriptArgs := flag.Args()[1:]
+	if cfg.Confirm {
+		confirmed, err := confirmScript(ctx, pipeline, source, scripts)
+		if errors.Is(err, errDeclined) {
+			fmt.Fprintln(os.Stderr, "Not running the script.")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		scripts = confirmed
+	}
+	generated := scripts.MainScript
+
+	if *dryRun {
+		return dryRunScript(cfg, generated, scriptArgs)
+	}
+
+	// Write the script to a file
+	scriptPath := filepath.Join(workDir, "script.sh")
+	if err := os.WriteFile(scriptPath, []byte(generated), 0755); err != nil {
+		return fmt.Errorf("failed to write script: %w", err)
+	}
+
+	// The final script runs for real, outside the test sandbox, but under the
+	// same resource limits.
+	runner, err := sandbox.New(sandbox.Config{Mode: sandbox.ModeNone}, cfg.Limits)
+	if err != nil {
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
 
-	// Execute the script with any additional arguments
+	// Execute the script with the additional arguments after the script file
 	cmd := exec.Command(scriptPath, scriptArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 
 	// Run the command and exit with its status code
-	if err := cmd.Run(); err != nil {
+	if err := runner.Run(cmd); err != nil {
+		var limitErr *sandbox.LimitError
+		if errors.As(err, &limitErr) {
+			return fmt.Errorf("script %w", limitErr)
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			os.Exit(exitErr.ExitCode())
 		}
@@ -210,3 +424,120 @@ func runScript(cfg *config.Config, scriptFile string) error {
 
 	return nil
 }
+
+// newProvider creates the LLM provider selected by llmCfg.
+func newProvider(cfg *config.Config, llmCfg config.LLMConfig) (llm.Provider, error) {
+	return llm.NewProvider(llm.Config{
+		Provider:         llmCfg.Provider,
+		ExtraPrompt:      cfg.ExtraPrompt,
+		ContextBudget:    llmCfg.ContextBudget,
+		Ollama:           llmCfg.Ollama,
+		Claude:           llmCfg.Claude,
+		OpenAI:           llmCfg.OpenAI,
+		Gemini:           llmCfg.Gemini,
+		OpenRouter:       llmCfg.OpenRouter,
+		OpenAICompatible: llmCfg.OpenAICompatible,
+	})
+}
+
+// newCandidateProviders creates a provider for each of the configured
+// candidate_providers, written as "provider" or "provider:model".
+func newCandidateProviders(cfg *config.Config) ([]llm.Provider, error) {
+	var providers []llm.Provider
+	for _, spec := range cfg.CandidateProviders {
+		name, model, _ := strings.Cut(spec, ":")
+		llmCfg := cfg.LLM
+		llmCfg.Provider = strings.TrimSpace(name)
+		llmCfg.OpenAICompatible = maps.Clone(cfg.LLM.OpenAICompatible)
+		if model = strings.TrimSpace(model); model != "" {
+			llmCfg.SetModel(model)
+		}
+		provider, err := newProvider(cfg, llmCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create candidate provider %s: %w", spec, err)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// dryRunScript runs the generated script in the namespace sandbox against a
+// copy-on-write view of the current directory and prints what it did.
+func dryRunScript(cfg *config.Config, generated string, args []string) error {
+	sb, err := sandbox.New(sandbox.Config{Mode: sandbox.ModeNamespace, Network: cfg.Sandbox.Network}, cfg.Limits)
+	if err != nil {
+		return fmt.Errorf("dry run needs the namespace sandbox: %w", err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get current directory: %w", err)
+	}
+
+	report, err := script.DryRun(sb, generated, args, cwd)
+	if err != nil {
+		var limitErr *sandbox.LimitError
+		if errors.As(err, &limitErr) {
+			return fmt.Errorf("script %w", limitErr)
+		}
+		return fmt.Errorf("dry run failed: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "\n%s", report)
+	return nil
+}
+
+// errDeclined is returned by confirmScript when the user chooses not to run
+// the script.
+var errDeclined = errors.New("script declined")
+
+// confirmScript shows the script and its risky operations on the terminal and
+// asks whether to run it. The user may edit it instead, in which case the
+// edited script is tested again before asking once more. The terminal is
+// opened directly since stdin may carry the script's input.
+func confirmScript(ctx context.Context, pipeline *script.Pipeline, source *script.Source, scripts llm.ScriptPair) (llm.ScriptPair, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return scripts, fmt.Errorf("--confirm needs a terminal: %w", err)
+	}
+	defer func() {
+		_ = tty.Close()
+	}()
+
+	answers := bufio.NewReader(tty)
+	for {
+		review.Show(tty, scripts.MainScript, true)
+		decision, err := review.Ask(answers, tty)
+		if err != nil {
+			return scripts, err
+		}
+		switch decision {
+		case review.Accept:
+			return scripts, nil
+		case review.Reject:
+			return scripts, errDeclined
+		}
+
+		edited, err := review.EditScript(tty, scripts.MainScript)
+		if err != nil {
+			return scripts, err
+		}
+		candidate := scripts
+		candidate.MainScript = edited
+
+		log.Info("Testing edited script")
+		err = pipeline.Verify(ctx, source, candidate)
+		log.GetSpinner().Stop()
+		log.GetSpinner().Clear()
+		var setupErr *sandbox.SetupError
+		if errors.As(err, &setupErr) || ctx.Err() != nil {
+			return scripts, err
+		}
+		if err != nil {
+			fmt.Fprintf(tty, "\nThe edited script failed its tests:\n%s\n\n", err)
+			fmt.Fprintln(tty, "Edit it again, answer y to run it anyway, or n to give up.")
+		} else {
+			fmt.Fprintln(tty, "\nThe edited script passed its tests.")
+		}
+		scripts = candidate
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/statico/llmscript/internal/config"
+	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/script"
+)
+
+// listRuns implements the "runs" subcommand.
+func listRuns() error {
+	runs, err := script.ListRuns()
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs yet")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUPDATED\tSTATUS\tATTEMPT\tFIX\tSTEPS\tSCRIPT")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			r.ID, formatTime(r.Updated), r.Status, position(r.Attempt), position(r.Fix), r.Steps, filepath.Base(r.ScriptFile))
+	}
+	return w.Flush()
+}
+
+// position formats an attempt or fix number, which is zero before the first
+// step.
+func position(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+// resumeRun implements the "resume" subcommand: it picks up a journaled run
+// where it stopped, replaying its recorded steps and then going on as the
+// original command would have.
+func resumeRun(cfg *config.Config, id string) error {
+	stored, err := script.FindRun(id)
+	if err != nil {
+		return err
+	}
+	if stored.Status == script.RunSucceeded {
+		return fmt.Errorf("run %s already succeeded", stored.ID)
+	}
+	journal, err := script.OpenJournal(stored.ID)
+	if err != nil {
+		return err
+	}
+	run := journal.Run()
+	if run.Steps == 0 {
+		log.Info("Run %s has no recorded steps, starting it over", run.ID)
+	} else {
+		log.Info("Resuming run %s of %s at attempt %d, fix %d", run.ID, run.ScriptFile, run.Attempt, run.Fix)
+	}
+	return runScript(cfg, run.ScriptFile, run.Args, run.Update, journal)
+}
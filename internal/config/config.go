@@ -5,10 +5,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/statico/llmscript/internal/llm"
 	customlog "github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
 	"gopkg.in/yaml.v3"
 )
 
@@ -16,39 +18,179 @@ import (
 // per-provider structs are reused from the llm package so there is a single
 // source of truth for their shape.
 type LLMConfig struct {
-	Provider   string               `yaml:"provider"`
-	Ollama     llm.OllamaConfig     `yaml:"ollama"`
-	Claude     llm.ClaudeConfig     `yaml:"claude"`
-	OpenAI     llm.OpenAIConfig     `yaml:"openai"`
-	Gemini     llm.GeminiConfig     `yaml:"gemini"`
-	OpenRouter llm.OpenRouterConfig `yaml:"openrouter"`
+	// Provider is a provider name or a comma-separated fallback chain. In
+	// YAML it may also be written as a list.
+	Provider string `yaml:"provider"`
+	// ContextBudget is roughly how many tokens a fix conversation may use
+	// before the oldest failed versions are left out of it.
+	ContextBudget int                  `yaml:"context_budget"`
+	Ollama        llm.OllamaConfig     `yaml:"ollama"`
+	Claude        llm.ClaudeConfig     `yaml:"claude"`
+	OpenAI        llm.OpenAIConfig     `yaml:"openai"`
+	Gemini        llm.GeminiConfig     `yaml:"gemini"`
+	OpenRouter    llm.OpenRouterConfig `yaml:"openrouter"`
+	// OpenAICompatible holds named OpenAI-compatible servers such as vLLM,
+	// LM Studio or an internal gateway. Each is selected as a provider by
+	// its name.
+	OpenAICompatible map[string]llm.OpenAICompatibleConfig `yaml:"openai_compatible,omitempty"`
+}
+
+// UnmarshalYAML accepts the provider as a list as well as a string.
+func (c *LLMConfig) UnmarshalYAML(node *yaml.Node) error {
+	FlattenProviders(node)
+	type plain LLMConfig
+	return node.Decode((*plain)(c))
+}
+
+// FlattenProviders rewrites a "provider" key of a YAML mapping whose value is
+// a list of provider names into the equivalent comma-separated string.
+func FlattenProviders(node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value != "provider" || value.Kind != yaml.SequenceNode {
+			continue
+		}
+		var names []string
+		for _, item := range value.Content {
+			names = append(names, item.Value)
+		}
+		*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: strings.Join(names, ", ")}
+	}
+}
+
+// primary returns the first provider of the fallback chain, whose model the
+// --llm.model flag and frontmatter set.
+func (c *LLMConfig) primary() string {
+	if providers := llm.ParseProviders(c.Provider); len(providers) > 0 {
+		return providers[0]
+	}
+	return ""
+}
+
+// Model returns the model configured for the selected provider, or for the
+// first one of a fallback chain.
+func (c *LLMConfig) Model() string {
+	switch c.primary() {
+	case "ollama":
+		return c.Ollama.Model
+	case "claude", "anthropic":
+		return c.Claude.Model
+	case "openai":
+		return c.OpenAI.Model
+	case "openrouter":
+		return c.OpenRouter.Model
+	case "gemini", "google":
+		return c.Gemini.Model
+	}
+	return c.OpenAICompatible[c.primary()].Model
+}
+
+// SetModel sets the model for the selected provider, or the first one of a
+// fallback chain, leaving the other providers' settings untouched.
+func (c *LLMConfig) SetModel(model string) {
+	switch c.primary() {
+	case "ollama":
+		c.Ollama.Model = model
+	case "claude", "anthropic":
+		c.Claude.Model = model
+	case "openai":
+		c.OpenAI.Model = model
+	case "openrouter":
+		c.OpenRouter.Model = model
+	case "gemini", "google":
+		c.Gemini.Model = model
+	default:
+		if server, ok := c.OpenAICompatible[c.primary()]; ok {
+			server.Model = model
+			c.OpenAICompatible[c.primary()] = server
+		}
+	}
 }
 
 type Config struct {
-	LLM         LLMConfig     `yaml:"llm"`
-	MaxFixes    int           `yaml:"max_fixes"`
-	MaxAttempts int           `yaml:"max_attempts"`
-	Timeout     time.Duration `yaml:"timeout"`
-	ExtraPrompt string        `yaml:"additional_prompt"`
+	LLM         LLMConfig `yaml:"llm"`
+	MaxFixes    int       `yaml:"max_fixes"`
+	MaxAttempts int       `yaml:"max_attempts"`
+	// MaxCost and MaxTokens, if positive, stop generating once a run has
+	// cost an estimated MaxCost US dollars or used MaxTokens tokens.
+	MaxCost   float64 `yaml:"max_cost"`
+	MaxTokens int     `yaml:"max_tokens"`
+	// Candidates, if more than one, generates that many scripts at once and
+	// keeps the one that passes the most of their test scripts. Parallel
+	// bounds how many are generated or tested at once.
+	Candidates  int            `yaml:"candidates"`
+	Parallel    int            `yaml:"parallel"`
+	Timeout     time.Duration  `yaml:"timeout"`
+	ExtraPrompt string         `yaml:"additional_prompt"`
+	Sandbox     sandbox.Config `yaml:"sandbox"`
+	Limits      sandbox.Limits `yaml:"limits"`
+	Watch       []string       `yaml:"watch"`
+	Confirm     bool           `yaml:"confirm"`
+	Lockfile    bool           `yaml:"lockfile"`
+	Cache       CacheConfig    `yaml:"cache"`
+	// Pricing maps model names to their price per million tokens, for
+	// estimating what a run costs.
+	Pricing map[string]llm.Price `yaml:"pricing,omitempty"`
+	// CandidateProviders lists the providers that take turns generating
+	// candidates, each a provider name optionally followed by ":model".
+	// Empty means the selected provider generates all of them.
+	CandidateProviders []string `yaml:"candidate_providers,omitempty"`
+}
+
+// CacheConfig controls how cached scripts are reused.
+type CacheConfig struct {
+	// PlatformMismatch decides what happens to a script cached on a different
+	// platform: "verify" re-runs its tests here and reuses it if they pass,
+	// "regenerate" ignores it.
+	PlatformMismatch string `yaml:"platform_mismatch"`
+	// Remote is a directory or an http(s):// URL of a cache shared with a
+	// team. Entries missing locally are downloaded from it and new entries
+	// are uploaded to it.
+	Remote string `yaml:"remote"`
+	// RemoteToken is sent as a bearer token to an HTTP remote cache.
+	RemoteToken string `yaml:"remote_token"`
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		LLM: LLMConfig{
-			Provider:   "ollama",
-			Ollama:     llm.OllamaConfig{Model: llm.DefaultOllamaModel, Host: llm.DefaultOllamaHost},
-			Claude:     llm.ClaudeConfig{APIKey: "${ANTHROPIC_API_KEY}", Model: llm.DefaultClaudeModel},
-			OpenAI:     llm.OpenAIConfig{APIKey: "${OPENAI_API_KEY}", Model: llm.DefaultOpenAIModel},
-			Gemini:     llm.GeminiConfig{APIKey: "${GEMINI_API_KEY}", Model: llm.DefaultGeminiModel},
-			OpenRouter: llm.OpenRouterConfig{APIKey: "${OPENROUTER_API_KEY}", Model: llm.DefaultOpenRouterModel},
+			Provider:      "ollama",
+			ContextBudget: llm.DefaultContextBudget,
+			Ollama:        llm.OllamaConfig{Model: llm.DefaultOllamaModel, Host: llm.DefaultOllamaHost, Retry: llm.DefaultRetry},
+			Claude:        llm.ClaudeConfig{APIKey: "${ANTHROPIC_API_KEY}", Model: llm.DefaultClaudeModel, Retry: llm.DefaultRetry},
+			OpenAI:        llm.OpenAIConfig{APIKey: "${OPENAI_API_KEY}", Model: llm.DefaultOpenAIModel, Retry: llm.DefaultRetry},
+			Gemini:        llm.GeminiConfig{APIKey: "${GEMINI_API_KEY}", Model: llm.DefaultGeminiModel, Retry: llm.DefaultRetry},
+			OpenRouter:    llm.OpenRouterConfig{APIKey: "${OPENROUTER_API_KEY}", Model: llm.DefaultOpenRouterModel, Retry: llm.DefaultRetry},
 		},
 		MaxFixes:    10,
 		MaxAttempts: 3,
+		Candidates:  1,
+		Parallel:    4,
 		Timeout:     30 * time.Second,
 		ExtraPrompt: "Use ANSI color codes to make the output more readable.",
+		Sandbox:     sandbox.Config{Mode: sandbox.ModeNone},
+		Cache:       CacheConfig{PlatformMismatch: "verify"},
 	}
 }
 
+// Fingerprint describes the settings that influence which script gets
+// generated. It is folded into the cache key so that changing the provider,
+// model, additional prompt or prompt templates doesn't reuse a script
+// produced under different settings. Settings that only bound how hard
+// llmscript tries, such as timeouts and retry counts, are left out so that
+// changing them keeps the cache.
+func (c *Config) Fingerprint() string {
+	return strings.Join([]string{
+		"provider=" + strings.Join(llm.ParseProviders(c.LLM.Provider), ","),
+		"model=" + c.LLM.Model(),
+		"additional_prompt=" + strings.TrimSpace(c.ExtraPrompt),
+		"prompt_version=" + llm.PromptVersion,
+	}, "\n")
+}
+
 func interpolateEnvVars(data []byte) []byte {
 	return []byte(os.ExpandEnv(string(data)))
 }
@@ -5,6 +5,9 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/statico/llmscript/internal/llm"
+	"gopkg.in/yaml.v3"
 )
 
 func TestConfig(t *testing.T) {
@@ -148,6 +151,75 @@ additional_prompt: "Test prompt"
 			t.Errorf("expected ExtraPrompt=Test prompt, got %s", cfg.ExtraPrompt)
 		}
 	})
+	t.Run("provider fallback chain", func(t *testing.T) {
+		cfg := DefaultConfig()
+		if err := yaml.Unmarshal([]byte("llm:\n  provider: [claude, openrouter, ollama]\n  claude:\n    model: claude-haiku-4-5\n"), cfg); err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		if cfg.LLM.Provider != "claude, openrouter, ollama" {
+			t.Errorf("expected the chain as a comma-separated list, got %q", cfg.LLM.Provider)
+		}
+		if cfg.LLM.Model() != "claude-haiku-4-5" {
+			t.Errorf("expected the first provider's model, got %s", cfg.LLM.Model())
+		}
+		if cfg.LLM.Ollama.Host != llm.DefaultOllamaHost {
+			t.Errorf("expected other settings to keep their defaults, got host %s", cfg.LLM.Ollama.Host)
+		}
+		cfg.LLM.SetModel("claude-opus-4-8")
+		if cfg.LLM.Claude.Model != "claude-opus-4-8" || cfg.LLM.OpenRouter.Model != llm.DefaultOpenRouterModel {
+			t.Errorf("expected SetModel to only change the first provider's model")
+		}
+	})
+	t.Run("openai-compatible servers", func(t *testing.T) {
+		cfg := DefaultConfig()
+		data := "llm:\n  provider: vllm\n  openai_compatible:\n    vllm:\n      base_url: http://localhost:8000/v1\n      model: qwen3-coder\n      headers:\n        X-Team: infra\n"
+		if err := yaml.Unmarshal([]byte(data), cfg); err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		server := cfg.LLM.OpenAICompatible["vllm"]
+		if server.BaseURL != "http://localhost:8000/v1" || server.Headers["X-Team"] != "infra" {
+			t.Errorf("unexpected server config %+v", server)
+		}
+		if cfg.LLM.Model() != "qwen3-coder" {
+			t.Errorf("expected the server's model, got %s", cfg.LLM.Model())
+		}
+		if server.Retry != llm.DefaultRetry {
+			t.Errorf("expected the default retry policy, got %+v", server.Retry)
+		}
+		cfg.LLM.SetModel("llama-3.3-70b")
+		if cfg.LLM.OpenAICompatible["vllm"].Model != "llama-3.3-70b" {
+			t.Errorf("expected SetModel to change the server's model")
+		}
+	})
+
+	t.Run("openai-compatible retry policy", func(t *testing.T) {
+		cfg := DefaultConfig()
+		data := "llm:\n  openai_compatible:\n    vllm:\n      retry:\n        max_delay: 1m\n    local:\n      retry:\n        max_retries: 0\n"
+		if err := yaml.Unmarshal([]byte(data), cfg); err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		if retry := cfg.LLM.OpenAICompatible["vllm"].Retry; retry.MaxRetries != llm.DefaultRetry.MaxRetries || retry.MaxDelay != time.Minute {
+			t.Errorf("expected the retry block to be read over the defaults, got %+v", retry)
+		}
+		if retry := cfg.LLM.OpenAICompatible["local"].Retry; retry.MaxRetries != 0 {
+			t.Errorf("expected retries to be disabled, got %+v", retry)
+		}
+	})
+
+	t.Run("pricing and budget", func(t *testing.T) {
+		cfg := DefaultConfig()
+		data := "max_cost: 0.5\nmax_tokens: 200000\npricing:\n  claude-opus-4-8:\n    input: 5\n    cached_input: 0.5\n    output: 25\n"
+		if err := yaml.Unmarshal([]byte(data), cfg); err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		if cfg.MaxCost != 0.5 || cfg.MaxTokens != 200000 {
+			t.Errorf("unexpected budget: max_cost=%v max_tokens=%d", cfg.MaxCost, cfg.MaxTokens)
+		}
+		want := llm.Price{Input: 5, CachedInput: 0.5, Output: 25}
+		if cfg.Pricing["claude-opus-4-8"] != want {
+			t.Errorf("expected price %+v, got %+v", want, cfg.Pricing["claude-opus-4-8"])
+		}
+	})
 
 	t.Run("config snapshot", func(t *testing.T) {
 		tmpDir := t.TempDir()
@@ -197,28 +269,97 @@ additional_prompt: "Test prompt"
 		// Compare with expected snapshot
 		expected := `llm:
   provider: ollama
+  context_budget: 32000
   ollama:
     model: llama2
     host: http://localhost:11434
+    retry:
+      max_retries: 4
+      base_delay: 1s
+      max_delay: 30s
   claude:
     api_key: ""
     model: ""
+    retry:
+      max_retries: 4
+      base_delay: 1s
+      max_delay: 30s
   openai:
     api_key: ""
     model: ""
+    retry:
+      max_retries: 4
+      base_delay: 1s
+      max_delay: 30s
   gemini:
     api_key: ""
     model: ""
+    retry:
+      max_retries: 4
+      base_delay: 1s
+      max_delay: 30s
   openrouter:
     api_key: ""
     model: ""
+    retry:
+      max_retries: 4
+      base_delay: 1s
+      max_delay: 30s
 max_fixes: 5
 max_attempts: 2
+max_cost: 0
+max_tokens: 0
+candidates: 1
+parallel: 4
 timeout: 15s
 additional_prompt: Test prompt
+sandbox:
+  mode: none
+  network: false
+limits:
+  cpu_time: 0s
+  memory: 0
+  open_files: 0
+  processes: 0
+  output: 0
+watch: []
+confirm: false
+lockfile: false
+cache:
+  platform_mismatch: verify
+  remote: ""
+  remote_token: ""
 `
 		if string(written) != expected {
 			t.Errorf("config snapshot mismatch:\nExpected:\n%s\nGot:\n%s", expected, string(written))
 		}
 	})
+	t.Run("fingerprint follows effective settings", func(t *testing.T) {
+		cfg := DefaultConfig()
+		base := cfg.Fingerprint()
+
+		cfg.LLM.SetModel("llama2")
+		if cfg.LLM.Ollama.Model != "llama2" {
+			t.Errorf("expected SetModel to update the ollama model, got %s", cfg.LLM.Ollama.Model)
+		}
+		if cfg.Fingerprint() == base {
+			t.Errorf("expected fingerprint to change with the model")
+		}
+
+		cfg = DefaultConfig()
+		cfg.ExtraPrompt = "Be terse."
+		if cfg.Fingerprint() == base {
+			t.Errorf("expected fingerprint to change with the additional prompt")
+		}
+
+		// How hard llmscript tries doesn't invalidate the cache.
+		cfg = DefaultConfig()
+		cfg.Timeout = 5 * time.Second
+		cfg.MaxFixes = 1
+		cfg.MaxAttempts = 1
+		cfg.Candidates = 3
+		if cfg.Fingerprint() != base {
+			t.Errorf("expected fingerprint to ignore the timeout and retry counts")
+		}
+	})
 }
@@ -0,0 +1,225 @@
+// Package fsdiff reports which files a command created, modified or deleted by
+// comparing snapshots taken before and after it runs.
+package fsdiff
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxHashSize is the largest file whose contents are hashed. Larger files are
+// compared by size and modification time only.
+const maxHashSize = 1 << 20
+
+// state is what a snapshot records about a single path.
+type state struct {
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	hash    [sha256.Size]byte
+	target  string // symlink target
+}
+
+// Snapshot records the state of every file and directory under a set of
+// paths.
+type Snapshot struct {
+	files map[string]state
+}
+
+// Take snapshots everything under dir, keyed by slash-separated paths relative
+// to dir, and everything under each of the watched paths, keyed by absolute
+// path. Watched paths that don't exist yet are allowed so that creating them
+// shows up; a leading "~/" is expanded to the home directory.
+func Take(dir string, watched []string) (*Snapshot, error) {
+	s := &Snapshot{files: make(map[string]state)}
+	if err := s.walk(dir, func(rel string) string { return rel }); err != nil {
+		return nil, err
+	}
+	for _, w := range watched {
+		root, err := expandHome(w)
+		if err != nil {
+			return nil, err
+		}
+		root, err = filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve watched path %s: %w", w, err)
+		}
+		if err := s.walk(root, func(rel string) string { return path.Join(filepath.ToSlash(root), rel) }); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func expandHome(p string) (string, error) {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %s: %w", p, err)
+	}
+	return filepath.Join(home, p[1:]), nil
+}
+
+// walk records every entry under root. Entries that can't be read, such as
+// directories without permission, are skipped rather than failing the
+// snapshot.
+func (s *Snapshot) walk(root string, key func(rel string) string) error {
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && p != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		name := key(filepath.ToSlash(rel))
+		if d.IsDir() {
+			name += "/"
+		}
+		s.files[name] = stat(p, info)
+		return nil
+	})
+}
+
+// stat records the state of the file at p.
+func stat(p string, info fs.FileInfo) state {
+	st := state{mode: info.Mode(), size: info.Size(), modTime: info.ModTime()}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		st.target, _ = os.Readlink(p)
+	case info.Mode().IsRegular() && info.Size() <= maxHashSize:
+		st.hash = hashFile(p)
+	}
+	return st
+}
+
+func hashFile(p string) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	f, err := os.Open(p)
+	if err != nil {
+		return sum
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// changed reports whether a path's contents or type changed. Directories only
+// change when their mode does; changes to their entries are reported
+// individually.
+func (a state) changed(b state) bool {
+	switch {
+	case a.mode != b.mode:
+		return true
+	case a.mode.IsDir():
+		return false
+	case a.mode&fs.ModeSymlink != 0:
+		return a.target != b.target
+	case a.size != b.size:
+		return true
+	case a.size <= maxHashSize:
+		return a.hash != b.hash
+	default:
+		return !a.modTime.Equal(b.modTime)
+	}
+}
+
+// Changes lists the paths that differ between two snapshots. Directories end
+// in "/".
+type Changes struct {
+	Created  []string
+	Modified []string
+	Deleted  []string
+}
+
+// Diff compares the snapshot to a later one.
+func (s *Snapshot) Diff(after *Snapshot) Changes {
+	var c Changes
+	for name, st := range after.files {
+		prev, ok := s.files[name]
+		switch {
+		case !ok:
+			c.Created = append(c.Created, name)
+		case prev.changed(st):
+			c.Modified = append(c.Modified, name)
+		}
+	}
+	for name := range s.files {
+		if _, ok := after.files[name]; !ok {
+			c.Deleted = append(c.Deleted, name)
+		}
+	}
+	sort.Strings(c.Created)
+	sort.Strings(c.Modified)
+	sort.Strings(c.Deleted)
+	return c
+}
+
+// Empty reports whether nothing changed.
+func (c Changes) Empty() bool {
+	return len(c.Created) == 0 && len(c.Modified) == 0 && len(c.Deleted) == 0
+}
+
+func (c Changes) String() string {
+	if c.Empty() {
+		return "No files were created, modified or deleted."
+	}
+	var sb strings.Builder
+	for _, group := range []struct {
+		label string
+		paths []string
+	}{
+		{"Created", c.Created},
+		{"Modified", c.Modified},
+		{"Deleted", c.Deleted},
+	} {
+		if len(group.paths) == 0 {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:\n", group.label)
+		for _, p := range group.paths {
+			fmt.Fprintf(&sb, "  %s\n", p)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// Match reports whether any of paths matches pattern, using path.Match syntax.
+// A trailing "/" on a directory is ignored, so "backups" matches a created
+// backups/ directory.
+func Match(paths []string, pattern string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	for _, p := range paths {
+		if ok, _ := path.Match(pattern, strings.TrimSuffix(p, "/")); ok {
+			return true
+		}
+	}
+	return false
+}
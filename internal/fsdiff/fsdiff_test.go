@@ -0,0 +1,68 @@
+package fsdiff
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	watched := filepath.Join(t.TempDir(), "watched")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(dir, "keep.txt"), "same")
+	write(filepath.Join(dir, "edit.txt"), "before")
+	write(filepath.Join(dir, "old/remove.log"), "bye")
+
+	before, err := Take(dir, []string{watched})
+	if err != nil {
+		t.Fatalf("Take: %v", err)
+	}
+
+	// Same size, different contents, so only the hash tells them apart.
+	write(filepath.Join(dir, "edit.txt"), "after!")
+	if err := os.RemoveAll(filepath.Join(dir, "old")); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(dir, "backups/keep.txt.bak"), "same")
+	write(filepath.Join(watched, "state"), "x")
+
+	after, err := Take(dir, []string{watched})
+	if err != nil {
+		t.Fatalf("Take: %v", err)
+	}
+	changes := before.Diff(after)
+
+	want := Changes{
+		Created:  []string{filepath.ToSlash(watched) + "/state", "backups/", "backups/keep.txt.bak"},
+		Modified: []string{"edit.txt"},
+		Deleted:  []string{"old/", "old/remove.log"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("unexpected changes:\n%s\nwant:\n%s", changes, want)
+	}
+
+	if !Match(changes.Created, "backups/*") {
+		t.Errorf("expected backups/* to match %v", changes.Created)
+	}
+	if !Match(changes.Created, "backups") {
+		t.Errorf("expected backups to match the created directory")
+	}
+	if Match(changes.Deleted, "*.log") {
+		t.Errorf("expected *.log not to match across directories")
+	}
+
+	if s := (Changes{}).String(); s != "No files were created, modified or deleted." {
+		t.Errorf("unexpected empty report %q", s)
+	}
+}
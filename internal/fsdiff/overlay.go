@@ -0,0 +1,73 @@
+package fsdiff
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// Overlay returns the snapshot as seen through an overlayfs mount whose lower
+// layer is the snapshotted directory and whose upper layer is upper, i.e. what
+// the directory would look like had the changes recorded in upper been made
+// to it. Deletions are read from overlayfs whiteouts and opaque directories.
+// Watched paths in the snapshot are left as they are.
+func (s *Snapshot) Overlay(upper string) (*Snapshot, error) {
+	merged := &Snapshot{files: make(map[string]state, len(s.files))}
+	for name, st := range s.files {
+		merged.files[name] = st
+	}
+
+	// WalkDir visits parents before their children, so a directory's
+	// whiteouts and opacity are applied before its new entries are added.
+	err := filepath.WalkDir(upper, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case isWhiteout(info):
+			merged.remove(name)
+		case d.IsDir():
+			if _, wasDir := merged.files[name+"/"]; !wasDir || isOpaque(p) {
+				merged.remove(name)
+			}
+			merged.files[name+"/"] = stat(p, info)
+		default:
+			merged.remove(name)
+			merged.files[name] = stat(p, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay changes: %w", err)
+	}
+	return merged, nil
+}
+
+// remove deletes name, whether it's a file or a directory, and everything
+// beneath it.
+func (s *Snapshot) remove(name string) {
+	delete(s.files, name)
+	for key := range s.files {
+		if key == name+"/" || strings.HasPrefix(key, name+"/") {
+			delete(s.files, key)
+		}
+	}
+}
+
+// isWhiteout reports whether an upper layer entry marks a deleted file.
+// Overlayfs whiteouts are character devices; scripts can't create those
+// without privileges, so there's no need to check the device number.
+func isWhiteout(info fs.FileInfo) bool {
+	return info.Mode()&fs.ModeCharDevice != 0
+}
@@ -0,0 +1,12 @@
+package fsdiff
+
+import "golang.org/x/sys/unix"
+
+// isOpaque reports whether an upper layer directory hides the lower layer's
+// contents, as happens when a directory is deleted and recreated. Unprivileged
+// overlayfs mounts (the userxattr option) mark this with a user xattr.
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Getxattr(dir, "user.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package fsdiff
+
+// isOpaque always reports false; overlayfs only exists on Linux.
+func isOpaque(dir string) bool {
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/statico/llmscript/internal/log"
@@ -21,20 +22,43 @@ type ScriptPair struct {
 	TestScript string // The test script that verifies the feature script
 }
 
-// generator produces raw text completions from a prompt. Each backend
-// (Claude, OpenAI, OpenRouter, Gemini, Ollama) implements this minimal
-// interface; the shared script-generation flow lives in scriptProvider.
+// generator produces raw text completions continuing a conversation, which
+// is usually a single prompt. Each backend (Claude, OpenAI, OpenRouter,
+// Gemini, Ollama) implements this minimal interface; the shared
+// script-generation flow lives in scriptProvider. Along with the text,
+// generators return the tokens the request used as far as the backend
+// reports them.
 type generator interface {
-	generate(ctx context.Context, prompt string) (string, error)
+	generate(ctx context.Context, messages []Message) (string, Usage, error)
 	name() string
 }
 
+// streamingGenerator is a generator that can also deliver its completion as
+// it's produced. onText is called with each chunk of text in order, along
+// with the number of output tokens so far if the backend reports it while
+// streaming and 0 otherwise, and the full text is returned at the end.
+type streamingGenerator interface {
+	generator
+	generateStream(ctx context.Context, messages []Message, onText func(text string, outputTokens int)) (string, Usage, error)
+}
+
 // scriptProvider implements Provider for any generator using a single shared
 // generate/test/fix flow, so each backend only has to know how to turn a
 // prompt into text.
 type scriptProvider struct {
 	gen         generator
 	extraPrompt string
+	retry       RetryConfig
+	// contextBudget is how many tokens a fix conversation may use; zero
+	// means no limit.
+	contextBudget int
+	// provider and model identify the backend for LastBackend.
+	provider string
+	model    string
+	// usage counts the tokens used since TakeUsage was last called. It's
+	// guarded by mu since candidates may be generated concurrently.
+	mu    sync.Mutex
+	usage Usage
 }
 
 // Name returns a human-readable name for the underlying backend.
@@ -42,33 +66,106 @@ func (p *scriptProvider) Name() string {
 	return p.gen.name()
 }
 
-// generate runs a single completion, bounding it with perRequestTimeout so no
-// backend can hang indefinitely.
-func (p *scriptProvider) generate(ctx context.Context, prompt string) (string, error) {
+// LastBackend returns the provider and model of the underlying backend.
+func (p *scriptProvider) LastBackend() (string, string) {
+	return p.provider, p.model
+}
+
+// TakeUsage returns the tokens used since it was last called.
+func (p *scriptProvider) TakeUsage() []ModelUsage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.usage == (Usage{}) {
+		return nil
+	}
+	usage := ModelUsage{Provider: p.provider, Model: p.model, Usage: p.usage}
+	p.usage = Usage{}
+	return []ModelUsage{usage}
+}
+
+// generate runs a completion for the described task, retrying failed
+// requests according to the provider's retry policy so that a rate limit or
+// an overloaded server doesn't abort the whole run.
+func (p *scriptProvider) generate(ctx context.Context, task string, messages []Message) (string, error) {
+	log.Info("%s with %s...", task, p.gen.name())
+	for attempt := 0; ; attempt++ {
+		text, err := p.request(ctx, task, messages)
+		if err == nil || ctx.Err() != nil {
+			return text, err
+		}
+
+		wait, fatal := p.retry.delay(attempt, err)
+		if fatal != nil {
+			return "", fatal
+		}
+		log.Warn("%s request failed, retrying in %s (%d/%d): %v", p.gen.name(), wait.Round(100*time.Millisecond), attempt+1, p.retry.MaxRetries, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+		log.Info("%s with %s...", task, p.gen.name())
+	}
+}
+
+// request runs a single completion, bounding it with perRequestTimeout so no
+// backend can hang indefinitely, and counts the tokens it used, including
+// those of failed requests. Backends that stream show the number of tokens
+// received in the spinner, or the number of chunks if they only count the
+// tokens at the end. With --verbose the text itself is printed, as it
+// arrives if the backend streams.
+func (p *scriptProvider) request(ctx context.Context, task string, messages []Message) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, perRequestTimeout)
 	defer cancel()
-	return p.gen.generate(ctx, prompt)
+
+	streamer, ok := p.gen.(streamingGenerator)
+	if !ok {
+		text, usage, err := p.gen.generate(ctx, messages)
+		if text != "" {
+			log.Stream(text + "\n")
+		}
+		p.addUsage(usage)
+		return text, err
+	}
+
+	chunks := 0
+	text, usage, err := streamer.generateStream(ctx, messages, func(chunk string, outputTokens int) {
+		chunks++
+		if outputTokens > 0 {
+			log.Progress("%s with %s... %d tokens received", task, p.gen.name(), outputTokens)
+		} else {
+			log.Progress("%s with %s... %d chunks received", task, p.gen.name(), chunks)
+		}
+		log.Stream(chunk)
+	})
+	if chunks > 0 {
+		log.Stream("\n")
+	}
+	p.addUsage(usage)
+	return text, err
+}
+
+func (p *scriptProvider) addUsage(usage Usage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.usage.Add(usage)
 }
 
 // GenerateScripts creates a main script and test script from a natural language description
 func (p *scriptProvider) GenerateScripts(ctx context.Context, description string) (ScriptPair, error) {
-	log.Info("Generating main script with %s...", p.gen.name())
 	mainPrompt := p.formatPrompt(FeatureScriptPrompt, description)
-	mainScript, err := p.generate(ctx, mainPrompt)
+	mainScript, err := p.generate(ctx, "Generating main script", userMessage(mainPrompt))
 	if err != nil {
 		return ScriptPair{}, fmt.Errorf("failed to generate main script: %w", err)
 	}
 	mainScript = ExtractScriptContent(mainScript)
-	log.Debug("Main script generated:\n%s", mainScript)
 
-	log.Info("Generating test script with %s...", p.gen.name())
 	testPrompt := p.formatPrompt(TestScriptPrompt, mainScript, description)
-	testScript, err := p.generate(ctx, testPrompt)
+	testScript, err := p.generate(ctx, "Generating test script", userMessage(testPrompt))
 	if err != nil {
 		return ScriptPair{}, fmt.Errorf("failed to generate test script: %w", err)
 	}
 	testScript = ExtractScriptContent(testScript)
-	log.Debug("Test script generated:\n%s", testScript)
 
 	return ScriptPair{
 		MainScript: strings.TrimSpace(mainScript),
@@ -76,19 +173,48 @@ func (p *scriptProvider) GenerateScripts(ctx context.Context, description string
 	}, nil
 }
 
-// FixScripts attempts to fix the main script based on test failures
-func (p *scriptProvider) FixScripts(ctx context.Context, scripts ScriptPair, failure string) (ScriptPair, error) {
-	mainPrompt := p.formatPrompt(FixScriptPrompt, scripts.MainScript, failure)
-	fixedMainScript, err := p.generate(ctx, mainPrompt)
-	if err != nil {
-		return ScriptPair{}, fmt.Errorf("failed to fix main script: %w", err)
+// FixScripts attempts to fix the latest scripts of a conversation based on
+// their test failures. Unless conv.FixMain is set, the model first triages
+// whether the main script, the test script or both are at fault; the main
+// script is fixed in view of its earlier versions, and a fixed test script is
+// only accepted if it keeps its test cases.
+func (p *scriptProvider) FixScripts(ctx context.Context, conv Conversation) (ScriptPair, error) {
+	if len(conv.Turns) == 0 {
+		return ScriptPair{}, fmt.Errorf("no failed script to fix")
+	}
+	last := conv.Turns[len(conv.Turns)-1]
+	scripts := ScriptPair{MainScript: last.MainScript, TestScript: last.TestScript}
+
+	fixMain, fixTest := true, false
+	if !conv.FixMain {
+		var err error
+		if fixMain, fixTest, err = p.triage(ctx, conv.Description, last); err != nil {
+			return ScriptPair{}, fmt.Errorf("failed to triage test failure: %w", err)
+		}
 	}
-	fixedMainScript = ExtractScriptContent(fixedMainScript)
 
-	return ScriptPair{
-		MainScript: strings.TrimSpace(fixedMainScript),
-		TestScript: scripts.TestScript,
-	}, nil
+	if fixTest {
+		testScript, err := p.fixTest(ctx, conv.Description, last)
+		if err != nil {
+			return ScriptPair{}, fmt.Errorf("failed to fix test script: %w", err)
+		}
+		if err := validateTestCaseCount(last.TestScript, testScript); err != nil {
+			log.Warn("Rejected the fixed test script: %v", err)
+			fixMain = true
+		} else {
+			scripts.TestScript = testScript
+		}
+	}
+
+	if fixMain {
+		fixedMainScript, err := p.generate(ctx, "Fixing main script", p.fixMessages(conv))
+		if err != nil {
+			return ScriptPair{}, fmt.Errorf("failed to fix main script: %w", err)
+		}
+		scripts.MainScript = strings.TrimSpace(ExtractScriptContent(fixedMainScript))
+	}
+
+	return scripts, nil
 }
 
 // formatPrompt fills in a prompt template, appending the current platform
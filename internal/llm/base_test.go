@@ -2,24 +2,32 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
 
-// fakeGenerator records the prompts it receives and returns canned responses.
+// fakeGenerator records the conversations it receives and returns canned
+// responses.
 type fakeGenerator struct {
 	responses []string
 	calls     int
-	prompts   []string
+	// prompts holds the last message of each conversation.
+	prompts       []string
+	conversations [][]Message
 }
 
 func (f *fakeGenerator) name() string { return "fake" }
 
-func (f *fakeGenerator) generate(_ context.Context, prompt string) (string, error) {
-	f.prompts = append(f.prompts, prompt)
+func (f *fakeGenerator) generate(_ context.Context, messages []Message) (string, Usage, error) {
+	f.prompts = append(f.prompts, messages[len(messages)-1].Content)
+	f.conversations = append(f.conversations, messages)
 	resp := f.responses[f.calls%len(f.responses)]
 	f.calls++
-	return resp, nil
+	return resp, Usage{}, nil
 }
 
 func TestScriptProvider_GenerateScripts(t *testing.T) {
@@ -80,20 +88,100 @@ func TestScriptProvider_FixScripts(t *testing.T) {
 	gen := &fakeGenerator{responses: []string{"<script>fixed</script>"}}
 	p := &scriptProvider{gen: gen}
 
-	in := ScriptPair{MainScript: "broken", TestScript: "the-test"}
-	out, err := p.FixScripts(context.Background(), in, "it failed")
+	conv := Conversation{Description: "print fixed", Turns: []Turn{{MainScript: "broken", TestScript: "the-test", Failure: "it failed"}}}
+	out, err := p.FixScripts(context.Background(), conv)
 	if err != nil {
 		t.Fatalf("FixScripts: %v", err)
 	}
+	// The failure is triaged first, then the main script is fixed.
+	if gen.calls != 2 {
+		t.Fatalf("expected 2 generate calls, got %d", gen.calls)
+	}
 	if out.MainScript != "fixed" {
 		t.Errorf("expected fixed main script, got %q", out.MainScript)
 	}
 	if out.TestScript != "the-test" {
 		t.Errorf("FixScripts should preserve the test script, got %q", out.TestScript)
 	}
-	if !strings.Contains(gen.prompts[0], "it failed") {
+	if !strings.Contains(gen.prompts[1], "it failed") {
 		t.Errorf("fix prompt should include the failure text")
 	}
+	if !strings.Contains(gen.prompts[1], "print fixed") {
+		t.Errorf("fix prompt should include the description")
+	}
+	if !strings.Contains(gen.prompts[1], "the-test") {
+		t.Errorf("fix prompt should include the test script")
+	}
+}
+
+func TestScriptProvider_Streaming(t *testing.T) {
+	chunks := []string{"Here you go:\n<script>\n", "#!/usr/bin/env bash\n", "echo ", "streamed\n", "</script>"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream {
+			t.Errorf("expected a streaming request")
+		}
+		for _, chunk := range chunks {
+			data, _ := json.Marshal(map[string]interface{}{"message": map[string]string{"role": "assistant", "content": chunk}, "done": false})
+			fmt.Fprintf(w, "%s\n", data)
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"prompt_eval_count":120,"eval_count":30}`)
+	}))
+	defer server.Close()
+
+	gen := newOllamaGenerator(OllamaConfig{Host: server.URL, Model: "test"})
+	var received []string
+	text, usage, err := gen.generateStream(context.Background(), userMessage("prompt"), func(chunk string, _ int) {
+		received = append(received, chunk)
+	})
+	if err != nil {
+		t.Fatalf("generateStream: %v", err)
+	}
+	if usage != (Usage{InputTokens: 120, OutputTokens: 30}) {
+		t.Errorf("expected the final chunk's token counts, got %+v", usage)
+	}
+	if strings.Join(received, "|") != strings.Join(chunks, "|") {
+		t.Errorf("expected chunks %q, got %q", chunks, received)
+	}
+	if text != strings.Join(chunks, "") {
+		t.Errorf("expected the full text, got %q", text)
+	}
+
+	// The provider streams and still extracts the script from the final text.
+	p := &scriptProvider{gen: gen, provider: "ollama", model: "test"}
+	out, err := p.FixScripts(context.Background(), Conversation{Description: "desc", Turns: []Turn{{MainScript: "broken", Failure: "failed"}}})
+	if err != nil {
+		t.Fatalf("FixScripts: %v", err)
+	}
+	if out.MainScript != "#!/usr/bin/env bash\necho streamed" {
+		t.Errorf("script not extracted from streamed text: %q", out.MainScript)
+	}
+
+	// The tokens used are reported once.
+	usage.Add(usage) // Triage and fix
+	want := []ModelUsage{{Provider: "ollama", Model: "test", Usage: usage}}
+	if got := p.TakeUsage(); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("expected usage %+v, got %+v", want, got)
+	}
+	if got := p.TakeUsage(); got != nil {
+		t.Errorf("expected no further usage, got %+v", got)
+	}
+}
+
+func TestOllamaGenerator_StreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"echo"},"done":false}`)
+		fmt.Fprintln(w, `{"error":"model crashed"}`)
+	}))
+	defer server.Close()
+
+	gen := newOllamaGenerator(OllamaConfig{Host: server.URL, Model: "test"})
+	_, _, err := gen.generateStream(context.Background(), userMessage("prompt"), func(string, int) {})
+	if err == nil || !strings.Contains(err.Error(), "model crashed") {
+		t.Fatalf("expected the streamed error, got %v", err)
+	}
 }
 
 func TestNewProvider(t *testing.T) {
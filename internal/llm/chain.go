@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/statico/llmscript/internal/log"
+)
+
+// chainProvider tries its providers in order, falling through to the next one
+// when a provider is unavailable or keeps failing after its retries. Once it
+// has fallen through it sticks with the provider that worked for the rest of
+// the run, so later fixes don't wait on a provider that's known to be down.
+type chainProvider struct {
+	providers []*scriptProvider
+	// current is guarded by mu since candidates may be generated
+	// concurrently.
+	mu      sync.Mutex
+	current int
+}
+
+// provider returns the index and the provider currently in use.
+func (c *chainProvider) provider() (int, *scriptProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current, c.providers[c.current]
+}
+
+// Name returns the name of the provider currently in use.
+func (c *chainProvider) Name() string {
+	_, p := c.provider()
+	return p.Name()
+}
+
+// LastBackend returns the provider and model that produced the most recent
+// scripts.
+func (c *chainProvider) LastBackend() (string, string) {
+	_, p := c.provider()
+	return p.LastBackend()
+}
+
+// TakeUsage returns the tokens each provider of the chain used since it was
+// last called.
+func (c *chainProvider) TakeUsage() []ModelUsage {
+	var usage []ModelUsage
+	for _, p := range c.providers {
+		usage = append(usage, p.TakeUsage()...)
+	}
+	return usage
+}
+
+func (c *chainProvider) GenerateScripts(ctx context.Context, description string) (ScriptPair, error) {
+	return c.try(ctx, func(p *scriptProvider) (ScriptPair, error) {
+		return p.GenerateScripts(ctx, description)
+	})
+}
+
+func (c *chainProvider) FixScripts(ctx context.Context, conv Conversation) (ScriptPair, error) {
+	return c.try(ctx, func(p *scriptProvider) (ScriptPair, error) {
+		return p.FixScripts(ctx, conv)
+	})
+}
+
+// try calls each provider from the current one on until one succeeds.
+func (c *chainProvider) try(ctx context.Context, call func(*scriptProvider) (ScriptPair, error)) (ScriptPair, error) {
+	var errs []error
+	first, _ := c.provider()
+	for i := first; i < len(c.providers); i++ {
+		p := c.providers[i]
+		scripts, err := call(p)
+		if err == nil {
+			c.mu.Lock()
+			if i > c.current {
+				provider, model := p.LastBackend()
+				log.Info("Using %s (%s) for the rest of this run", provider, model)
+				c.current = i
+			}
+			c.mu.Unlock()
+			return scripts, nil
+		}
+		if ctx.Err() != nil {
+			return ScriptPair{}, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+		if i+1 < len(c.providers) {
+			log.Warn("%s failed, falling back to %s: %v", p.Name(), c.providers[i+1].Name(), err)
+		}
+	}
+	return ScriptPair{}, fmt.Errorf("all providers failed: %w", errors.Join(errs...))
+}
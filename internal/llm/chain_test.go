@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingGenerator fails every request with err.
+type failingGenerator struct {
+	err   error
+	calls int
+}
+
+func (f *failingGenerator) name() string { return "failing" }
+
+func (f *failingGenerator) generate(context.Context, []Message) (string, Usage, error) {
+	f.calls++
+	return "", Usage{}, f.err
+}
+
+func TestChainProvider(t *testing.T) {
+	down := &failingGenerator{err: &StatusError{StatusCode: 401, Err: errors.New("invalid API key")}}
+	working := &fakeGenerator{responses: []string{"<script>echo ok</script>"}}
+	chain := &chainProvider{providers: []*scriptProvider{
+		{gen: down, provider: "claude", model: "claude-opus-4-8"},
+		{gen: working, provider: "ollama", model: "llama3.3"},
+	}}
+
+	pair, err := chain.GenerateScripts(context.Background(), "desc")
+	if err != nil {
+		t.Fatalf("expected the chain to fall back, got %v", err)
+	}
+	if pair.MainScript != "echo ok" {
+		t.Errorf("unexpected script %q", pair.MainScript)
+	}
+	if provider, model := chain.LastBackend(); provider != "ollama" || model != "llama3.3" {
+		t.Errorf("expected the fallback to be reported, got %s/%s", provider, model)
+	}
+
+	// The chain sticks with the provider that worked.
+	conv := Conversation{Description: "desc", Turns: []Turn{{MainScript: pair.MainScript, TestScript: pair.TestScript, Failure: "failed"}}}
+	if _, err := chain.FixScripts(context.Background(), conv); err != nil {
+		t.Fatalf("FixScripts: %v", err)
+	}
+	if down.calls != 1 {
+		t.Errorf("expected the failed provider to be skipped afterwards, got %d calls", down.calls)
+	}
+	if chain.Name() != "fake" {
+		t.Errorf("expected the name of the provider in use, got %s", chain.Name())
+	}
+}
+
+func TestChainProvider_AllFail(t *testing.T) {
+	chain := &chainProvider{providers: []*scriptProvider{
+		{gen: &failingGenerator{err: errors.New("connection refused")}},
+		{gen: &failingGenerator{err: errors.New("quota exceeded")}},
+	}}
+	_, err := chain.GenerateScripts(context.Background(), "desc")
+	if err == nil || !strings.Contains(err.Error(), "connection refused") || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("expected every provider's error, got %v", err)
+	}
+
+	// A cancelled run doesn't fall through.
+	first := &failingGenerator{err: context.Canceled}
+	second := &failingGenerator{err: errors.New("unused")}
+	chain = &chainProvider{providers: []*scriptProvider{{gen: first}, {gen: second}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := chain.GenerateScripts(ctx, "desc"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancellation, got %v", err)
+	}
+	if second.calls != 0 {
+		t.Errorf("expected no fallback after cancellation")
+	}
+}
+
+func TestNewProvider_Chain(t *testing.T) {
+	// Providers without an API key are skipped.
+	p, err := NewProvider(Config{Provider: "claude, openai, ollama", OpenAI: OpenAIConfig{APIKey: "k"}})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	chain, ok := p.(*chainProvider)
+	if !ok || len(chain.providers) != 2 {
+		t.Fatalf("expected a chain of openai and ollama, got %#v", p)
+	}
+	if provider, model := chain.LastBackend(); provider != "openai" || model != DefaultOpenAIModel {
+		t.Errorf("expected openai to be tried first, got %s/%s", provider, model)
+	}
+
+	if _, err := NewProvider(Config{Provider: "claude, gemini"}); err == nil {
+		t.Errorf("expected an error when no provider in the chain is usable")
+	}
+}
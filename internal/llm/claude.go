@@ -2,6 +2,7 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -15,26 +16,27 @@ type claudeGenerator struct {
 	model  string
 }
 
-// newClaudeGenerator creates a Claude-backed generator.
+// newClaudeGenerator creates a Claude-backed generator. The SDK's own retries
+// are disabled since scriptProvider retries according to the configured
+// policy.
 func newClaudeGenerator(config ClaudeConfig) *claudeGenerator {
-	client := anthropic.NewClient(option.WithAPIKey(config.APIKey))
+	client := anthropic.NewClient(option.WithAPIKey(config.APIKey), option.WithMaxRetries(0))
 	return &claudeGenerator{client: client, model: config.Model}
 }
 
 func (g *claudeGenerator) name() string { return "Claude" }
 
-func (g *claudeGenerator) generate(ctx context.Context, prompt string) (string, error) {
+func (g *claudeGenerator) generate(ctx context.Context, messages []Message) (string, Usage, error) {
 	msg, err := g.client.Messages.New(ctx, anthropic.MessageNewParams{
 		Model:     anthropic.Model(g.model),
 		MaxTokens: 8192,
-		Messages: []anthropic.MessageParam{
-			anthropic.NewUserMessage(anthropic.NewTextBlock(prompt)),
-		},
+		Messages:  claudeMessages(messages),
 	})
 	if err != nil {
-		return "", fmt.Errorf("request to Claude failed: %w", err)
+		return "", Usage{}, fmt.Errorf("request to Claude failed: %w", claudeError(err))
 	}
 
+	usage := claudeUsage(msg.Usage)
 	var sb strings.Builder
 	for _, block := range msg.Content {
 		if block.Type == "text" {
@@ -42,7 +44,73 @@ func (g *claudeGenerator) generate(ctx context.Context, prompt string) (string,
 		}
 	}
 	if sb.Len() == 0 {
-		return "", fmt.Errorf("no text content in Claude response")
+		return "", usage, fmt.Errorf("no text content in Claude response")
 	}
-	return sb.String(), nil
+	return sb.String(), usage, nil
+}
+
+func (g *claudeGenerator) generateStream(ctx context.Context, messages []Message, onText func(string, int)) (string, Usage, error) {
+	stream := g.client.Messages.NewStreaming(ctx, anthropic.MessageNewParams{
+		Model:     anthropic.Model(g.model),
+		MaxTokens: 8192,
+		Messages:  claudeMessages(messages),
+	})
+	defer func() { _ = stream.Close() }()
+
+	var sb strings.Builder
+	var usage Usage
+	for stream.Next() {
+		switch event := stream.Current().AsAny().(type) {
+		case anthropic.MessageStartEvent:
+			usage = claudeUsage(event.Message.Usage)
+		case anthropic.MessageDeltaEvent:
+			// The output token count is cumulative.
+			usage.OutputTokens = int(event.Usage.OutputTokens)
+		case anthropic.ContentBlockDeltaEvent:
+			if delta, ok := event.Delta.AsAny().(anthropic.TextDelta); ok && delta.Text != "" {
+				sb.WriteString(delta.Text)
+				// The output token count only arrives at the end.
+				onText(delta.Text, 0)
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return "", usage, fmt.Errorf("request to Claude failed: %w", claudeError(err))
+	}
+	if sb.Len() == 0 {
+		return "", usage, fmt.Errorf("no text content in Claude response")
+	}
+	return sb.String(), usage, nil
+}
+
+func claudeMessages(messages []Message) []anthropic.MessageParam {
+	params := make([]anthropic.MessageParam, 0, len(messages))
+	for _, m := range messages {
+		block := anthropic.NewTextBlock(m.Content)
+		if m.Role == RoleAssistant {
+			params = append(params, anthropic.NewAssistantMessage(block))
+		} else {
+			params = append(params, anthropic.NewUserMessage(block))
+		}
+	}
+	return params
+}
+
+// claudeUsage converts Claude's token counts, whose input tokens exclude
+// those read from or written to the prompt cache.
+func claudeUsage(u anthropic.Usage) Usage {
+	return Usage{
+		InputTokens:  int(u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens),
+		CachedTokens: int(u.CacheReadInputTokens),
+		OutputTokens: int(u.OutputTokens),
+	}
+}
+
+// claudeError exposes the HTTP status of a failed request for retrying.
+func claudeError(err error) error {
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		return newStatusError(apiErr.StatusCode, apiErr.Response, err)
+	}
+	return err
 }
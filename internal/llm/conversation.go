@@ -0,0 +1,105 @@
+package llm
+
+import "fmt"
+
+// DefaultContextBudget is the default for how many tokens a fix
+// conversation may use before its oldest turns are left out.
+const DefaultContextBudget = 32000
+
+// Role is who a message of a conversation comes from.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is one message of a conversation with the model.
+type Message struct {
+	Role    Role
+	Content string
+}
+
+// userMessage returns a conversation consisting of a single prompt.
+func userMessage(prompt string) []Message {
+	return []Message{{Role: RoleUser, Content: prompt}}
+}
+
+// Conversation is the history of one attempt at getting a script to pass its
+// tests. The Pipeline keeps one per attempt, so that each fix sees the
+// versions of the script that were already tried and why they failed rather
+// than going back to one of them.
+type Conversation struct {
+	Description string
+	// Turns holds each version of the scripts with its test failures,
+	// oldest first.
+	Turns []Turn
+	// FixMain skips triage and asks for a fix of the main script only, for
+	// instance after a fix of the test script was rejected.
+	FixMain bool
+}
+
+// Turn is a version of the scripts and how they failed.
+type Turn struct {
+	MainScript string
+	TestScript string
+	Failure    string
+	// ExamplesFailed is set if the user-authored examples failed, which is
+	// always the main script's fault.
+	ExamplesFailed bool
+}
+
+// fixMessages turns a conversation into messages asking for a fix of its
+// latest script. The first message is the full fix prompt for the original
+// script; each later version is the model's answer followed by its failures,
+// and by the test script if that was fixed in the meantime.
+// If that doesn't fit in the provider's context budget, the oldest versions
+// after the original are left out, and as a last resort only the latest one
+// is sent.
+func (p *scriptProvider) fixMessages(conv Conversation) []Message {
+	turns := conv.Turns
+	omitted := 0
+	for {
+		messages := p.buildFixMessages(conv, turns, omitted)
+		if p.contextBudget <= 0 || len(turns) == 1 || estimateTokens(messages) <= p.contextBudget {
+			return messages
+		}
+		if len(turns) > 2 {
+			turns = append(turns[:1:1], turns[2:]...)
+			omitted++
+		} else {
+			turns = turns[1:]
+		}
+	}
+}
+
+// buildFixMessages lays out turns as a conversation. omitted counts the
+// versions left out after the first one.
+func (p *scriptProvider) buildFixMessages(conv Conversation, turns []Turn, omitted int) []Message {
+	first := turns[0]
+	messages := userMessage(p.formatPrompt(FixScriptPrompt, conv.Description, first.MainScript, first.TestScript, first.Failure))
+	for i, turn := range turns[1:] {
+		var note string
+		if i == 0 && omitted > 0 {
+			note = fmt.Sprintf("(Failed versions left out here to save space: %d.)\n\n", omitted)
+		}
+		if turn.TestScript != turns[i].TestScript {
+			note += "The test script was corrected in the meantime. It now is:\n\n<test_script>\n" + turn.TestScript + "\n</test_script>\n\n"
+		}
+		messages = append(messages,
+			Message{Role: RoleAssistant, Content: "<script>\n" + turn.MainScript + "\n</script>"},
+			Message{Role: RoleUser, Content: note + fmt.Sprintf(FixFollowUpPrompt, turn.Failure)},
+		)
+	}
+	return messages
+}
+
+// estimateTokens roughly estimates the tokens messages use, at four
+// characters per token.
+func estimateTokens(messages []Message) int {
+	var n int
+	for _, m := range messages {
+		n += len(m.Content)
+	}
+	return n / 4
+}
@@ -0,0 +1,91 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestScriptProvider_FixConversation(t *testing.T) {
+	gen := &fakeGenerator{responses: []string{"<script>v4</script>"}}
+	p := &scriptProvider{gen: gen}
+
+	conv := Conversation{Description: "print hello", Turns: []Turn{
+		{MainScript: "v1", TestScript: "the-test", Failure: "v1 failed"},
+		{MainScript: "v2", TestScript: "the-test", Failure: "v2 failed"},
+		{MainScript: "v3", TestScript: "the-test", Failure: "v3 failed"},
+	}}
+	out, err := p.FixScripts(context.Background(), conv)
+	if err != nil {
+		t.Fatalf("FixScripts: %v", err)
+	}
+	if out.MainScript != "v4" || out.TestScript != "the-test" {
+		t.Errorf("unexpected scripts %+v", out)
+	}
+
+	// The original fix prompt, then each later version and its failures.
+	messages := gen.conversations[len(gen.conversations)-1]
+	roles := make([]string, len(messages))
+	for i, m := range messages {
+		roles[i] = string(m.Role)
+	}
+	if got := strings.Join(roles, ","); got != "user,assistant,user,assistant,user" {
+		t.Fatalf("unexpected conversation %s", got)
+	}
+	for _, want := range []string{"print hello", "the-test", "v1", "v1 failed"} {
+		if !strings.Contains(messages[0].Content, want) {
+			t.Errorf("first message should contain %q", want)
+		}
+	}
+	if !strings.Contains(messages[1].Content, "v2") || !strings.Contains(messages[2].Content, "v2 failed") {
+		t.Errorf("expected the second version and its failures next, got %q and %q", messages[1].Content, messages[2].Content)
+	}
+	if !strings.Contains(messages[4].Content, "v3 failed") {
+		t.Errorf("expected to end with the latest failures, got %q", messages[4].Content)
+	}
+
+	if _, err := p.FixScripts(context.Background(), Conversation{Description: "print hello"}); err == nil {
+		t.Errorf("expected an error without a script to fix")
+	}
+}
+
+func TestScriptProvider_FixConversationBudget(t *testing.T) {
+	long := strings.Repeat("x", 4000) // About 1000 tokens.
+	conv := Conversation{Description: "print hello", Turns: []Turn{
+		{MainScript: "v1", TestScript: "the-test", Failure: long},
+		{MainScript: "v2", TestScript: "the-test", Failure: long},
+		{MainScript: "v3", TestScript: "the-test", Failure: long},
+		{MainScript: "v4", TestScript: "the-test", Failure: "v4 failed"},
+	}}
+	p := &scriptProvider{}
+	base := estimateTokens(p.fixMessages(Conversation{Description: "print hello", Turns: conv.Turns[:1]}))
+
+	// Unlimited, and a budget with room for one of the middle versions.
+	if messages := p.fixMessages(conv); len(messages) != 7 {
+		t.Errorf("expected the whole conversation without a budget, got %d messages", len(messages))
+	}
+	p.contextBudget = base + 1200
+	messages := p.fixMessages(conv)
+	if len(messages) != 5 {
+		t.Fatalf("expected the oldest middle version to be left out, got %d messages", len(messages))
+	}
+	if !strings.Contains(messages[0].Content, "v1") || !strings.Contains(messages[1].Content, "v3") {
+		t.Errorf("expected the original and the latest versions to be kept")
+	}
+	if !strings.Contains(messages[2].Content, "left out here to save space: 1") {
+		t.Errorf("expected a note about the left out version, got %q", messages[2].Content)
+	}
+	if !strings.Contains(messages[4].Content, "v4 failed") {
+		t.Errorf("expected the latest failures to be kept, got %q", messages[4].Content)
+	}
+
+	// Too small a budget falls back to fixing the latest version alone.
+	p.contextBudget = 10
+	messages = p.fixMessages(conv)
+	if len(messages) != 1 || !strings.Contains(messages[0].Content, "v4 failed") {
+		t.Errorf("expected only the latest version, got %d messages", len(messages))
+	}
+	if len(conv.Turns) != 4 || conv.Turns[1].MainScript != "v2" {
+		t.Errorf("the conversation itself must not change")
+	}
+}
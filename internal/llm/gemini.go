@@ -2,7 +2,9 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"google.golang.org/genai"
 )
@@ -31,14 +33,74 @@ func newGeminiGenerator(ctx context.Context, config GeminiConfig) (*geminiGenera
 
 func (g *geminiGenerator) name() string { return "Gemini" }
 
-func (g *geminiGenerator) generate(ctx context.Context, prompt string) (string, error) {
-	result, err := g.client.Models.GenerateContent(ctx, g.model, genai.Text(prompt), nil)
+func (g *geminiGenerator) generate(ctx context.Context, messages []Message) (string, Usage, error) {
+	result, err := g.client.Models.GenerateContent(ctx, g.model, geminiContents(messages), nil)
 	if err != nil {
-		return "", fmt.Errorf("request to Gemini failed: %w", err)
+		return "", Usage{}, fmt.Errorf("request to Gemini failed: %w", geminiError(err))
 	}
+	usage := geminiUsage(result.UsageMetadata)
 	text := result.Text()
 	if text == "" {
-		return "", fmt.Errorf("empty response from Gemini (check finish reason / safety filters)")
+		return "", usage, fmt.Errorf("empty response from Gemini (check finish reason / safety filters)")
 	}
-	return text, nil
+	return text, usage, nil
+}
+
+func (g *geminiGenerator) generateStream(ctx context.Context, messages []Message, onText func(string, int)) (string, Usage, error) {
+	var sb strings.Builder
+	var usage Usage
+	for result, err := range g.client.Models.GenerateContentStream(ctx, g.model, geminiContents(messages), nil) {
+		if err != nil {
+			return "", usage, fmt.Errorf("request to Gemini failed: %w", geminiError(err))
+		}
+		// Each chunk carries the counts so far.
+		if result.UsageMetadata != nil {
+			usage = geminiUsage(result.UsageMetadata)
+		}
+		if text := result.Text(); text != "" {
+			sb.WriteString(text)
+			onText(text, usage.OutputTokens)
+		}
+	}
+	if sb.Len() == 0 {
+		return "", usage, fmt.Errorf("empty response from Gemini (check finish reason / safety filters)")
+	}
+	return sb.String(), usage, nil
+}
+
+// geminiContents converts a conversation, in which Gemini calls the
+// assistant the model.
+func geminiContents(messages []Message) []*genai.Content {
+	contents := make([]*genai.Content, 0, len(messages))
+	for _, m := range messages {
+		role := genai.Role(genai.RoleUser)
+		if m.Role == RoleAssistant {
+			role = genai.RoleModel
+		}
+		contents = append(contents, genai.NewContentFromText(m.Content, role))
+	}
+	return contents
+}
+
+// geminiUsage converts Gemini's token counts. Thinking tokens are billed as
+// output.
+func geminiUsage(u *genai.GenerateContentResponseUsageMetadata) Usage {
+	if u == nil {
+		return Usage{}
+	}
+	return Usage{
+		InputTokens:  int(u.PromptTokenCount),
+		CachedTokens: int(u.CachedContentTokenCount),
+		OutputTokens: int(u.CandidatesTokenCount + u.ThoughtsTokenCount),
+	}
+}
+
+// geminiError exposes the HTTP status of a failed request for retrying. The
+// SDK doesn't expose the response headers, so there's no Retry-After.
+func geminiError(err error) error {
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		return newStatusError(apiErr.Code, nil, err)
+	}
+	return err
 }
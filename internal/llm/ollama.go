@@ -13,7 +13,7 @@ import (
 
 // ollamaGenerator generates text using a local Ollama server. Ollama needs no
 // SDK or API key, so this stays a small raw-HTTP client against the native
-// /api/generate endpoint.
+// /api/chat endpoint.
 type ollamaGenerator struct {
 	config OllamaConfig
 }
@@ -24,48 +24,114 @@ func newOllamaGenerator(config OllamaConfig) *ollamaGenerator {
 
 func (g *ollamaGenerator) name() string { return "Ollama" }
 
-func (g *ollamaGenerator) generate(ctx context.Context, prompt string) (string, error) {
-	url := fmt.Sprintf("%s/api/generate", g.config.Host)
+func (g *ollamaGenerator) generate(ctx context.Context, messages []Message) (string, Usage, error) {
+	resp, err := g.post(ctx, messages, false)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer closeBody(resp)
+
+	var result ollamaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", Usage{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return result.Message.Content, result.usage(), nil
+}
+
+// generateStream reads the newline-delimited JSON objects Ollama sends when
+// streaming, each carrying the next piece of the response. The final one
+// carries the token counts.
+func (g *ollamaGenerator) generateStream(ctx context.Context, messages []Message, onText func(string, int)) (string, Usage, error) {
+	resp, err := g.post(ctx, messages, true)
+	if err != nil {
+		return "", Usage{}, err
+	}
+	defer closeBody(resp)
+
+	var sb strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaResponse
+		if err := decoder.Decode(&chunk); err != nil {
+			if err == io.EOF {
+				return "", Usage{}, fmt.Errorf("response ended before it was done")
+			}
+			return "", Usage{}, fmt.Errorf("failed to decode response: %w", err)
+		}
+		if chunk.Error != "" {
+			return "", Usage{}, fmt.Errorf("request failed: %s", chunk.Error)
+		}
+		if text := chunk.Message.Content; text != "" {
+			sb.WriteString(text)
+			onText(text, 0)
+		}
+		if chunk.Done {
+			return sb.String(), chunk.usage(), nil
+		}
+	}
+}
+
+// ollamaMessage is a message of an /api/chat conversation.
+type ollamaMessage struct {
+	Role    Role   `json:"role"`
+	Content string `json:"content"`
+}
+
+// ollamaResponse is a response from /api/chat, or one chunk of it when
+// streaming.
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	Error           string        `json:"error"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+func (r ollamaResponse) usage() Usage {
+	return Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+}
 
+func (g *ollamaGenerator) post(ctx context.Context, messages []Message, stream bool) (*http.Response, error) {
+	url := fmt.Sprintf("%s/api/chat", g.config.Host)
+
+	chat := make([]ollamaMessage, 0, len(messages))
+	for _, m := range messages {
+		chat = append(chat, ollamaMessage(m))
+	}
 	reqBody := map[string]interface{}{
-		"model":  g.config.Model,
-		"prompt": prompt,
-		"stream": false,
+		"model":    g.config.Model,
+		"messages": chat,
+		"stream":   stream,
 	}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonData)))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Error("failed to close response body: %v", err)
-		}
-	}()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		closeBody(resp)
+		err := fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, newStatusError(resp.StatusCode, resp, err)
 	}
+	return resp, nil
+}
 
-	var result struct {
-		Response string `json:"response"`
-		Done     bool   `json:"done"`
+func closeBody(resp *http.Response) {
+	if err := resp.Body.Close(); err != nil {
+		log.Error("failed to close response body: %v", err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
-	}
-
-	return result.Response, nil
 }
@@ -2,26 +2,30 @@ package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/openai/openai-go/v3"
 	"github.com/openai/openai-go/v3/option"
 )
 
 // openaiCompatGenerator generates text against any OpenAI Chat Completions
-// compatible endpoint using the official openai-go SDK. It backs both the
-// OpenAI and OpenRouter providers, which differ only by base URL, key, model
-// ID format, and optional headers.
+// compatible endpoint using the official openai-go SDK. It backs the OpenAI
+// and OpenRouter providers as well as user-configured compatible servers,
+// which differ only by base URL, key, model ID format, and optional headers.
 type openaiCompatGenerator struct {
 	client openai.Client
 	model  string
 	label  string
 }
 
-// newOpenAIGenerator creates a generator backed by OpenAI's own API.
+// newOpenAIGenerator creates a generator backed by OpenAI's own API. The SDK's
+// own retries are disabled since scriptProvider retries according to the
+// configured policy.
 func newOpenAIGenerator(apiKey, model string) *openaiCompatGenerator {
 	return &openaiCompatGenerator{
-		client: openai.NewClient(option.WithAPIKey(apiKey)),
+		client: openai.NewClient(option.WithAPIKey(apiKey), option.WithMaxRetries(0)),
 		model:  model,
 		label:  "OpenAI",
 	}
@@ -31,33 +35,128 @@ func newOpenAIGenerator(apiKey, model string) *openaiCompatGenerator {
 // OpenAI Chat Completions compatible. The X-Title header is optional and only
 // used for attribution on openrouter.ai.
 func newOpenRouterGenerator(apiKey, model string) *openaiCompatGenerator {
+	return newOpenAICompatibleGenerator("OpenRouter", OpenAICompatibleConfig{
+		BaseURL: openRouterBaseURL,
+		APIKey:  apiKey,
+		Model:   model,
+		// Optional attribution headers used for ranking on openrouter.ai.
+		Headers: map[string]string{
+			"HTTP-Referer": "https://github.com/statico/llmscript",
+			"X-Title":      "llmscript",
+		},
+	})
+}
+
+// newOpenAICompatibleGenerator creates a generator for a server that
+// implements OpenAI's Chat Completions API, such as vLLM, LM Studio, a
+// llama.cpp server or a LiteLLM gateway. Only the configured credentials are
+// sent: the OPENAI_* environment variables the SDK reads by default are
+// meant for OpenAI and mustn't leak to another server.
+func newOpenAICompatibleGenerator(label string, config OpenAICompatibleConfig) *openaiCompatGenerator {
+	opts := []option.RequestOption{
+		option.WithBaseURL(config.BaseURL),
+		option.WithAPIKey(config.APIKey),
+		option.WithMaxRetries(0),
+		option.WithHeaderDel("OpenAI-Organization"),
+		option.WithHeaderDel("OpenAI-Project"),
+	}
+	if config.APIKey == "" {
+		// Local servers usually need no key at all.
+		opts = append(opts, option.WithHeaderDel("Authorization"))
+	}
+	if config.Organization != "" {
+		opts = append(opts, option.WithOrganization(config.Organization))
+	}
+	if config.Project != "" {
+		opts = append(opts, option.WithProject(config.Project))
+	}
+	for name, value := range config.Headers {
+		opts = append(opts, option.WithHeader(name, value))
+	}
+
 	return &openaiCompatGenerator{
-		client: openai.NewClient(
-			option.WithAPIKey(apiKey),
-			option.WithBaseURL(openRouterBaseURL),
-			// Optional attribution headers used for ranking on openrouter.ai.
-			option.WithHeader("HTTP-Referer", "https://github.com/statico/llmscript"),
-			option.WithHeader("X-Title", "llmscript"),
-		),
-		model: model,
-		label: "OpenRouter",
+		client: openai.NewClient(opts...),
+		model:  config.Model,
+		label:  label,
 	}
 }
 
 func (g *openaiCompatGenerator) name() string { return g.label }
 
-func (g *openaiCompatGenerator) generate(ctx context.Context, prompt string) (string, error) {
+func (g *openaiCompatGenerator) generate(ctx context.Context, messages []Message) (string, Usage, error) {
 	resp, err := g.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Model: openai.ChatModel(g.model),
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.UserMessage(prompt),
-		},
+		Model:    openai.ChatModel(g.model),
+		Messages: openaiMessages(messages),
 	})
 	if err != nil {
-		return "", fmt.Errorf("%s request failed: %w", g.label, err)
+		return "", Usage{}, fmt.Errorf("%s request failed: %w", g.label, openaiError(err))
 	}
+	usage := openaiUsage(resp.Usage)
 	if len(resp.Choices) == 0 {
-		return "", fmt.Errorf("no choices in %s response", g.label)
+		return "", usage, fmt.Errorf("no choices in %s response", g.label)
+	}
+	return resp.Choices[0].Message.Content, usage, nil
+}
+
+// generateStream asks for the token counts to be included in the stream,
+// which they are in a final chunk without choices.
+func (g *openaiCompatGenerator) generateStream(ctx context.Context, messages []Message, onText func(string, int)) (string, Usage, error) {
+	stream := g.client.Chat.Completions.NewStreaming(ctx, openai.ChatCompletionNewParams{
+		Model:         openai.ChatModel(g.model),
+		Messages:      openaiMessages(messages),
+		StreamOptions: openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)},
+	})
+	defer func() { _ = stream.Close() }()
+
+	var sb strings.Builder
+	var usage Usage
+	for stream.Next() {
+		chunk := stream.Current()
+		if chunk.Usage.TotalTokens > 0 {
+			usage = openaiUsage(chunk.Usage)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		text := chunk.Choices[0].Delta.Content
+		sb.WriteString(text)
+		onText(text, 0)
+	}
+	if err := stream.Err(); err != nil {
+		return "", usage, fmt.Errorf("%s request failed: %w", g.label, openaiError(err))
+	}
+	if sb.Len() == 0 {
+		return "", usage, fmt.Errorf("no content in %s response", g.label)
+	}
+	return sb.String(), usage, nil
+}
+
+func openaiMessages(messages []Message) []openai.ChatCompletionMessageParamUnion {
+	params := make([]openai.ChatCompletionMessageParamUnion, 0, len(messages))
+	for _, m := range messages {
+		if m.Role == RoleAssistant {
+			params = append(params, openai.AssistantMessage(m.Content))
+		} else {
+			params = append(params, openai.UserMessage(m.Content))
+		}
+	}
+	return params
+}
+
+// openaiUsage converts the token counts of a Chat Completions response.
+func openaiUsage(u openai.CompletionUsage) Usage {
+	return Usage{
+		InputTokens:  int(u.PromptTokens),
+		CachedTokens: int(u.PromptTokensDetails.CachedTokens),
+		OutputTokens: int(u.CompletionTokens),
+	}
+}
+
+// openaiError exposes the HTTP status of a failed request for retrying.
+func openaiError(err error) error {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		return newStatusError(apiErr.StatusCode, apiErr.Response, err)
 	}
-	return resp.Choices[0].Message.Content, nil
+	return err
 }
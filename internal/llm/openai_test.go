@@ -0,0 +1,34 @@
+package llm
+
+import "testing"
+
+func TestNewProvider_OpenAICompatible(t *testing.T) {
+	servers := map[string]OpenAICompatibleConfig{
+		"vllm":    {BaseURL: "http://localhost:8000/v1", Model: "qwen3-coder"},
+		"gateway": {BaseURL: "https://llm.internal/v1", APIKey: "k", Model: "gpt-5.5"},
+		"broken":  {Model: "no-url"},
+	}
+
+	p, err := NewProvider(Config{Provider: "broken, gateway, vllm", OpenAICompatible: servers})
+	if err != nil {
+		t.Fatalf("NewProvider: %v", err)
+	}
+	chain, ok := p.(*chainProvider)
+	if !ok || len(chain.providers) != 2 {
+		t.Fatalf("expected a chain of gateway and vllm, got %#v", p)
+	}
+	if provider, model := chain.LastBackend(); provider != "gateway" || model != "gpt-5.5" {
+		t.Errorf("expected gateway to be tried first, got %s/%s", provider, model)
+	}
+	if chain.Name() != "gateway" {
+		t.Errorf("expected the server's name, got %s", chain.Name())
+	}
+
+	if _, err := NewProvider(Config{Provider: "lmstudio", OpenAICompatible: servers}); err == nil {
+		t.Errorf("expected an error for an unknown server")
+	}
+	clash := map[string]OpenAICompatibleConfig{"openai": {BaseURL: "http://localhost:8000/v1", Model: "m"}}
+	if _, err := NewProvider(Config{Provider: "openai", OpenAICompatible: clash}); err == nil {
+		t.Errorf("expected an error for a server named like a built-in provider")
+	}
+}
@@ -1,5 +1,10 @@
 package llm
 
+// PromptVersion identifies the prompt templates below. It is part of the cache
+// key, so bump it whenever a change to the prompts should stop previously
+// cached scripts from being reused.
+const PromptVersion = "5"
+
 const (
 	// FeatureScriptPrompt is used to generate the main feature script
 	FeatureScriptPrompt = `You are an expert shell script developer with deep knowledge of Unix/Linux systems, shell scripting best practices, and error handling.
@@ -58,6 +63,10 @@ Target platform Information:
 <requirements>
 - The script you're testing is ./script.sh
 - Create a test script that runs one or more test cases to make sure that ./script.sh works as expected
+- Start each test case with a comment line of the form "# Test case: <what it checks>"
+- Report the results in TAP format: first print the plan "1..N", where N is the number of test cases, then for each test case print "ok <number> - <what it checks>" if it passed or "not ok <number> - <what it checks>" if it failed
+- After a failing test case, print what went wrong as lines starting with "# ", such as the expected and the actual output
+- Run every test case even if an earlier one fails, and don't print anything else that starts with "ok", "not ok" or "1.."
 - Each test case should:
    - Set up the test environment
    - Run the main script with test inputs
@@ -91,10 +100,18 @@ Your expertise includes error handling, cross-platform compatibility, and shell
 
 Fix the following script based on the test failures:
 
+<description>
+%s
+</description>
+
 <script>
 %s
 </script>
 
+<test_script>
+%s
+</test_script>
+
 <test_failures>
 %s
 </test_failures>
@@ -106,6 +123,8 @@ Target platform Information:
 
 <requirements>
 - Fix all test failures while maintaining existing functionality
+- The test failures list only the failing test cases, in TAP format with their diagnostics; the other test cases already pass and must keep passing
+- The test script runs the script as ./script.sh and must pass unchanged
 - Improve error handling and validation
 - Follow shell scripting best practices
 - Ensure cross-platform compatibility
@@ -121,5 +140,106 @@ Output your response in the following format:
 </script>
 
 Do not include any other text, explanations, or markdown formatting. Only output the script between the markers.
+</output_format>`
+
+	// FixFollowUpPrompt follows the model's previous fix in a fix
+	// conversation when that fix failed its tests too
+	FixFollowUpPrompt = `That version of the script fails the tests as well:
+
+<test_failures>
+%s
+</test_failures>
+
+Fix the script again. Learn from the earlier versions above and why they failed: don't go back to an approach that has already failed.
+
+Output only the fixed script between the <script> and </script> markers, as before.`
+
+	// TriagePrompt is used to decide whether the main script, the test script
+	// or both are at fault for a test failure
+	TriagePrompt = `You are an expert shell script developer reviewing a failed test run.
+A script was written for the task below, along with a test script that checks it. The test failed. Decide which of them is wrong.
+
+<description>
+%s
+</description>
+
+<script>
+%s
+</script>
+
+<test_script>
+%s
+</test_script>
+
+<test_failures>
+%s
+</test_failures>
+
+<target_platform>
+Target platform Information:
+%s
+</target_platform>
+
+<requirements>
+- The description is the specification: a test is only wrong if it expects something the description doesn't ask for, or checks it in a broken or non-portable way
+- Failures of the examples are never the test script's fault, since the examples come from the user
+- Answer "script" if only the script is wrong, "test" if only the test script is wrong, or "both"
+</requirements>
+
+<output_format>
+Output your response in the following format:
+
+<verdict>script, test or both</verdict>
+<reason>One sentence explaining why</reason>
+
+You *MUST NOT* include any other text, explanations, or markdown formatting.
+</output_format>`
+
+	// FixTestPrompt is used to fix a test script that is wrong
+	FixTestPrompt = `You are an expert in testing shell scripts with extensive experience in test automation and quality assurance.
+The test script below was written to check ./script.sh, but it is wrong: it failed for reasons that aren't the script's fault.
+
+Fix the following test script:
+
+<description>
+%s
+</description>
+
+<script>
+%s
+</script>
+
+<test_script>
+%s
+</test_script>
+
+<test_failures>
+%s
+</test_failures>
+
+<target_platform>
+Target platform Information:
+%s
+</target_platform>
+
+<requirements>
+- Fix the mistakes in the test script, such as wrong expectations or non-portable commands and flags
+- Keep every test case, each starting with its "# Test case: <what it checks>" comment line, and don't remove or loosen any check that the description asks for
+- Keep reporting the results in TAP format: the plan "1..N", then "ok <number> - <what it checks>" or "not ok <number> - <what it checks>" for each test case, with diagnostics as lines starting with "# " after a failing one
+- The test script must still run ./script.sh and must fail when ./script.sh doesn't do what the description asks for
+- Do not modify ./script.sh, only test it
+- Return exit code 0 if all tests pass, or 1 if any test fails
+- Keep the script short, concise, and simple
+</requirements>
+
+<output_format>
+Output your response in the following format:
+
+<script>
+#!/usr/bin/env bash
+# Your fixed test script content here
+</script>
+
+You *MUST NOT* include any other text, explanations, or markdown formatting.
 </output_format>`
 )
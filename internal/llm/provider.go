@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+
+	"github.com/statico/llmscript/internal/log"
 )
 
 // Default models for each provider. These target the most capable tier as of
@@ -26,8 +28,9 @@ const (
 type Provider interface {
 	// GenerateScripts creates a main script and test script from a natural language description
 	GenerateScripts(ctx context.Context, description string) (ScriptPair, error)
-	// FixScripts attempts to fix the main script based on a test failure
-	FixScripts(ctx context.Context, scripts ScriptPair, failure string) (ScriptPair, error)
+	// FixScripts attempts to fix the latest main script of a conversation
+	// based on its test failures
+	FixScripts(ctx context.Context, conv Conversation) (ScriptPair, error)
 	// Name returns a human-readable name for the provider
 	Name() string
 }
@@ -54,14 +57,90 @@ func GetPlatformInfo() string {
 	return strings.Join(info, "\n")
 }
 
-// NewProvider creates a new LLM provider from a fully-resolved Config.
+// PlatformFingerprint summarizes the parts of GetPlatformInfo that affect how
+// a generated script behaves: the operating system, the architecture and the
+// bash version. Unlike GetPlatformInfo it leaves out the host name and kernel
+// build, so it's stable across machines of the same kind.
+func PlatformFingerprint() string {
+	fingerprint := runtime.GOOS + "/" + runtime.GOARCH
+	if output, err := exec.Command("bash", "--version").Output(); err == nil {
+		// "GNU bash, version 5.2.21(1)-release (x86_64-pc-linux-gnu)"
+		firstLine, _, _ := strings.Cut(string(output), "\n")
+		if _, version, ok := strings.Cut(firstLine, "version "); ok {
+			major, rest, _ := strings.Cut(version, ".")
+			minor, _, _ := strings.Cut(rest, ".")
+			fingerprint += " bash " + major + "." + minor
+		}
+	}
+	return fingerprint
+}
+
+// builtinProviders are the provider names that can't be used for an
+// OpenAI-compatible server.
+var builtinProviders = map[string]bool{
+	"ollama": true, "claude": true, "anthropic": true, "openai": true,
+	"openrouter": true, "gemini": true, "google": true,
+}
+
+// BackendReporter is implemented by providers to report the provider and
+// model that produced their most recent scripts, which for a fallback chain
+// may not be the first one configured.
+type BackendReporter interface {
+	LastBackend() (provider, model string)
+}
+
+// ParseProviders splits a provider setting, either a single provider name or
+// a comma-separated fallback chain such as "claude, openrouter, ollama", into
+// provider names.
+func ParseProviders(setting string) []string {
+	var providers []string
+	for _, name := range strings.Split(setting, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			providers = append(providers, name)
+		}
+	}
+	return providers
+}
+
+// NewProvider creates a new LLM provider from a fully-resolved Config. A
+// provider is either a built-in one or the name of an OpenAI-compatible
+// server in cfg.OpenAICompatible. If cfg.Provider lists several providers,
+// the result tries them in order, skipping providers that aren't configured,
+// such as ones without an API key.
 func NewProvider(cfg Config) (Provider, error) {
-	provider := cfg.Provider
-	if provider == "" {
-		provider = "ollama" // Default to Ollama if no provider specified
+	names := ParseProviders(cfg.Provider)
+	if len(names) == 0 {
+		names = []string{"ollama"} // Default to Ollama if no provider specified
+	}
+	for name := range cfg.OpenAICompatible {
+		if builtinProviders[name] {
+			return nil, fmt.Errorf("openai_compatible server %q has the name of a built-in provider", name)
+		}
+	}
+	if len(names) == 1 {
+		return newScriptProvider(names[0], cfg)
 	}
 
+	chain := &chainProvider{}
+	for _, name := range names {
+		p, err := newScriptProvider(name, cfg)
+		if err != nil {
+			log.Warn("Skipping %s in the provider chain: %v", name, err)
+			continue
+		}
+		chain.providers = append(chain.providers, p)
+	}
+	if len(chain.providers) == 0 {
+		return nil, fmt.Errorf("none of the providers %s is usable", strings.Join(names, ", "))
+	}
+	return chain, nil
+}
+
+// newScriptProvider creates the provider with the given name.
+func newScriptProvider(provider string, cfg Config) (*scriptProvider, error) {
 	var gen generator
+	var model string
+	var retry RetryConfig
 	var err error
 
 	switch provider {
@@ -74,42 +153,47 @@ func NewProvider(cfg Config) (Provider, error) {
 			oc.Host = DefaultOllamaHost
 		}
 		gen = newOllamaGenerator(oc)
+		model = oc.Model
+		retry = oc.Retry
 
 	case "claude", "anthropic":
 		if cfg.Claude.APIKey == "" {
 			return nil, fmt.Errorf("a Claude API key is required")
 		}
-		model := cfg.Claude.Model
+		model = cfg.Claude.Model
 		if model == "" {
 			model = DefaultClaudeModel
 		}
 		gen = newClaudeGenerator(ClaudeConfig{APIKey: cfg.Claude.APIKey, Model: model})
+		retry = cfg.Claude.Retry
 
 	case "openai":
 		if cfg.OpenAI.APIKey == "" {
 			return nil, fmt.Errorf("an OpenAI API key is required")
 		}
-		model := cfg.OpenAI.Model
+		model = cfg.OpenAI.Model
 		if model == "" {
 			model = DefaultOpenAIModel
 		}
 		gen = newOpenAIGenerator(cfg.OpenAI.APIKey, model)
+		retry = cfg.OpenAI.Retry
 
 	case "openrouter":
 		if cfg.OpenRouter.APIKey == "" {
 			return nil, fmt.Errorf("an OpenRouter API key is required")
 		}
-		model := cfg.OpenRouter.Model
+		model = cfg.OpenRouter.Model
 		if model == "" {
 			model = DefaultOpenRouterModel
 		}
 		gen = newOpenRouterGenerator(cfg.OpenRouter.APIKey, model)
+		retry = cfg.OpenRouter.Retry
 
 	case "gemini", "google":
 		if cfg.Gemini.APIKey == "" {
 			return nil, fmt.Errorf("a Gemini API key is required")
 		}
-		model := cfg.Gemini.Model
+		model = cfg.Gemini.Model
 		if model == "" {
 			model = DefaultGeminiModel
 		}
@@ -117,10 +201,31 @@ func NewProvider(cfg Config) (Provider, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Gemini client: %w", err)
 		}
+		retry = cfg.Gemini.Retry
 
 	default:
-		return nil, fmt.Errorf("unsupported provider: %s", provider)
+		// Any other name refers to a configured OpenAI-compatible server.
+		oc, ok := cfg.OpenAICompatible[provider]
+		if !ok {
+			return nil, fmt.Errorf("unsupported provider: %s", provider)
+		}
+		if oc.BaseURL == "" {
+			return nil, fmt.Errorf("a base URL is required for %s", provider)
+		}
+		if oc.Model == "" {
+			return nil, fmt.Errorf("a model is required for %s", provider)
+		}
+		gen = newOpenAICompatibleGenerator(provider, oc)
+		model = oc.Model
+		retry = oc.Retry
 	}
 
-	return &scriptProvider{gen: gen, extraPrompt: cfg.ExtraPrompt}, nil
+	return &scriptProvider{
+		gen:           gen,
+		extraPrompt:   cfg.ExtraPrompt,
+		retry:         retry.withDefaults(),
+		contextBudget: cfg.ContextBudget,
+		provider:      provider,
+		model:         model,
+	}, nil
 }
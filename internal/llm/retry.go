@@ -0,0 +1,152 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryConfig controls how failed requests to a provider are retried.
+type RetryConfig struct {
+	// MaxRetries is how many times a failed request is retried. Zero
+	// disables retries.
+	MaxRetries int `yaml:"max_retries"`
+	// BaseDelay is the delay before the first retry. It doubles with each
+	// further retry, with jitter, up to MaxDelay.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// DefaultRetry is the retry policy used for every provider unless configured
+// otherwise.
+var DefaultRetry = RetryConfig{MaxRetries: 4, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// maxRetryAfter is the longest a provider may ask us to wait before retrying.
+// Beyond that the request fails rather than leaving the run hanging.
+const maxRetryAfter = 5 * time.Minute
+
+// StatusError is a request that a provider answered with an HTTP error
+// status. Generators convert their SDK's errors into it so that a single
+// retry policy can decide what to do.
+type StatusError struct {
+	StatusCode int
+	// RetryAfter is how long the provider asked us to wait, or zero.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError wraps err with the status and Retry-After of an HTTP
+// response, which may be nil.
+func newStatusError(statusCode int, resp *http.Response, err error) *StatusError {
+	statusErr := &StatusError{StatusCode: statusCode, Err: err}
+	if resp != nil {
+		statusErr.RetryAfter = retryAfter(resp.Header, time.Now())
+	}
+	return statusErr
+}
+
+// retryAfter reads how long a response asks us to wait from the standard
+// Retry-After header, the retry-after-ms header sent by Anthropic and
+// OpenAI, or OpenAI's rate limit reset headers.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+		if date, err := http.ParseTime(value); err == nil && date.After(now) {
+			return date.Sub(now)
+		}
+	}
+	// "1s", "6m0s" or "20ms" until the request or token budget resets.
+	var wait time.Duration
+	for _, name := range []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset-Tokens"} {
+		if d, err := time.ParseDuration(header.Get(name)); err == nil && d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// retryable reports whether a failed request may succeed if repeated: rate
+// limits, timeouts, server errors and dropped connections. Client errors
+// such as a bad API key or request are fatal, as are transport failures like
+// an unknown host, a refused connection or a bad certificate, which won't go
+// away by themselves. So is a request that ran
+// into perRequestTimeout, since a backend that took that long is unlikely to
+// be faster the next time and retrying would keep the run waiting for
+// several times the timeout.
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests,
+			statusErr.StatusCode == http.StatusRequestTimeout,
+			statusErr.StatusCode == http.StatusConflict,
+			statusErr.StatusCode >= 500:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// delay returns how long to wait before retry number attempt (starting at
+// 0) after err. If the request shouldn't be retried, it returns the error to
+// give up with instead.
+func (c RetryConfig) delay(attempt int, err error) (time.Duration, error) {
+	if attempt >= c.MaxRetries || !retryable(err) {
+		return 0, err
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if statusErr.RetryAfter > maxRetryAfter {
+			return 0, fmt.Errorf("%w (asked to retry after %s)", err, statusErr.RetryAfter.Round(time.Second))
+		}
+		return statusErr.RetryAfter, nil
+	}
+
+	backoff := c.BaseDelay << attempt
+	if backoff <= 0 || (c.MaxDelay > 0 && backoff > c.MaxDelay) {
+		backoff = c.MaxDelay
+	}
+	// Jitter the upper half of the delay so that concurrent runs don't
+	// retry in lockstep.
+	return backoff/2 + rand.N(backoff/2+1), nil
+}
+
+// withDefaults fills in unset delays from DefaultRetry.
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.BaseDelay <= 0 {
+		c.BaseDelay = DefaultRetry.BaseDelay
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = DefaultRetry.MaxDelay
+	}
+	return c
+}
@@ -0,0 +1,177 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer answers /api/chat with the given statuses in turn, then
+// with a successful completion, and counts the requests it receives.
+func fakeServer(t *testing.T, statuses []int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		if n < len(statuses) {
+			if statuses[n] == 0 {
+				// Drop the connection without a response.
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					_ = conn.Close()
+				}
+				return
+			}
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(statuses[n])
+			fmt.Fprintf(w, `{"error":"status %d"}`, statuses[n])
+			return
+		}
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"<script>echo ok</script>"},"done":true}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func retryingProvider(server *httptest.Server, retry RetryConfig) *scriptProvider {
+	gen := &nonStreaming{newOllamaGenerator(OllamaConfig{Host: server.URL, Model: "test"})}
+	return &scriptProvider{gen: gen, retry: retry}
+}
+
+// nonStreaming hides generateStream so the plain request path is exercised.
+type nonStreaming struct{ generator }
+
+func TestScriptProvider_Retry(t *testing.T) {
+	fast := RetryConfig{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	t.Run("retryable errors are retried", func(t *testing.T) {
+		server, calls := fakeServer(t, []int{http.StatusTooManyRequests, 529, 0}, nil)
+		out, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt"))
+		if err != nil {
+			t.Fatalf("expected success after retrying, got %v", err)
+		}
+		if out != "<script>echo ok</script>" {
+			t.Errorf("unexpected response %q", out)
+		}
+		if calls.Load() != 4 {
+			t.Errorf("expected 4 requests, got %d", calls.Load())
+		}
+	})
+
+	t.Run("fatal errors are not retried", func(t *testing.T) {
+		for _, status := range []int{http.StatusUnauthorized, http.StatusBadRequest} {
+			server, calls := fakeServer(t, []int{status}, nil)
+			_, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt"))
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != status {
+				t.Errorf("expected a %d status error, got %v", status, err)
+			}
+			if calls.Load() != 1 {
+				t.Errorf("expected a single request for status %d, got %d", status, calls.Load())
+			}
+		}
+	})
+
+	t.Run("retries are bounded", func(t *testing.T) {
+		server, calls := fakeServer(t, []int{500, 500, 500, 500, 500}, nil)
+		_, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt"))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if calls.Load() != 4 {
+			t.Errorf("expected 1 request and 3 retries, got %d", calls.Load())
+		}
+	})
+
+	t.Run("Retry-After is honored", func(t *testing.T) {
+		header := http.Header{"Retry-After-Ms": {"150"}}
+		server, calls := fakeServer(t, []int{http.StatusTooManyRequests}, header)
+		start := time.Now()
+		if _, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt")); err != nil {
+			t.Fatalf("expected success after retrying, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("expected to wait for Retry-After, retried after %s", elapsed)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("expected 2 requests, got %d", calls.Load())
+		}
+	})
+
+	t.Run("too long a Retry-After fails", func(t *testing.T) {
+		header := http.Header{"Retry-After": {"3600"}}
+		server, calls := fakeServer(t, []int{http.StatusServiceUnavailable}, header)
+		_, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt"))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if calls.Load() != 1 {
+			t.Errorf("expected a single request, got %d", calls.Load())
+		}
+	})
+
+	t.Run("unreachable servers fail right away", func(t *testing.T) {
+		server, _ := fakeServer(t, nil, nil)
+		server.Close()
+		_, err := retryingProvider(server, fast).generate(context.Background(), "Testing", userMessage("prompt"))
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if retryable(err) {
+			t.Errorf("expected a refused connection to be fatal, got %v", err)
+		}
+	})
+
+	t.Run("request timeouts aren't retried", func(t *testing.T) {
+		server, calls := fakeServer(t, []int{http.StatusGatewayTimeout}, nil)
+		provider := retryingProvider(server, fast)
+		timedOut := fmt.Errorf("failed to read response: %w", context.DeadlineExceeded)
+		if _, err := provider.retry.delay(0, timedOut); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the timeout to be returned, got %v", err)
+		}
+		// A gateway timeout is the server's, not ours, so it's retried.
+		if _, err := provider.generate(context.Background(), "Testing", userMessage("prompt")); err != nil {
+			t.Fatalf("expected success after retrying, got %v", err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("expected 2 requests, got %d", calls.Load())
+		}
+	})
+
+	t.Run("cancellation stops retrying", func(t *testing.T) {
+		server, _ := fakeServer(t, []int{500, 500}, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		slow := RetryConfig{MaxRetries: 3, BaseDelay: time.Minute, MaxDelay: time.Minute}
+		_, err := retryingProvider(server, slow).generate(ctx, "Testing", userMessage("prompt"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the context's error, got %v", err)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Retry-After": {"2"}}, 2 * time.Second},
+		{http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}, time.Minute},
+		{http.Header{"Retry-After": {"soon"}}, 0},
+		{http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, 250 * time.Millisecond},
+		{http.Header{"X-Ratelimit-Reset-Requests": {"1s"}, "X-Ratelimit-Reset-Tokens": {"6m0s"}}, 6 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.header, now); got != tt.want {
+			t.Errorf("retryAfter(%v) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
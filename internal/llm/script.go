@@ -20,3 +20,17 @@ func ExtractScriptContent(response string) string {
 	content := response[start+8 : end]
 	return strings.TrimSpace(content)
 }
+
+// extractTag extracts the content between the first <tag> and </tag> of an
+// LLM response, or returns an empty string if there is none.
+func extractTag(response, tag string) string {
+	_, rest, ok := strings.Cut(response, "<"+tag+">")
+	if !ok {
+		return ""
+	}
+	content, _, ok := strings.Cut(rest, "</"+tag+">")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(content)
+}
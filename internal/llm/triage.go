@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/statico/llmscript/internal/log"
+)
+
+// testCaseMarker matches the comment the prompts ask for at the start of each
+// test case.
+var testCaseMarker = regexp.MustCompile(`(?im)^\s*#\s*test case:`)
+
+// triage asks the model whether the main script, the test script or both
+// caused a failure. Example failures are always the main script's fault, and
+// an unclear verdict is treated as one, as it was before triage existed.
+func (p *scriptProvider) triage(ctx context.Context, description string, turn Turn) (fixMain, fixTest bool, err error) {
+	prompt := p.formatPrompt(TriagePrompt, description, turn.MainScript, turn.TestScript, turn.Failure)
+	response, err := p.generate(ctx, "Triaging test failure", userMessage(prompt))
+	if err != nil {
+		return false, false, err
+	}
+
+	verdict := strings.ToLower(extractTag(response, "verdict"))
+	if verdict != "" {
+		log.Info("Triage verdict: %s (%s)", verdict, extractTag(response, "reason"))
+	}
+	switch verdict {
+	case "test":
+		return turn.ExamplesFailed, true, nil
+	case "both":
+		return true, true, nil
+	default:
+		return true, false, nil
+	}
+}
+
+// fixTest asks the model for a corrected test script.
+func (p *scriptProvider) fixTest(ctx context.Context, description string, turn Turn) (string, error) {
+	prompt := p.formatPrompt(FixTestPrompt, description, turn.MainScript, turn.TestScript, turn.Failure)
+	response, err := p.generate(ctx, "Fixing test script", userMessage(prompt))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(ExtractScriptContent(response)), nil
+}
+
+// validateTestCaseCount guards against a test script being "fixed" by
+// weakening it until anything passes: the fix must still run ./script.sh and
+// keep at least as many test cases. Test cases are counted by their marker comments, or if
+// the original has none, by the lines that run ./script.sh.
+func validateTestCaseCount(original, fixed string) error {
+	if strings.TrimSpace(fixed) == "" {
+		return fmt.Errorf("it is empty")
+	}
+	if !strings.Contains(fixed, "./script.sh") {
+		return fmt.Errorf("it doesn't run ./script.sh")
+	}
+	before, after := len(testCaseMarker.FindAllString(original, -1)), len(testCaseMarker.FindAllString(fixed, -1))
+	if before == 0 {
+		before, after = countScriptRuns(original), countScriptRuns(fixed)
+	}
+	if after < before {
+		return fmt.Errorf("it has %d test cases instead of %d", after, before)
+	}
+	return nil
+}
+
+// countScriptRuns counts the lines of a test script that run ./script.sh,
+// ignoring comments.
+func countScriptRuns(testScript string) int {
+	var n int
+	for _, line := range strings.Split(testScript, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") && strings.Contains(line, "./script.sh") {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,88 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const triagedTest = `#!/usr/bin/env bash
+# Test case: prints the date
+[ -n "$(./script.sh)" ] || exit 1
+# Test case: fails on bad input
+! ./script.sh --bogus || exit 1`
+
+func TestScriptProvider_FixScriptsTriage(t *testing.T) {
+	fixedTest := strings.Replace(triagedTest, "-n", "-n \"$(date -u)\" -a -n", 1)
+	weakenedTest := "#!/usr/bin/env bash\n# Test case: runs\n./script.sh || true"
+
+	tests := []struct {
+		name           string
+		responses      []string
+		examplesFailed bool
+		wantMain       string
+		wantTest       string
+	}{
+		{"script at fault", []string{"<verdict>script</verdict>", "<script>fixed</script>"}, false, "fixed", triagedTest},
+		{"test at fault", []string{"<verdict>test</verdict><reason>GNU date flags</reason>", "<script>" + fixedTest + "</script>"}, false, "broken", fixedTest},
+		{"both at fault", []string{"<verdict>both</verdict>", "<script>" + fixedTest + "</script>", "<script>fixed</script>"}, false, "fixed", fixedTest},
+		{"weakened test is rejected", []string{"<verdict>test</verdict>", "<script>" + weakenedTest + "</script>", "<script>fixed</script>"}, false, "fixed", triagedTest},
+		{"examples are never the test's fault", []string{"<verdict>test</verdict>", "<script>" + fixedTest + "</script>", "<script>fixed</script>"}, true, "fixed", fixedTest},
+		{"no verdict", []string{"I'm not sure", "<script>fixed</script>"}, false, "fixed", triagedTest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &fakeGenerator{responses: tt.responses}
+			p := &scriptProvider{gen: gen}
+			turn := Turn{MainScript: "broken", TestScript: triagedTest, Failure: "date: illegal option", ExamplesFailed: tt.examplesFailed}
+			out, err := p.FixScripts(context.Background(), Conversation{Description: "print the date", Turns: []Turn{turn}})
+			if err != nil {
+				t.Fatalf("FixScripts: %v", err)
+			}
+			if out.MainScript != tt.wantMain || out.TestScript != tt.wantTest {
+				t.Errorf("got main %q and test %q", out.MainScript, out.TestScript)
+			}
+			if gen.calls != len(tt.responses) {
+				t.Errorf("expected %d requests, got %d", len(tt.responses), gen.calls)
+			}
+		})
+	}
+}
+
+func TestScriptProvider_FixScriptsMainOnly(t *testing.T) {
+	// Without triage, the only request is for the main script.
+	gen := &fakeGenerator{responses: []string{"<script>fixed</script>"}}
+	p := &scriptProvider{gen: gen}
+	turn := Turn{MainScript: "broken", TestScript: triagedTest, Failure: "date: illegal option"}
+	out, err := p.FixScripts(context.Background(), Conversation{Description: "print the date", Turns: []Turn{turn}, FixMain: true})
+	if err != nil {
+		t.Fatalf("FixScripts: %v", err)
+	}
+	if out.MainScript != "fixed" || out.TestScript != triagedTest {
+		t.Errorf("got main %q and test %q", out.MainScript, out.TestScript)
+	}
+	if gen.calls != 1 {
+		t.Errorf("expected 1 request, got %d", gen.calls)
+	}
+}
+
+func TestValidateTestCaseCount(t *testing.T) {
+	unmarked := "#!/bin/bash\n[ \"$(./script.sh a)\" = a ]\n[ \"$(./script.sh b)\" = b ]"
+	tests := []struct {
+		original, fixed string
+		ok              bool
+	}{
+		{triagedTest, triagedTest, true},
+		{triagedTest, triagedTest + "\n# Test case: another one\n./script.sh x", true},
+		{triagedTest, "#!/bin/bash\n# Test case: only one\n./script.sh", false},
+		{triagedTest, "#!/bin/bash\nexit 0", false},
+		{triagedTest, "", false},
+		{unmarked, "#!/bin/bash\n[ \"$(./script.sh a)\" = a ]\n[ \"$(./script.sh b)\" = b ]\n", true},
+		{unmarked, "#!/bin/bash\n# ./script.sh b\n[ \"$(./script.sh a)\" = a ]", false},
+	}
+	for i, tt := range tests {
+		if err := validateTestCaseCount(tt.original, tt.fixed); (err == nil) != tt.ok {
+			t.Errorf("case %d: validateTestCaseCount() = %v, want ok=%v", i, err, tt.ok)
+		}
+	}
+}
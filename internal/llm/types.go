@@ -2,32 +2,63 @@ package llm
 
 // OllamaConfig represents configuration for the Ollama provider
 type OllamaConfig struct {
-	Model string `yaml:"model"`
-	Host  string `yaml:"host"`
+	Model string      `yaml:"model"`
+	Host  string      `yaml:"host"`
+	Retry RetryConfig `yaml:"retry"`
 }
 
 // ClaudeConfig represents configuration for the Claude (Anthropic) provider
 type ClaudeConfig struct {
-	APIKey string `yaml:"api_key"`
-	Model  string `yaml:"model"`
+	APIKey string      `yaml:"api_key"`
+	Model  string      `yaml:"model"`
+	Retry  RetryConfig `yaml:"retry"`
 }
 
 // OpenAIConfig represents configuration for the OpenAI provider
 type OpenAIConfig struct {
-	APIKey string `yaml:"api_key"`
-	Model  string `yaml:"model"`
+	APIKey string      `yaml:"api_key"`
+	Model  string      `yaml:"model"`
+	Retry  RetryConfig `yaml:"retry"`
 }
 
 // GeminiConfig represents configuration for the Google Gemini provider
 type GeminiConfig struct {
-	APIKey string `yaml:"api_key"`
-	Model  string `yaml:"model"`
+	APIKey string      `yaml:"api_key"`
+	Model  string      `yaml:"model"`
+	Retry  RetryConfig `yaml:"retry"`
 }
 
 // OpenRouterConfig represents configuration for the OpenRouter provider
 type OpenRouterConfig struct {
-	APIKey string `yaml:"api_key"`
-	Model  string `yaml:"model"`
+	APIKey string      `yaml:"api_key"`
+	Model  string      `yaml:"model"`
+	Retry  RetryConfig `yaml:"retry"`
+}
+
+// OpenAICompatibleConfig represents configuration for a server that
+// implements OpenAI's Chat Completions API, such as vLLM, LM Studio, a
+// llama.cpp server or a LiteLLM gateway
+type OpenAICompatibleConfig struct {
+	BaseURL      string            `yaml:"base_url"`
+	APIKey       string            `yaml:"api_key"`
+	Model        string            `yaml:"model"`
+	Headers      map[string]string `yaml:"headers"`
+	Organization string            `yaml:"organization"`
+	Project      string            `yaml:"project"`
+	Retry        RetryConfig       `yaml:"retry"`
+}
+
+// UnmarshalYAML starts from DefaultRetry, like the built-in providers whose
+// settings are read over the defaults, so that a server is retried unless
+// its retry block says otherwise.
+func (c *OpenAICompatibleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain OpenAICompatibleConfig
+	cfg := plain{Retry: DefaultRetry}
+	if err := unmarshal(&cfg); err != nil {
+		return err
+	}
+	*c = OpenAICompatibleConfig(cfg)
+	return nil
 }
 
 // Config is the fully-resolved LLM configuration passed to NewProvider. It is
@@ -35,9 +66,15 @@ type OpenRouterConfig struct {
 type Config struct {
 	Provider    string
 	ExtraPrompt string
-	Ollama      OllamaConfig
-	Claude      ClaudeConfig
-	OpenAI      OpenAIConfig
-	Gemini      GeminiConfig
-	OpenRouter  OpenRouterConfig
+	// ContextBudget is how many tokens a fix conversation may use before
+	// its oldest turns are left out; zero means no limit.
+	ContextBudget int
+	Ollama        OllamaConfig
+	Claude        ClaudeConfig
+	OpenAI        OpenAIConfig
+	Gemini        GeminiConfig
+	OpenRouter    OpenRouterConfig
+	// OpenAICompatible holds named OpenAI-compatible servers, each of which
+	// is selected as a provider by its name.
+	OpenAICompatible map[string]OpenAICompatibleConfig
 }
@@ -0,0 +1,77 @@
+package llm
+
+import "fmt"
+
+// Usage counts the tokens used by LLM requests.
+type Usage struct {
+	// InputTokens counts every prompt token, including cached ones.
+	InputTokens int
+	// CachedTokens is the part of InputTokens read from the provider's
+	// prompt cache, which is usually billed at a lower price.
+	CachedTokens int
+	OutputTokens int
+}
+
+// Add adds other's tokens to u.
+func (u *Usage) Add(other Usage) {
+	u.InputTokens += other.InputTokens
+	u.CachedTokens += other.CachedTokens
+	u.OutputTokens += other.OutputTokens
+}
+
+// Total returns the number of input and output tokens.
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens
+}
+
+func (u Usage) String() string {
+	s := fmt.Sprintf("%d input tokens", u.InputTokens)
+	if u.CachedTokens > 0 {
+		s += fmt.Sprintf(" (%d cached)", u.CachedTokens)
+	}
+	return s + fmt.Sprintf(", %d output tokens", u.OutputTokens)
+}
+
+// ModelUsage is the usage of a single provider and model.
+type ModelUsage struct {
+	Provider string
+	Model    string
+	Usage
+}
+
+// UsageReporter is implemented by providers that count the tokens their
+// requests use.
+type UsageReporter interface {
+	// TakeUsage returns the usage of the requests made since it was last
+	// called, per model.
+	TakeUsage() []ModelUsage
+}
+
+// Price is what a model costs in US dollars per million tokens.
+type Price struct {
+	Input float64 `yaml:"input"`
+	// CachedInput is the price of prompt tokens read from the cache. Zero
+	// means they cost the same as other input tokens.
+	CachedInput float64 `yaml:"cached_input"`
+	Output      float64 `yaml:"output"`
+}
+
+// Cost estimates what usage costs at price p.
+func (p Price) Cost(u Usage) float64 {
+	cached := p.CachedInput
+	if cached == 0 {
+		cached = p.Input
+	}
+	return (float64(u.InputTokens-u.CachedTokens)*p.Input +
+		float64(u.CachedTokens)*cached +
+		float64(u.OutputTokens)*p.Output) / 1e6
+}
+
+// FormatCost formats an amount in US dollars, keeping fractions of a cent
+// visible for small amounts since a single request often costs less.
+func FormatCost(cost float64) string {
+	if cost >= 1 {
+		return fmt.Sprintf("$%.2f", cost)
+	}
+	return fmt.Sprintf("$%.4f", cost)
+}
@@ -0,0 +1,32 @@
+package llm
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPrice_Cost(t *testing.T) {
+	usage := Usage{InputTokens: 1_000_000, CachedTokens: 400_000, OutputTokens: 100_000}
+	tests := []struct {
+		price Price
+		want  float64
+	}{
+		{Price{Input: 3, CachedInput: 0.3, Output: 15}, 0.6*3 + 0.4*0.3 + 0.1*15},
+		// Without a cached price, cached tokens cost as much as others.
+		{Price{Input: 3, Output: 15}, 3 + 0.1*15},
+		{Price{}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.price.Cost(usage); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%+v.Cost() = %f, want %f", tt.price, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCost(t *testing.T) {
+	for cost, want := range map[float64]string{0: "$0.0000", 0.00123: "$0.0012", 0.5: "$0.5000", 12.5: "$12.50"} {
+		if got := FormatCost(cost); got != want {
+			t.Errorf("FormatCost(%f) = %s, want %s", cost, got, want)
+		}
+	}
+}
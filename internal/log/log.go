@@ -85,6 +85,23 @@ func Spinner(format string, args ...interface{}) {
 	updateSpinner(format, args...)
 }
 
+// Progress updates the spinner with frequently changing progress, such as
+// the number of tokens received. Unlike Info it's only shown on a terminal
+// and never printed as a line of its own.
+func Progress(format string, args ...interface{}) {
+	if getLevel() == InfoLevel && isTTY() {
+		updateSpinner(format, args...)
+	}
+}
+
+// Stream writes text as it's produced, such as a script streamed from the
+// LLM, when debug output is enabled.
+func Stream(text string) {
+	if getLevel() <= DebugLevel {
+		fmt.Fprint(os.Stderr, text)
+	}
+}
+
 func Info(format string, args ...interface{}) {
 	if getLevel() <= InfoLevel {
 		if getLevel() == DebugLevel {
@@ -0,0 +1,109 @@
+package review
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Decision is the user's answer to the confirmation prompt.
+type Decision int
+
+const (
+	Reject Decision = iota
+	Accept
+	Edit
+)
+
+// Show writes the script, with line numbers, followed by a summary of its
+// risky operations. Syntax is highlighted when color is true.
+func Show(w io.Writer, script string, color bool) {
+	shown := script
+	if color {
+		shown = Highlight(script)
+	}
+	lines := strings.Split(strings.TrimRight(shown, "\n"), "\n")
+	width := len(fmt.Sprint(len(lines)))
+	for i, line := range lines {
+		fmt.Fprintf(w, "%*d  %s\n", width, i+1, line)
+	}
+	fmt.Fprintln(w)
+
+	risks := Risks(script)
+	if len(risks) == 0 {
+		fmt.Fprintln(w, "No risky operations detected.")
+		return
+	}
+	fmt.Fprintf(w, "Risky operations detected (%d):\n", len(risks))
+	for _, r := range risks {
+		fmt.Fprintf(w, "  line %d: %s: %s\n", r.Line, r.Reason, r.Text)
+	}
+}
+
+// Ask prompts until it gets a valid answer. An empty answer or end of input
+// means no.
+func Ask(r *bufio.Reader, w io.Writer) (Decision, error) {
+	for {
+		fmt.Fprint(w, "Run this script? [y/N/edit] ")
+		answer, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return Reject, fmt.Errorf("failed to read answer: %w", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return Accept, nil
+		case "e", "edit":
+			return Edit, nil
+		case "", "n", "no":
+			return Reject, nil
+		}
+		if err == io.EOF {
+			return Reject, nil
+		}
+		fmt.Fprintln(w, `Please answer "y", "n" or "edit".`)
+	}
+}
+
+// EditScript opens the script in the user's editor ($VISUAL, $EDITOR or vi)
+// attached to tty and returns the edited version.
+func EditScript(tty *os.File, script string) (string, error) {
+	f, err := os.CreateTemp("", "llmscript-edit-*.sh")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.WriteString(script); err != nil {
+		_ = f.Close()
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// The editor setting may include arguments, e.g. "code --wait".
+	cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %s failed: %w", editor, err)
+	}
+
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited script: %w", err)
+	}
+	return string(edited), nil
+}
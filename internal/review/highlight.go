@@ -0,0 +1,110 @@
+package review
+
+import "strings"
+
+const (
+	gray    = "\033[90m"
+	green   = "\033[32m"
+	cyan    = "\033[36m"
+	magenta = "\033[35m"
+	reset   = "\033[0m"
+)
+
+var keywords = map[string]bool{
+	"if": true, "then": true, "else": true, "elif": true, "fi": true,
+	"for": true, "while": true, "until": true, "do": true, "done": true,
+	"case": true, "esac": true, "in": true, "select": true, "function": true,
+	"return": true, "local": true, "export": true, "readonly": true, "declare": true,
+	"exit": true, "set": true, "trap": true, "shift": true,
+}
+
+// Highlight colors a shell script for display on an ANSI terminal: comments
+// in gray, strings in green, variables in cyan and keywords in magenta.
+func Highlight(script string) string {
+	var sb strings.Builder
+	n := len(script)
+	for i := 0; i < n; {
+		c := script[i]
+		switch {
+		case c == '#' && (i == 0 || strings.ContainsRune(" \t\n;", rune(script[i-1]))):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = n - i
+			}
+			sb.WriteString(gray + script[i:i+end] + reset)
+			i += end
+		case c == '\'':
+			end := strings.IndexByte(script[i+1:], '\'')
+			if end < 0 {
+				end = n - i - 2
+			}
+			sb.WriteString(green + script[i:i+end+2] + reset)
+			i += end + 2
+		case c == '"':
+			j := i + 1
+			for j < n && script[j] != '"' {
+				if script[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, n)
+			sb.WriteString(green + script[i:j] + reset)
+			i = j
+		case c == '$':
+			j := variableEnd(script, i)
+			sb.WriteString(cyan + script[i:j] + reset)
+			i = j
+		case c == '\\':
+			j := min(i+2, n)
+			sb.WriteString(script[i:j])
+			i = j
+		case isWordChar(c):
+			j := i
+			for j < n && isWordChar(script[j]) {
+				j++
+			}
+			word := script[i:j]
+			if keywords[word] && (i == 0 || !isWordChar(script[i-1])) {
+				sb.WriteString(magenta + word + reset)
+			} else {
+				sb.WriteString(word)
+			}
+			i = j
+		default:
+			sb.WriteByte(c)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// variableEnd returns the end of the variable reference starting at the '$'
+// at i: $name, ${...}, or a special parameter such as $1 or $?. A "$(" only
+// highlights the "$(" itself so the command inside is highlighted normally.
+func variableEnd(s string, i int) int {
+	j := i + 1
+	switch {
+	case j >= len(s):
+		return j
+	case s[j] == '{':
+		if end := strings.IndexByte(s[j:], '}'); end >= 0 {
+			return j + end + 1
+		}
+		return len(s)
+	case s[j] == '(':
+		return j + 1
+	case isWordChar(s[j]) && !(s[j] >= '0' && s[j] <= '9'):
+		for j < len(s) && isWordChar(s[j]) {
+			j++
+		}
+		return j
+	case strings.IndexByte("0123456789?#@*!$-", s[j]) >= 0:
+		return j + 1
+	}
+	return j
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
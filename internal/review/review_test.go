@@ -0,0 +1,86 @@
+package review
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRisks(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		reasons []string
+	}{
+		{"plain rm", `rm "$file"`, []string{"deletes files"}},
+		{"recursive rm", `[ -d build ] && rm -rf build`, []string{"recursively deletes files"}},
+		{"find delete", `find . -name '*.log' -mtime +30 -delete`, []string{"deletes files"}},
+		{"sudo", `sudo apt-get install -y jq`, []string{"runs commands as root"}},
+		{"curl to shell", `curl -fsSL https://example.com/install.sh | sudo bash`, []string{"runs commands as root", "pipes a download into a shell"}},
+		{"recursive chmod", `chmod -R 755 public`, []string{"recursively changes permissions or ownership"}},
+		{"redirect outside", `echo "done" >> ~/.bashrc`, []string{"writes outside the current directory"}},
+		{"copy outside", `cp config.yml /etc/app/config.yml`, []string{"writes outside the current directory"}},
+		{"dev null", `grep -q foo file 2>/dev/null >/dev/null`, nil},
+		{"comment", `# rm -rf / would be bad`, nil},
+		{"word containing rm", `echo "format: $format"`, nil},
+		{"chmod without -R", `chmod +x script.sh`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reasons []string
+			for _, r := range Risks("#!/bin/bash\n" + tt.line + "\n") {
+				if r.Line != 2 {
+					t.Errorf("expected line 2, got %d", r.Line)
+				}
+				reasons = append(reasons, r.Reason)
+			}
+			if !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("Risks(%q) = %v, want %v", tt.line, reasons, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := Highlight(`if [ -n "$1" ]; then echo ${#name} # hi` + "\nfi")
+	want := magenta + "if" + reset + ` [ -n ` + green + `"$1"` + reset + ` ]; ` + magenta + "then" + reset +
+		` echo ` + cyan + "${#name}" + reset + " " + gray + "# hi" + reset + "\n" + magenta + "fi" + reset
+	if got != want {
+		t.Errorf("Highlight mismatch:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestAsk(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Decision
+	}{
+		{"y\n", Accept},
+		{"YES\n", Accept},
+		{"edit\n", Edit},
+		{"\n", Reject},
+		{"", Reject},
+		{"maybe\nn\n", Reject},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		got, err := Ask(bufio.NewReader(strings.NewReader(tt.input)), &out)
+		if err != nil {
+			t.Fatalf("Ask(%q): %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("Ask(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestShow(t *testing.T) {
+	var out bytes.Buffer
+	Show(&out, "#!/bin/bash\nsudo reboot\n", false)
+	want := "1  #!/bin/bash\n2  sudo reboot\n\nRisky operations detected (1):\n  line 2: runs commands as root: sudo reboot\n"
+	if out.String() != want {
+		t.Errorf("Show mismatch:\n got: %q\nwant: %q", out.String(), want)
+	}
+}
@@ -0,0 +1,105 @@
+// Package review helps a user check a generated script before it runs: it
+// highlights the script's syntax and points out risky operations.
+package review
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Risk is a potentially dangerous operation found in a script.
+type Risk struct {
+	Line   int    // 1-based line number
+	Reason string // what the operation does, e.g. "runs commands as root"
+	Text   string // the offending line, trimmed
+}
+
+// rule flags lines matching pattern, unless they also match except.
+type rule struct {
+	reason  string
+	pattern *regexp.Regexp
+	except  *regexp.Regexp
+}
+
+// commandStart matches the start of a command: the beginning of the line or
+// a separator, optionally followed by sudo and its flags.
+const commandStart = `(?:^|[;&|(]|\$\(|\b(?:then|do|else|exec|xargs|sudo))\s*(?:-\S+\s+)*`
+
+// outsidePath matches paths outside the current directory.
+const outsidePath = `["']?(?:/|~|\$\{?HOME\b|\.\./)`
+
+// deviceRedirect matches redirections to device files such as /dev/null,
+// which are fine to write to.
+var deviceRedirect = regexp.MustCompile(`\d?>>?&?\s*["']?/dev/(?:null|std(?:out|err)|tty|fd/\d+)["']?`)
+
+var rules = []rule{
+	{
+		reason:  "recursively deletes files",
+		pattern: regexp.MustCompile(commandStart + `rm\s+(?:\S+\s+)*-[a-zA-Z]*[rR]`),
+	},
+	{
+		reason:  "deletes files",
+		pattern: regexp.MustCompile(commandStart + `(?:rm|rmdir|unlink|shred)\s|\bfind\b.*\s-delete\b`),
+		except:  regexp.MustCompile(commandStart + `rm\s+(?:\S+\s+)*-[a-zA-Z]*[rR]`),
+	},
+	{
+		reason:  "runs commands as root",
+		pattern: regexp.MustCompile(`(?:^|[;&|(\s])(?:sudo|doas|su)\s`),
+	},
+	{
+		reason:  "pipes a download into a shell",
+		pattern: regexp.MustCompile(`\b(?:curl|wget)\b[^|]*\|\s*(?:sudo\s+(?:-\S+\s+)*)?(?:ba|z|da|k)?sh\b`),
+	},
+	{
+		reason:  "recursively changes permissions or ownership",
+		pattern: regexp.MustCompile(commandStart + `(?:chmod|chown|chgrp)\s+(?:\S+\s+)*-[a-zA-Z]*R`),
+	},
+	{
+		reason: "writes outside the current directory",
+		pattern: regexp.MustCompile(`>>?\s*` + outsidePath + `|` +
+			commandStart + `(?:cp|mv|tee|touch|mkdir|ln|install|rsync|truncate|dd)\s+(?:.*\s)?(?:of=)?` + outsidePath),
+	},
+}
+
+// Risks returns the risky operations in script, in line order. It's a
+// heuristic: it looks at each line on its own and skips comments, so it can
+// both miss and over-report operations.
+func Risks(script string) []Risk {
+	var risks []Risk
+	for i, line := range strings.Split(script, "\n") {
+		code := strings.TrimSpace(deviceRedirect.ReplaceAllString(stripComment(line), ""))
+		if code == "" {
+			continue
+		}
+		for _, r := range rules {
+			if r.pattern.MatchString(code) && (r.except == nil || !r.except.MatchString(code)) {
+				risks = append(risks, Risk{Line: i + 1, Reason: r.reason, Text: strings.TrimSpace(line)})
+			}
+		}
+	}
+	return risks
+}
+
+// stripComment removes a trailing shell comment, leaving '#' inside quotes
+// and words such as ${#var} alone.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t' || line[i-1] == ';'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,245 @@
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bounds the resources a command may use. Zero values mean unlimited.
+// CPU time, memory (address space) and open files are enforced by the kernel
+// per process. Processes are counted per user: against all of the user's
+// processes without the namespace sandbox, and only against the sandboxed
+// ones inside it (on Linux 5.14 and later, which count them per user
+// namespace). Output is the total number of bytes a command may write to its
+// stdout and stderr before it is killed.
+type Limits struct {
+	CPUTime   time.Duration `yaml:"cpu_time"`
+	Memory    ByteSize      `yaml:"memory"`
+	OpenFiles int           `yaml:"open_files"`
+	Processes int           `yaml:"processes"`
+	Output    ByteSize      `yaml:"output"`
+}
+
+// kernelLimits reports whether any limit has to be applied with setrlimit.
+func (l Limits) kernelLimits() bool {
+	return l.CPUTime > 0 || l.Memory > 0 || l.OpenFiles > 0 || l.Processes > 0
+}
+
+// LimitError reports that a command was stopped by, or failed because of, one
+// of its resource limits.
+type LimitError struct {
+	Resource string // "CPU time", "memory", "open files", "processes" or "output"
+	Limit    string // the configured limit, e.g. "256MB"
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("exceeded %s %s limit", e.Limit, e.Resource)
+}
+
+// ByteSize is a number of bytes that can be written in YAML as a plain number
+// or with a KB, MB or GB suffix (powers of 1024).
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+}
+
+// ParseByteSize parses sizes such as "512", "64KB", "256MB" or "1GB".
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.Replace(str, "IB", "B", 1), "B")
+	multiplier := ByteSize(1)
+	for _, u := range byteUnits {
+		if prefix := u.suffix[:1]; strings.HasSuffix(str, prefix) {
+			str = strings.TrimSuffix(str, prefix)
+			multiplier = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n) * multiplier, nil
+}
+
+func (b ByteSize) String() string {
+	for _, u := range byteUnits {
+		if b >= u.size && b%u.size == 0 {
+			return strconv.FormatInt(int64(b/u.size), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// UnmarshalYAML accepts either a plain number of bytes or a size string.
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// MarshalYAML writes sizes in their most readable form.
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	if b == 0 {
+		return 0, nil
+	}
+	return b.String(), nil
+}
+
+// failureHints maps error messages commonly printed when a kernel limit is
+// hit to the resource responsible. Unlike exceeding the CPU time, allocation,
+// fd and fork failures don't kill the process with a signal, so its error
+// output is the only sign of which limit was hit.
+var failureHints = []struct {
+	resource string
+	patterns []string
+}{
+	{"memory", []string{"cannot allocate memory", "out of memory", "memoryerror", "bad_alloc", "xmalloc"}},
+	// The dynamic loader reports EMFILE by number.
+	{"open files", []string{"too many open files", "error 24"}},
+	{"processes", []string{"fork: retry", "fork: resource temporarily unavailable", "cannot fork"}},
+}
+
+// outputMonitor counts the bytes written to a command's stdout and stderr,
+// kills the command once it exceeds the output limit, and keeps the tail of
+// the captured output to recognize limit-related failures.
+type outputMonitor struct {
+	mu       sync.Mutex
+	limit    ByteSize
+	written  ByteSize
+	exceeded bool
+	tail     []byte
+	kill     func()
+}
+
+const monitorTailSize = 4096
+
+var errOutputLimit = errors.New("output limit exceeded")
+
+type monitoredWriter struct {
+	m *outputMonitor
+	w io.Writer
+}
+
+func (mw *monitoredWriter) Write(p []byte) (int, error) {
+	m := mw.m
+	m.mu.Lock()
+	exceeded := m.limit > 0 && m.written+ByteSize(len(p)) > m.limit
+	if exceeded {
+		p = p[:max(0, int(m.limit-m.written))]
+		if !m.exceeded {
+			m.exceeded = true
+			defer m.kill()
+		}
+	}
+	m.written += ByteSize(len(p))
+	m.tail = append(m.tail, p...)
+	if len(m.tail) > monitorTailSize {
+		m.tail = m.tail[len(m.tail)-monitorTailSize:]
+	}
+	m.mu.Unlock()
+
+	n, err := mw.w.Write(p)
+	if err == nil && exceeded {
+		// Stop copying so the pipe closes and any process still writing to
+		// it gets SIGPIPE instead of blocking Wait.
+		err = errOutputLimit
+	}
+	return n, err
+}
+
+// monitorOutput wraps cmd's stdout and stderr with a shared outputMonitor. It
+// only does so when there's something to monitor: an output limit, or kernel
+// limits whose failures can only be recognized from error output. Without an
+// output limit, outputs that are files (such as a terminal) are passed
+// straight through so the command still sees them directly; kernel limit
+// breaches are then only recognized from the output of captured streams.
+func monitorOutput(cmd *exec.Cmd, limits Limits) *outputMonitor {
+	m := &outputMonitor{limit: limits.Output, kill: func() {
+		if cmd.Process != nil {
+			_ = cmd.Process.Kill()
+		}
+	}}
+	if limits.Output == 0 && !limits.kernelLimits() {
+		return m
+	}
+
+	monitored := func(w io.Writer) bool {
+		_, isFile := w.(*os.File)
+		return w != nil && (limits.Output > 0 || !isFile)
+	}
+	switch {
+	case cmd.Stdout == cmd.Stderr && monitored(cmd.Stdout):
+		cmd.Stdout = &monitoredWriter{m: m, w: cmd.Stdout}
+		cmd.Stderr = cmd.Stdout
+	default:
+		if monitored(cmd.Stdout) {
+			cmd.Stdout = &monitoredWriter{m: m, w: cmd.Stdout}
+		}
+		if monitored(cmd.Stderr) {
+			cmd.Stderr = &monitoredWriter{m: m, w: cmd.Stderr}
+		}
+	}
+	return m
+}
+
+// breach works out whether a failed command hit one of its limits.
+func (m *outputMonitor) breach(limits Limits, state *os.ProcessState) *LimitError {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.exceeded {
+		return &LimitError{Resource: "output", Limit: limits.Output.String()}
+	}
+	if limits.CPUTime > 0 && cpuLimitHit(state) {
+		return &LimitError{Resource: "CPU time", Limit: limits.CPUTime.String()}
+	}
+
+	tail := strings.ToLower(string(m.tail))
+	for _, hint := range failureHints {
+		var limit string
+		switch hint.resource {
+		case "memory":
+			if limits.Memory > 0 {
+				limit = limits.Memory.String()
+			}
+		case "open files":
+			if limits.OpenFiles > 0 {
+				limit = strconv.Itoa(limits.OpenFiles)
+			}
+		case "processes":
+			if limits.Processes > 0 {
+				limit = strconv.Itoa(limits.Processes)
+			}
+		}
+		if limit == "" {
+			continue
+		}
+		for _, pattern := range hint.patterns {
+			if strings.Contains(tail, pattern) {
+				return &LimitError{Resource: hint.resource, Limit: limit}
+			}
+		}
+	}
+	return nil
+}
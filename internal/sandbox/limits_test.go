@@ -0,0 +1,85 @@
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "64KB", want: 64 << 10},
+		{in: "256MB", want: 256 << 20},
+		{in: "256mb", want: 256 << 20},
+		{in: "1GiB", want: 1 << 30},
+		{in: "2G", want: 2 << 30},
+		{in: "lots", wantErr: true},
+		{in: "-1MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q): expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	if s := ByteSize(256 << 20).String(); s != "256MB" {
+		t.Errorf("expected 256MB, got %s", s)
+	}
+}
+
+func TestLimits_YAML(t *testing.T) {
+	var limits Limits
+	if err := yaml.Unmarshal([]byte("memory: 256MB\noutput: 1024\ncpu_time: 5s\n"), &limits); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if limits.Memory != 256<<20 || limits.Output != 1024 || limits.CPUTime.Seconds() != 5 {
+		t.Errorf("unexpected limits: %+v", limits)
+	}
+
+	out, err := yaml.Marshal(Limits{Memory: 256 << 20})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Contains(out, []byte("memory: 256MB")) {
+		t.Errorf("expected a readable memory size, got:\n%s", out)
+	}
+}
+
+func TestSandbox_OutputLimit(t *testing.T) {
+	sb, err := New(Config{}, Limits{Output: 1024})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", "yes")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err = sb.Run(cmd)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected a LimitError, got %v", err)
+	}
+	if limitErr.Error() != "exceeded 1KB output limit" {
+		t.Errorf("unexpected message: %s", limitErr)
+	}
+	if out.Len() != 1024 {
+		t.Errorf("expected output to be truncated at the limit, got %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,106 @@
+package sandbox
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// killGracePeriod is how long a process group gets to exit after SIGTERM
+// before it is sent SIGKILL.
+const killGracePeriod = 2 * time.Second
+
+// HangError reports that a command had to be terminated because it, or
+// processes it started, kept running.
+type HangError struct {
+	// Exited is true when the command itself exited but left background
+	// processes holding its output open, rather than running past its
+	// deadline.
+	Exited bool
+	// Processes lists the processes that were still running, as "PID command".
+	Processes []string
+}
+
+func (e *HangError) Error() string {
+	var sb strings.Builder
+	if e.Exited {
+		sb.WriteString("exited but left background processes running that kept its output open")
+	} else {
+		sb.WriteString("hung and was terminated before it finished")
+	}
+	if len(e.Processes) > 0 {
+		sb.WriteString("; processes still running:\n  ")
+		sb.WriteString(strings.Join(e.Processes, "\n  "))
+	}
+	return sb.String()
+}
+
+// processGroup terminates a command together with everything it started.
+type processGroup struct {
+	cmd      *exec.Cmd
+	canceled bool
+	running  []string
+}
+
+// manageProcessGroup starts commands created with exec.CommandContext in a
+// process group of their own and replaces the default cancelation, which
+// only kills the direct child, with SIGTERM to the whole group followed by
+// SIGKILL after killGracePeriod. Other commands, such as the final script
+// that must stay in the terminal's foreground, are left alone.
+func manageProcessGroup(cmd *exec.Cmd) *processGroup {
+	if cmd.Cancel == nil {
+		return nil
+	}
+
+	g := &processGroup{cmd: cmd}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		g.canceled = true
+		g.running = listProcessGroup(cmd.Process.Pid)
+		g.terminate()
+		return nil
+	}
+	// Wait gives up on pipes still held open by leftover processes after this
+	// long, whether the command exited or was canceled.
+	cmd.WaitDelay = killGracePeriod + time.Second
+	return g
+}
+
+// terminate sends SIGTERM to the group, and SIGKILL after the grace period.
+func (g *processGroup) terminate() {
+	pid := g.cmd.Process.Pid
+	signalProcessGroup(pid, false)
+	time.AfterFunc(killGracePeriod, func() {
+		signalProcessGroup(pid, true)
+	})
+}
+
+// kill sends SIGKILL to the group straight away.
+func (g *processGroup) kill() {
+	if g.cmd.Process != nil {
+		signalProcessGroup(g.cmd.Process.Pid, true)
+	}
+}
+
+// finish cleans up any processes left in the group once the command has been
+// waited for and reports a hang if the command was canceled or leftover
+// processes kept its output open.
+func (g *processGroup) finish(err error) error {
+	if g == nil || g.cmd.Process == nil {
+		return err
+	}
+
+	leftover := listProcessGroup(g.cmd.Process.Pid)
+	if len(leftover) > 0 {
+		g.terminate()
+	}
+
+	switch {
+	case g.canceled:
+		return &HangError{Processes: g.running}
+	case errors.Is(err, exec.ErrWaitDelay):
+		return &HangError{Exited: true, Processes: leftover}
+	}
+	return err
+}
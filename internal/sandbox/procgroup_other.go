@@ -0,0 +1,28 @@
+//go:build unix && !linux
+
+package sandbox
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listProcessGroup returns "PID command" for every process in the group,
+// using ps since there is no /proc to read.
+func listProcessGroup(pgid int) []string {
+	out, err := exec.Command("ps", "-A", "-o", "pid=", "-o", "pgid=", "-o", "stat=", "-o", "command=").Output()
+	if err != nil {
+		return nil
+	}
+
+	var procs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != strconv.Itoa(pgid) || strings.HasPrefix(fields[2], "Z") {
+			continue
+		}
+		procs = append(procs, fields[0]+" "+strings.Join(fields[3:], " "))
+	}
+	return procs
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSandbox_ProcessGroup(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		exited  bool
+	}{
+		{
+			name:    "timeout",
+			script:  "sleep 60 & sleep 60",
+			timeout: 500 * time.Millisecond,
+		},
+		{
+			name:    "background process keeps output open",
+			script:  "sleep 60 &",
+			timeout: time.Minute,
+			exited:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb, err := New(Config{}, Limits{})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			var out bytes.Buffer
+			cmd := exec.CommandContext(ctx, "/bin/sh", "-c", tt.script)
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+
+			start := time.Now()
+			err = sb.Run(cmd)
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("Run took %v; the process group wasn't terminated", elapsed)
+			}
+
+			var hangErr *HangError
+			if !errors.As(err, &hangErr) {
+				t.Fatalf("expected a HangError, got %v\n%s", err, out.String())
+			}
+			if hangErr.Exited != tt.exited {
+				t.Errorf("expected Exited=%v, got %v", tt.exited, hangErr.Exited)
+			}
+			if !strings.Contains(hangErr.Error(), "sleep 60") {
+				t.Errorf("expected the leftover sleep to be listed, got %q", hangErr.Error())
+			}
+
+			pgid := cmd.Process.Pid
+			deadline := time.Now().Add(2 * killGracePeriod)
+			for len(listProcessGroup(pgid)) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("processes still running: %v", listProcessGroup(pgid))
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSandbox_ProcessGroupCleanExit(t *testing.T) {
+	sb, err := New(Config{}, Limits{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// A detached background process doesn't fail the run but is cleaned up.
+	cmd := exec.CommandContext(context.Background(), "/bin/sh", "-c", "sleep 60 >/dev/null 2>&1 &")
+	if err := sb.Run(cmd); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	pgid := cmd.Process.Pid
+	deadline := time.Now().Add(2 * killGracePeriod)
+	for len(listProcessGroup(pgid)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("processes still running: %v", listProcessGroup(pgid))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
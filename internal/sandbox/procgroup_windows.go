@@ -0,0 +1,11 @@
+package sandbox
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(pgid int, kill bool) {}
+
+func listProcessGroup(pgid int) []string {
+	return nil
+}
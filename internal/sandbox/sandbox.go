@@ -0,0 +1,150 @@
+// Package sandbox runs generated scripts isolated from the rest of the system.
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Sandbox modes selectable via the sandbox.mode config key.
+const (
+	// ModeNone runs commands directly with the user's full privileges.
+	ModeNone = "none"
+	// ModeNamespace runs commands in fresh Linux user, mount, PID and network
+	// namespaces with a read-only view of the host filesystem.
+	ModeNamespace = "namespace"
+)
+
+// Config selects and tunes the sandbox backend.
+type Config struct {
+	Mode    string `yaml:"mode"`
+	Network bool   `yaml:"network"`
+}
+
+// Sandbox runs commands according to its configured backend and limits.
+type Sandbox struct {
+	mode    string
+	network bool
+	limits  Limits
+}
+
+// New creates a sandbox from cfg that applies limits to every command. An
+// empty mode means ModeNone.
+func New(cfg Config, limits Limits) (*Sandbox, error) {
+	if limits.kernelLimits() {
+		if err := limitsSupported(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Mode {
+	case "", ModeNone:
+		return &Sandbox{mode: ModeNone, limits: limits}, nil
+	case ModeNamespace:
+		if err := namespacesSupported(); err != nil {
+			return nil, err
+		}
+		return &Sandbox{mode: ModeNamespace, network: cfg.Network, limits: limits}, nil
+	default:
+		return nil, fmt.Errorf("unsupported sandbox mode: %s", cfg.Mode)
+	}
+}
+
+// Mode returns the sandbox backend in use.
+func (s *Sandbox) Mode() string {
+	return s.mode
+}
+
+// SetupError reports that the sandbox itself could not be set up, as opposed
+// to the sandboxed command failing. Callers should treat it as fatal rather
+// than as a script failure to be fixed.
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string {
+	return "failed to set up sandbox: " + e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// Run starts cmd and waits for it to complete. In ModeNamespace, cmd.Dir is
+// the only host directory the command may write to; everything else is
+// read-only, /tmp is a private scratch space and the network is unavailable
+// unless enabled. A *LimitError is returned when the command hit one of its
+// resource limits.
+//
+// Commands created with exec.CommandContext run in their own process group.
+// When the context is done the whole group gets SIGTERM and then SIGKILL, and
+// a *HangError lists the processes that were still running. The same happens
+// when the command exits but leaves background processes holding its output
+// open; other leftover processes are terminated silently.
+func (s *Sandbox) Run(cmd *exec.Cmd) error {
+	return s.run(cmd, "")
+}
+
+// RunOverlay runs cmd like Run, but against a copy-on-write view of cmd.Dir:
+// the command sees the directory's contents and may change them, but every
+// change is stored in scratch/upper, in overlayfs format, and cmd.Dir itself
+// is left untouched. scratch must be an empty directory; it's visible
+// read-only inside the sandbox, so it may also hold the command. RunOverlay
+// requires ModeNamespace.
+func (s *Sandbox) RunOverlay(cmd *exec.Cmd, scratch string) error {
+	if s.mode != ModeNamespace {
+		return &SetupError{Err: errors.New("a copy-on-write view requires the namespace sandbox")}
+	}
+	scratch, err := filepath.Abs(scratch)
+	if err != nil {
+		return &SetupError{Err: err}
+	}
+	for _, dir := range []string{"upper", "work"} {
+		if err := os.Mkdir(filepath.Join(scratch, dir), 0755); err != nil {
+			return &SetupError{Err: fmt.Errorf("failed to create overlay directory: %w", err)}
+		}
+	}
+	return s.run(cmd, scratch)
+}
+
+func (s *Sandbox) run(cmd *exec.Cmd, overlay string) error {
+	group := manageProcessGroup(cmd)
+	monitor := monitorOutput(cmd, s.limits)
+	if group != nil {
+		monitor.kill = group.kill
+	}
+
+	var err error
+	if s.mode == ModeNone && !s.limits.kernelLimits() {
+		err = cmd.Run()
+	} else {
+		err = run(cmd, s.mode == ModeNamespace, s.network, s.limits, overlay)
+	}
+
+	var setupErr *SetupError
+	if errors.As(err, &setupErr) {
+		return err
+	}
+	err = group.finish(err)
+	var hangErr *HangError
+	if errors.As(err, &hangErr) {
+		return err
+	}
+	if err != nil || monitor.exceeded {
+		if breach := monitor.breach(s.limits, cmd.ProcessState); breach != nil {
+			return breach
+		}
+	}
+	return err
+}
+
+// Init must be called at the very start of main. When the current process was
+// started by Run as the init process of a command, it sets up the isolated
+// filesystem and resource limits and replaces itself with the command, never
+// returning. Otherwise it does nothing.
+func Init() {
+	initialize()
+}
@@ -0,0 +1,502 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// initArg is argv[0] of the re-executed llmscript binary that acts as the
+// init process inside the new namespaces.
+const initArg = "llmscript-sandbox-init"
+
+// Secure bits that stop a uid 0 process from regaining capabilities on exec.
+// They aren't exported by x/sys/unix.
+const (
+	secbitNoRoot              = 1 << 0
+	secbitNoRootLocked        = 1 << 1
+	secbitNoSetuidFixup       = 1 << 2
+	secbitNoSetuidFixupLocked = 1 << 3
+)
+
+// spec tells the sandbox init process what to set up and what to run.
+type spec struct {
+	Isolate bool     `json:"isolate"`
+	Root    string   `json:"root"`
+	Dir     string   `json:"dir"`
+	Overlay string   `json:"overlay"`
+	Network bool     `json:"network"`
+	Limits  Limits   `json:"limits"`
+	SetupFD int      `json:"setup_fd"`
+	Path    string   `json:"path"`
+	Args    []string `json:"args"`
+}
+
+func limitsSupported() error {
+	return nil
+}
+
+func namespacesSupported() error {
+	if hint := namespaceHint(); hint != "" {
+		return errors.New(hint)
+	}
+	return nil
+}
+
+// namespaceHint explains why unprivileged user namespaces are unavailable, or
+// returns "" if nothing obviously disables them.
+func namespaceHint() string {
+	sysctls := []struct {
+		path, disabled, explanation string
+	}{
+		{"/proc/sys/kernel/unprivileged_userns_clone", "0",
+			"unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone=0)"},
+		{"/proc/sys/user/max_user_namespaces", "0",
+			"user namespaces are disabled (user.max_user_namespaces=0)"},
+		{"/proc/sys/kernel/apparmor_restrict_unprivileged_userns", "1",
+			"AppArmor restricts unprivileged user namespaces (kernel.apparmor_restrict_unprivileged_userns=1)"},
+	}
+	for _, s := range sysctls {
+		if data, err := os.ReadFile(s.path); err == nil && strings.TrimSpace(string(data)) == s.disabled {
+			return "the namespace sandbox is unavailable: " + s.explanation +
+				"; enable them with sysctl or set sandbox.mode to none"
+		}
+	}
+	return ""
+}
+
+// explain adds the namespace hint to permission errors so users learn why the
+// kernel refused to create the sandbox.
+func explain(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOSPC) {
+		hint := namespaceHint()
+		if hint == "" {
+			hint = "the kernel refused to create unprivileged namespaces; check that user namespaces are enabled or set sandbox.mode to none"
+		}
+		return fmt.Errorf("%w (%s)", err, hint)
+	}
+	return err
+}
+
+// run re-executes the current binary as a small init process that applies
+// the kernel resource limits and then execs the real command. When isolating,
+// it becomes the init process of new user, mount and PID (and, without
+// network access, network) namespaces and sets up the sandboxed filesystem
+// first. Setup failures are reported back over a close-on-exec pipe, so an
+// empty read means the command itself started.
+func run(cmd *exec.Cmd, isolate, network bool, limits Limits, overlay string) error {
+	s := spec{
+		Isolate: isolate,
+		Overlay: overlay,
+		Network: network,
+		Limits:  limits,
+		SetupFD: 3 + len(cmd.ExtraFiles),
+		Path:    cmd.Path,
+		Args:    cmd.Args,
+	}
+
+	if isolate {
+		dir := cmd.Dir
+		if dir == "" {
+			var err error
+			if dir, err = os.Getwd(); err != nil {
+				return &SetupError{Err: err}
+			}
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return &SetupError{Err: err}
+		}
+		s.Dir = dir
+
+		root, err := os.MkdirTemp("", "llmscript-root-*")
+		if err != nil {
+			return &SetupError{Err: fmt.Errorf("failed to create sandbox root: %w", err)}
+		}
+		defer func() {
+			_ = os.Remove(root)
+		}()
+		s.Root = root
+
+		cloneflags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+		if !network {
+			cloneflags |= syscall.CLONE_NEWNET
+		}
+		// The real uid and gid map to themselves so files keep their owners.
+		// The init process needs a few capabilities to build the sandbox;
+		// they're passed as ambient capabilities and dropped again before the
+		// command runs.
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Cloneflags = cloneflags
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+		cmd.SysProcAttr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SYS_CHROOT, unix.CAP_NET_ADMIN, unix.CAP_SETPCAP}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return &SetupError{Err: err}
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		_ = w.Close()
+		return &SetupError{Err: err}
+	}
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{initArg, string(data)}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return &SetupError{Err: explain(err)}
+	}
+
+	setupErr, _ := io.ReadAll(r)
+	err = cmd.Wait()
+	if len(setupErr) > 0 {
+		return &SetupError{Err: errors.New(string(setupErr))}
+	}
+	return err
+}
+
+// listProcessGroup returns "PID command" for every live process in the group.
+func listProcessGroup(pgid int) []string {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	var procs []string
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// The command name in parentheses may contain spaces, so fields are
+		// counted from the last closing parenthesis: state, ppid, pgrp, ...
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 3 || fields[0] == "Z" || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+
+		name := string(stat[strings.IndexByte(string(stat), '(')+1 : end])
+		if cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+			name = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+		}
+		procs = append(procs, fmt.Sprintf("%d %s", pid, name))
+	}
+	return procs
+}
+
+func initialize() {
+	if len(os.Args) != 2 || os.Args[0] != initArg {
+		return
+	}
+
+	var s spec
+	if err := json.Unmarshal([]byte(os.Args[1]), &s); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid sandbox spec: %v\n", err)
+		os.Exit(125)
+	}
+
+	setup := os.NewFile(uintptr(s.SetupFD), "setup")
+	syscall.CloseOnExec(s.SetupFD)
+
+	if s.Isolate {
+		if err := enter(s); err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+				if hint := namespaceHint(); hint != "" {
+					err = fmt.Errorf("%w (%s)", err, hint)
+				}
+			}
+			_, _ = setup.WriteString(err.Error())
+			os.Exit(125)
+		}
+	}
+	if err := setRlimits(s.Limits); err != nil {
+		_, _ = setup.WriteString(err.Error())
+		os.Exit(125)
+	}
+
+	// On success the setup pipe is closed by exec.
+	env := os.Environ()
+	if err := syscall.Exec(s.Path, s.Args, env); err != nil {
+		_, _ = setup.WriteString(fmt.Sprintf("failed to execute %s: %v", s.Path, err))
+		os.Exit(125)
+	}
+}
+
+// setRlimits applies the kernel-enforced limits to the current process, to be
+// inherited by the command it execs. The CPU hard limit is one second above
+// the soft limit so the command first gets SIGXCPU, which identifies the
+// breach, rather than an anonymous SIGKILL.
+func setRlimits(limits Limits) error {
+	rlimits := []struct {
+		resource int
+		name     string
+		value    uint64
+	}{
+		{unix.RLIMIT_CPU, "CPU time", uint64((limits.CPUTime + time.Second - 1) / time.Second)},
+		{unix.RLIMIT_AS, "memory", uint64(limits.Memory)},
+		{unix.RLIMIT_NOFILE, "open files", uint64(limits.OpenFiles)},
+		{unix.RLIMIT_NPROC, "processes", uint64(limits.Processes)},
+	}
+	for _, r := range rlimits {
+		if r.value == 0 {
+			continue
+		}
+		var current unix.Rlimit
+		if err := unix.Getrlimit(r.resource, &current); err != nil {
+			return fmt.Errorf("failed to read %s limit: %w", r.name, err)
+		}
+		limit := unix.Rlimit{Cur: min(r.value, current.Max), Max: min(r.value, current.Max)}
+		if r.resource == unix.RLIMIT_CPU {
+			limit.Max = min(r.value+1, current.Max)
+		}
+		if err := unix.Setrlimit(r.resource, &limit); err != nil {
+			return fmt.Errorf("failed to set %s limit: %w", r.name, err)
+		}
+	}
+	return nil
+}
+
+// cpuLimitHit reports whether a command was killed for exceeding its CPU time,
+// either directly or as reported by a shell whose child was killed.
+func cpuLimitHit(state *os.ProcessState) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	if status.Signaled() {
+		return status.Signal() == syscall.SIGXCPU
+	}
+	return status.ExitStatus() == 128+int(syscall.SIGXCPU)
+}
+
+// enter builds the sandboxed filesystem under s.Root, switches into it and
+// drops all capabilities.
+func enter(s spec) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// Read-only view of the whole host filesystem.
+	if err := unix.Mount("/", s.Root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind host root: %w", err)
+	}
+	if err := remountReadOnly(s.Root); err != nil {
+		return err
+	}
+
+	// A private, writable /tmp.
+	tmp := filepath.Join(s.Root, "tmp")
+	if err := unix.Mount("tmpfs", tmp, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("failed to mount /tmp: %w", err)
+	}
+
+	// The working directory is the only writable host path, unless it's an
+	// overlay whose changes land in the scratch directory instead.
+	target := filepath.Join(s.Root, s.Dir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create working directory mount point: %w", err)
+	}
+	if s.Overlay != "" {
+		if err := mountOverlay(s, target); err != nil {
+			return err
+		}
+	} else if err := unix.Mount(s.Dir, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind working directory: %w", err)
+	}
+
+	// A /proc matching the new PID namespace. Some container runtimes forbid
+	// mounting proc; the read-only host /proc is kept in that case.
+	_ = unix.Mount("proc", filepath.Join(s.Root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+
+	if !s.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("failed to bring up loopback interface: %w", err)
+		}
+	}
+
+	if err := unix.Chroot(s.Root); err != nil {
+		return fmt.Errorf("failed to chroot: %w", err)
+	}
+	if err := os.Chdir(s.Dir); err != nil {
+		return fmt.Errorf("failed to change to working directory: %w", err)
+	}
+
+	return dropCapabilities()
+}
+
+// mountOverlay mounts a copy-on-write view of the working directory at
+// target, with changes going to the upper directory in the scratch directory.
+// The scratch directory itself stays visible, read-only, at its own path so
+// that the command can live in it even when it's under /tmp.
+func mountOverlay(s spec, target string) error {
+	scratch := filepath.Join(s.Root, s.Overlay)
+	if err := os.MkdirAll(scratch, 0755); err != nil {
+		return fmt.Errorf("failed to create scratch mount point: %w", err)
+	}
+	if err := unix.Mount(s.Overlay, scratch, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind scratch directory: %w", err)
+	}
+	if err := remountReadOnly(scratch); err != nil {
+		return err
+	}
+
+	// userxattr lets an unprivileged mount record opaque directories.
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,userxattr",
+		s.Dir, filepath.Join(s.Overlay, "upper"), filepath.Join(s.Overlay, "work"))
+	if err := unix.Mount("overlay", target, "overlay", 0, options); err != nil {
+		return fmt.Errorf("failed to mount copy-on-write view of %s (overlayfs needs Linux 5.11 or later and a scratch directory that isn't itself on overlayfs): %w", s.Dir, err)
+	}
+	return nil
+}
+
+// remountReadOnly makes root and every mount beneath it read-only, keeping
+// each mount's existing nosuid/nodev/noexec/atime flags since the kernel
+// refuses to clear flags locked by a more privileged namespace.
+func remountReadOnly(root string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("failed to read mounts: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoint := unescapeMountPoint(fields[4])
+		if mountPoint == root || strings.HasPrefix(mountPoint, root+"/") {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read mounts: %w", err)
+	}
+
+	for _, mountPoint := range mounts {
+		var st unix.Statfs_t
+		if err := unix.Statfs(mountPoint, &st); err != nil {
+			return fmt.Errorf("failed to stat mount %s: %w", mountPoint, err)
+		}
+		flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+		for stFlag, msFlag := range map[int64]uintptr{
+			unix.ST_NOSUID:     unix.MS_NOSUID,
+			unix.ST_NODEV:      unix.MS_NODEV,
+			unix.ST_NOEXEC:     unix.MS_NOEXEC,
+			unix.ST_NOATIME:    unix.MS_NOATIME,
+			unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+			unix.ST_RELATIME:   unix.MS_RELATIME,
+		} {
+			if int64(st.Flags)&stFlag != 0 {
+				flags |= msFlag
+			}
+		}
+		if err := unix.Mount("", mountPoint, "", flags, ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", strings.TrimPrefix(mountPoint, root), err)
+		}
+	}
+	return nil
+}
+
+// unescapeMountPoint decodes the octal escapes (\040 for space, ...) used in
+// /proc/self/mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// loopbackUp brings up the loopback interface of the new network namespace
+// so tests can still talk to local servers.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// dropCapabilities clears every capability and prevents the sandboxed command
+// from regaining any, even when it runs as uid 0.
+func dropCapabilities() error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+	securebits := secbitNoRoot | secbitNoRootLocked | secbitNoSetuidFixup | secbitNoSetuidFixupLocked
+	if err := unix.Prctl(unix.PR_SET_SECUREBITS, uintptr(securebits), 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set securebits: %w", err)
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to drop capabilities: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The namespace sandbox re-executes the test binary as its init process.
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestSandbox_Namespace(t *testing.T) {
+	sb, err := New(Config{Mode: ModeNamespace}, Limits{})
+	if err != nil {
+		t.Skipf("namespace sandbox unavailable: %v", err)
+	}
+
+	workDir := t.TempDir()
+	outside := t.TempDir()
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", `
+echo inside > result.txt
+touch "$OUTSIDE/escaped" 2>/dev/null && echo "outside write succeeded"
+echo scratch > /tmp/scratch && cat /tmp/scratch
+echo "pid $$"
+`)
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), "OUTSIDE="+outside)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err = sb.Run(cmd)
+	var setupErr *SetupError
+	if errors.As(err, &setupErr) {
+		t.Skipf("namespace sandbox unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("sandboxed command failed: %v\n%s", err, out.String())
+	}
+
+	if data, err := os.ReadFile(filepath.Join(workDir, "result.txt")); err != nil || string(data) != "inside\n" {
+		t.Errorf("expected the working directory to be writable, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "escaped")); err == nil {
+		t.Errorf("command wrote outside its working directory")
+	}
+	if _, err := os.Stat("/tmp/scratch"); err == nil {
+		t.Errorf("sandbox /tmp leaked onto the host")
+	}
+	if !bytes.Contains(out.Bytes(), []byte("scratch")) {
+		t.Errorf("expected /tmp to be writable inside the sandbox:\n%s", out.String())
+	}
+	if !bytes.Contains(out.Bytes(), []byte("pid 1\n")) {
+		t.Errorf("expected the command to run as PID 1 of a new PID namespace:\n%s", out.String())
+	}
+}
+
+func TestSandbox_None(t *testing.T) {
+	sb, err := New(Config{}, Limits{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if sb.Mode() != ModeNone {
+		t.Errorf("expected mode %q, got %q", ModeNone, sb.Mode())
+	}
+	if err := sb.Run(exec.Command("true")); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+
+	if _, err := New(Config{Mode: "bogus"}, Limits{}); err == nil {
+		t.Errorf("expected an error for an unknown mode")
+	}
+}
+
+func TestSandbox_KernelLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   Limits
+		script   string
+		resource string
+	}{
+		{
+			name:     "cpu time",
+			limits:   Limits{CPUTime: time.Second},
+			script:   "while :; do :; done",
+			resource: "CPU time",
+		},
+		{
+			name:     "open files",
+			limits:   Limits{OpenFiles: 3},
+			script:   ": < /dev/null",
+			resource: "open files",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb, err := New(Config{}, tt.limits)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			var out bytes.Buffer
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+
+			err = sb.Run(cmd)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected a LimitError, got %v\n%s", err, out.String())
+			}
+			if limitErr.Resource != tt.resource {
+				t.Errorf("expected %s breach, got %s", tt.resource, limitErr.Resource)
+			}
+		})
+	}
+}
+
+func TestSandbox_KernelLimitsRedirected(t *testing.T) {
+	sb, err := New(Config{}, Limits{OpenFiles: 3})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// Without an output limit, the output of the final script goes straight
+	// to its files, so the breach is only seen as a failure.
+	path := filepath.Join(t.TempDir(), "out")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer func() {
+		_ = out.Close()
+	}()
+	cmd := exec.Command("/bin/sh", "-c", ": < /dev/null")
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := sb.Run(cmd); err == nil {
+		t.Fatal("expected the command to fail")
+	}
+	if cmd.Stdout != out || cmd.Stderr != out {
+		t.Errorf("expected stdout and stderr to stay the file")
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func namespacesSupported() error {
+	return errors.New("the namespace sandbox is only supported on Linux; set sandbox.mode to none")
+}
+
+func limitsSupported() error {
+	return errors.New("CPU, memory, open file and process limits are only supported on Linux")
+}
+
+func run(cmd *exec.Cmd, isolate, network bool, limits Limits, overlay string) error {
+	return &SetupError{Err: namespacesSupported()}
+}
+
+func cpuLimitHit(state *os.ProcessState) bool {
+	return false
+}
+
+func initialize() {}
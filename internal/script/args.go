@@ -0,0 +1,274 @@
+package script
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Argument declares a positional argument or an option of the generated
+// script. When a script declares any, llmscript parses and validates the
+// command line itself and always invokes the script in a canonical form, so
+// callers get the same interface no matter how often the script is
+// regenerated.
+type Argument struct {
+	Name     string  `yaml:"name"`
+	Type     string  `yaml:"type"`
+	Default  *string `yaml:"default"`
+	Required bool    `yaml:"required"`
+	Help     string  `yaml:"help"`
+}
+
+// kind returns the argument's type, defaulting to string.
+func (a Argument) kind() string {
+	if a.Type == "" {
+		return "string"
+	}
+	return a.Type
+}
+
+// check reports whether value is valid for the argument's type.
+func (a Argument) check(value string) error {
+	var err error
+	switch a.kind() {
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s value %q for %s", a.kind(), value, a.Name)
+	}
+	return nil
+}
+
+// hasArgSchema reports whether the script declares any arguments or options.
+func (f *Frontmatter) hasArgSchema() bool {
+	return len(f.Arguments) > 0 || len(f.Options) > 0
+}
+
+// validateArgSchema checks the declared arguments and options for unknown
+// types, duplicate names, bad defaults and required positionals that follow
+// optional ones.
+func (f *Frontmatter) validateArgSchema() error {
+	seen := map[string]bool{"help": true, "h": true}
+	optional := false
+	all := append(append([]Argument{}, f.Arguments...), f.Options...)
+	for i, a := range all {
+		if a.Name == "" || strings.HasPrefix(a.Name, "-") || strings.ContainsAny(a.Name, "= \t") {
+			return fmt.Errorf("invalid argument name %q", a.Name)
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("duplicate or reserved argument name %q", a.Name)
+		}
+		seen[a.Name] = true
+
+		switch a.kind() {
+		case "string", "int", "float", "bool":
+		default:
+			return fmt.Errorf("argument %s has unsupported type %q (use string, int, float or bool)", a.Name, a.Type)
+		}
+		if a.Default != nil {
+			if err := a.check(*a.Default); err != nil {
+				return fmt.Errorf("bad default: %w", err)
+			}
+		}
+
+		if i < len(f.Arguments) {
+			if a.Required && optional {
+				return fmt.Errorf("required argument %s cannot follow an optional one", a.Name)
+			}
+			if !a.Required {
+				optional = true
+			}
+		}
+	}
+	return nil
+}
+
+// ParseArgs validates the command line against the declared arguments and
+// options and returns it in the canonical form the script is generated to
+// expect: every option as --name=value in declaration order, then "--", then
+// the positional arguments. Scripts without a schema get their arguments
+// forwarded unchanged. flag.ErrHelp is returned when -h or --help is given.
+func (s *Source) ParseArgs(args []string) ([]string, error) {
+	f := &s.Frontmatter
+	if !f.hasArgSchema() {
+		return args, nil
+	}
+
+	fs := flag.NewFlagSet("script", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := make(map[string]*string, len(f.Options))
+	bools := make(map[string]*bool, len(f.Options))
+	for _, o := range f.Options {
+		def := ""
+		if o.Default != nil {
+			def = *o.Default
+		}
+		if o.kind() == "bool" {
+			b, _ := strconv.ParseBool(def)
+			bools[o.Name] = fs.Bool(o.Name, b, o.Help)
+		} else {
+			values[o.Name] = fs.String(o.Name, def, o.Help)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	var out []string
+	for _, o := range f.Options {
+		if o.kind() == "bool" {
+			out = append(out, fmt.Sprintf("--%s=%t", o.Name, *bools[o.Name]))
+			continue
+		}
+		if !set[o.Name] && o.Default == nil {
+			if o.Required {
+				return nil, fmt.Errorf("missing required option --%s", o.Name)
+			}
+			continue
+		}
+		value := *values[o.Name]
+		if err := o.check(value); err != nil {
+			return nil, err
+		}
+		out = append(out, fmt.Sprintf("--%s=%s", o.Name, value))
+	}
+
+	out = append(out, "--")
+	positional := fs.Args()
+	if len(positional) > len(f.Arguments) {
+		return nil, fmt.Errorf("too many arguments: expected at most %d, got %d", len(f.Arguments), len(positional))
+	}
+	// Optional arguments without a default that weren't given are passed as
+	// empty strings if a later argument has a default, so that it stays in
+	// its position, and omitted at the end.
+	var skipped int
+	for i, a := range f.Arguments {
+		var value string
+		switch {
+		case i < len(positional):
+			value = positional[i]
+		case a.Default != nil:
+			value = *a.Default
+		case a.Required:
+			return nil, fmt.Errorf("missing required argument %s", a.Name)
+		default:
+			skipped++
+			continue
+		}
+		if err := a.check(value); err != nil {
+			return nil, err
+		}
+		for ; skipped > 0; skipped-- {
+			out = append(out, "")
+		}
+		out = append(out, value)
+	}
+	return out, nil
+}
+
+// Usage returns the --help text for the script's declared interface.
+func (s *Source) Usage(program string) string {
+	f := &s.Frontmatter
+	var sb strings.Builder
+
+	sb.WriteString("Usage: " + program)
+	if len(f.Options) > 0 {
+		sb.WriteString(" [options]")
+	}
+	for _, a := range f.Arguments {
+		if a.Required {
+			sb.WriteString(" <" + a.Name + ">")
+		} else {
+			sb.WriteString(" [" + a.Name + "]")
+		}
+	}
+	sb.WriteString("\n")
+
+	if summary, _, _ := strings.Cut(s.Description, "\n"); summary != "" {
+		sb.WriteString("\n" + summary + "\n")
+	}
+
+	writeSection := func(title string, args []Argument, prefix string) {
+		if len(args) == 0 {
+			return
+		}
+		sb.WriteString("\n" + title + ":\n")
+		tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+		for _, a := range args {
+			fmt.Fprintf(tw, "  %s%s %s\t%s\n", prefix, a.Name, a.kind(), describeArgument(a))
+		}
+		_ = tw.Flush()
+	}
+	writeSection("Arguments", f.Arguments, "")
+	writeSection("Options", f.Options, "--")
+
+	return sb.String()
+}
+
+// describeArgument returns the help text followed by the default or a
+// required marker.
+func describeArgument(a Argument) string {
+	var parts []string
+	if a.Help != "" {
+		parts = append(parts, a.Help)
+	}
+	switch {
+	case a.Default != nil:
+		parts = append(parts, fmt.Sprintf("(default %q)", *a.Default))
+	case a.Required:
+		parts = append(parts, "(required)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatArgSchema renders the declared interface as a block appended to the
+// description so the LLM generates a script that parses exactly the canonical
+// form produced by ParseArgs.
+func formatArgSchema(f *Frontmatter) string {
+	if !f.hasArgSchema() {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<interface>\n")
+	sb.WriteString("llmscript validates the command line and handles --help itself, then always invokes the script as:\n\n")
+	sb.WriteString("  ./script.sh [--option=value ...] -- [argument ...]\n\n")
+	sb.WriteString("Options come first, in the order listed below, each exactly once in --name=value form. " +
+		"Boolean options are always passed as --name=true or --name=false. " +
+		"Other options that were not given and have no default are omitted. " +
+		"A literal -- always follows the options, then the positional arguments in the order listed below; " +
+		"optional arguments without a default that were not given are passed as empty strings " +
+		"if a later argument has a default, and omitted at the end. " +
+		"Values are already validated against their types. " +
+		"The script must parse exactly this form and must not implement its own --help, " +
+		"and tests must invoke ./script.sh in this same form.\n")
+	for _, section := range []struct {
+		title  string
+		args   []Argument
+		prefix string
+	}{
+		{"Options", f.Options, "--"},
+		{"Arguments", f.Arguments, ""},
+	} {
+		if len(section.args) == 0 {
+			continue
+		}
+		sb.WriteString("\n" + section.title + ":\n")
+		for _, a := range section.args {
+			fmt.Fprintf(&sb, "- %s%s (%s): %s\n", section.prefix, a.Name, a.kind(), describeArgument(a))
+		}
+	}
+	sb.WriteString("</interface>")
+	return sb.String()
+}
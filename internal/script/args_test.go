@@ -0,0 +1,124 @@
+package script
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const argsSource = `#!/usr/bin/env llmscript
+---
+arguments:
+  - name: input
+    required: true
+    help: Directory to read
+  - name: output
+    default: out
+options:
+  - name: size
+    type: int
+    default: 256
+    help: Width and height in pixels
+  - name: quality
+    type: float
+  - name: dry-run
+    type: bool
+---
+Resize every PNG in the input directory`
+
+func TestSource_ParseArgs(t *testing.T) {
+	src, err := ParseSource(argsSource)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "defaults", args: []string{"in"}, want: []string{"--size=256", "--dry-run=false", "--", "in", "out"}},
+		{
+			name: "all set",
+			args: []string{"--size=64", "--quality", "0.5", "--dry-run", "in", "dest"},
+			want: []string{"--size=64", "--quality=0.5", "--dry-run=true", "--", "in", "dest"},
+		},
+		{name: "missing required", args: []string{}, wantErr: true},
+		{name: "bad int", args: []string{"--size=big", "in"}, wantErr: true},
+		{name: "unknown option", args: []string{"--bogus", "in"}, wantErr: true},
+		{name: "too many", args: []string{"a", "b", "c"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := src.ParseArgs(tt.args)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = src.ParseArgs([]string{"--help"})
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func TestSource_ParseArgsSkippedOptional(t *testing.T) {
+	src, err := ParseSource("---\narguments:\n  - name: a\n  - name: b\n  - name: c\n    default: x\n  - name: d\n---\nPrint the arguments")
+	require.NoError(t, err)
+
+	// b has no default, so it's passed empty to keep c's default in place.
+	got, err := src.ParseArgs([]string{"1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--", "1", "", "x"}, got)
+
+	got, err = src.ParseArgs(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--", "", "", "x"}, got)
+}
+
+func TestSource_ParseArgsWithoutSchema(t *testing.T) {
+	src, err := ParseSource("Print hello world")
+	require.NoError(t, err)
+
+	args := []string{"--anything", "goes"}
+	got, err := src.ParseArgs(args)
+	require.NoError(t, err)
+	assert.Equal(t, args, got)
+	assert.NotContains(t, src.Prompt(), "<interface>")
+}
+
+func TestSource_Usage(t *testing.T) {
+	src, err := ParseSource(argsSource)
+	require.NoError(t, err)
+
+	usage := src.Usage("resize")
+	assert.Contains(t, usage, "Usage: resize [options] <input> [output]")
+	assert.Contains(t, usage, "Resize every PNG in the input directory")
+	assert.Contains(t, usage, "--size int")
+	assert.Contains(t, usage, `Width and height in pixels (default "256")`)
+	assert.Contains(t, usage, "Directory to read (required)")
+
+	prompt := src.Prompt()
+	assert.Contains(t, prompt, "<interface>")
+	assert.Contains(t, prompt, "--dry-run (bool)")
+}
+
+func TestParseSource_InvalidArgSchema(t *testing.T) {
+	for name, frontmatter := range map[string]string{
+		"unknown type":      "options:\n  - name: n\n    type: number",
+		"bad default":       "options:\n  - name: n\n    type: int\n    default: x",
+		"duplicate":         "arguments:\n  - name: a\noptions:\n  - name: a",
+		"reserved":          "options:\n  - name: help",
+		"required after":    "arguments:\n  - name: a\n  - name: b\n    required: true",
+		"invalid example":   "arguments:\n  - name: a\n    required: true\nexamples:\n  - args: []",
+		"name with a space": "options:\n  - name: two words",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseSource("---\n" + frontmatter + "\n---\nDo something")
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,86 +1,523 @@
 package script
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/statico/llmscript/internal/llm"
+	"github.com/statico/llmscript/internal/log"
 )
 
 // Cache handles caching of successful scripts and their test plans
 type Cache struct {
-	dir string
+	dir    string
+	remote Backend
+	keys   *Keyring
 }
 
-// NewCache creates a new cache instance. The cache lives under the same config
-// directory as the config file, honoring XDG_CONFIG_HOME so it can be isolated
-// in tests and sandboxes.
+// CacheEntry is a cached script pair together with the platform it was
+// generated and tested on and bookkeeping used to inspect and prune the cache.
+type CacheEntry struct {
+	Scripts     llm.ScriptPair `json:"scripts"`
+	Platform    string         `json:"platform"`
+	Description string         `json:"description"`
+	Provider    string         `json:"provider"`
+	Model       string         `json:"model"`
+	Created     time.Time      `json:"created"`
+	LastUsed    time.Time      `json:"last_used"`
+	Hits        int            `json:"hits"`
+	// Signer is the public key that signed the entry, and Signature its
+	// signature over the scripts and where they came from.
+	Signer    string `json:"signer"`
+	Signature string `json:"signature"`
+}
+
+// signedEntry is the part of a cache entry covered by its signature. The
+// entry's ID is included so that a signed entry can't be moved to another
+// key.
+type signedEntry struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`
+	Platform    string `json:"platform"`
+	MainScript  string `json:"main_script"`
+	TestScript  string `json:"test_script"`
+}
+
+func (e *CacheEntry) signed(id string) signedEntry {
+	return signedEntry{
+		ID:          id,
+		Description: e.Description,
+		Provider:    e.Provider,
+		Model:       e.Model,
+		Platform:    e.Platform,
+		MainScript:  e.Scripts.MainScript,
+		TestScript:  e.Scripts.TestScript,
+	}
+}
+
+// StoredEntry is a cache entry as found on disk.
+type StoredEntry struct {
+	CacheEntry
+	ID   string // the entry's key, which is also its file name
+	Size int64  // size of the entry's file in bytes
+}
+
+// NewCache creates a new cache instance. The cache lives in
+// $XDG_CACHE_HOME/llmscript (~/.cache/llmscript by default). Entries left in
+// the old location under the config directory are removed. Entries are
+// signed with the local key and only returned if signed by a trusted key.
 func NewCache() (*Cache, error) {
-	configDir := os.Getenv("XDG_CONFIG_HOME")
-	if configDir == "" {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get home directory: %w", err)
-		}
-		configDir = filepath.Join(homeDir, ".config")
+	keys, err := LoadKeyring()
+	if err != nil {
+		return nil, err
 	}
 
-	cacheDir := filepath.Join(configDir, "llmscript", "cache")
+	cacheDir, err := xdgDir("XDG_CACHE_HOME", ".cache")
+	if err != nil {
+		return nil, err
+	}
+	cacheDir = filepath.Join(cacheDir, "llmscript")
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
-	return &Cache{dir: cacheDir}, nil
+	if configDir, err := xdgDir("XDG_CONFIG_HOME", ".config"); err == nil {
+		dropOldCache(filepath.Join(configDir, "llmscript", "cache"))
+	}
+	return &Cache{dir: cacheDir, keys: keys}, nil
 }
 
-// Get retrieves a cached script pair
-func (c *Cache) Get(description string) (llm.ScriptPair, error) {
-	hash := c.hashDescription(description)
-	scriptPath := filepath.Join(c.dir, hash+".json")
+// xdgDir returns the directory named by an XDG environment variable, falling
+// back to a directory in the user's home.
+func xdgDir(env, fallback string) (string, error) {
+	if dir := os.Getenv(env); dir != "" {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, fallback), nil
+}
 
-	// Check if file exists
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-		return llm.ScriptPair{}, nil
+// dropOldCache removes the entries left in the cache's old location and then
+// the directory itself. They were keyed before the prompt version and
+// platform were part of the key, and aren't signed, so they could never be
+// used. Failures are ignored since the old entries only take up space.
+func dropOldCache(oldDir string) {
+	files, err := filepath.Glob(filepath.Join(oldDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return
 	}
 
-	// Read script pair
-	data, err := os.ReadFile(scriptPath)
+	log.Debug("Removing %d unusable cached scripts from %s", len(files), oldDir)
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+	_ = os.Remove(oldDir)
+}
+
+// SetRemote makes the cache read through to a shared backend: entries
+// missing locally are downloaded from it and new entries are uploaded to it.
+func (c *Cache) SetRemote(remote Backend) {
+	c.remote = remote
+}
+
+// Dir returns the directory the cache is stored in.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Keys returns the keyring entries are signed and verified with.
+func (c *Cache) Keys() *Keyring {
+	return c.keys
+}
+
+// Get retrieves the cache entry for a description generated under the given
+// settings, falling back to the remote backend if there is one. It returns
+// nil if there is none. Entries that aren't signed by a trusted key are
+// reported and treated as missing.
+func (c *Cache) Get(description, settings string) (*CacheEntry, error) {
+	id := c.hashKey(description, settings)
+	entry, err := c.read(id)
+	if os.IsNotExist(err) {
+		return c.fetch(id)
+	}
 	if err != nil {
-		return llm.ScriptPair{}, fmt.Errorf("failed to read cached script: %w", err)
+		return nil, err
+	}
+	if entry.Scripts.MainScript == "" {
+		return nil, nil
+	}
+	if err := c.Verify(id, entry); err != nil {
+		log.Warn("Ignoring cached script %s: %v", id, err)
+		return nil, nil
 	}
+	return entry, nil
+}
+
+// Verify checks that the entry with the given ID is signed by a trusted key.
+func (c *Cache) Verify(id string, entry *CacheEntry) error {
+	return c.keys.verify("cache entry", entry.signed(id), entry.Signer, entry.Signature)
+}
 
-	var scripts llm.ScriptPair
-	if err := json.Unmarshal(data, &scripts); err != nil {
-		return llm.ScriptPair{}, fmt.Errorf("failed to parse cached scripts: %w", err)
+// Set stores a successful script pair signed with the local key. Its
+// creation and last-used times are set to now and its hit count is reset.
+func (c *Cache) Set(description, settings string, entry CacheEntry) error {
+	now := time.Now()
+	entry.Created = now
+	entry.LastUsed = now
+	entry.Hits = 0
+	if entry.Description == "" {
+		entry.Description = strings.TrimSpace(description)
+	}
+	id := c.hashKey(description, settings)
+	var err error
+	if entry.Signer, entry.Signature, err = c.keys.sign("cache entry", entry.signed(id)); err != nil {
+		return err
 	}
+	if err := c.write(id, &entry); err != nil {
+		return err
+	}
+	c.push(id, &entry)
+	return nil
+}
+
+// fetch downloads an entry missing from the local cache from the remote
+// backend and keeps a local copy. Remote failures are logged and treated as
+// a miss, since the entry can always be regenerated.
+func (c *Cache) fetch(id string) (*CacheEntry, error) {
+	if c.remote == nil {
+		return nil, nil
+	}
+	data, err := c.remote.Get(id + ".json")
+	if err != nil {
+		log.Warn("Failed to check remote cache %s: %v", c.remote, err)
+		return nil, nil
+	}
+	if data == nil {
+		return nil, nil
+	}
+	entry, err := decodeRemoteEntry(data)
+	if err != nil {
+		log.Warn("Ignoring cached script %s from %s: %v", id, c.remote, err)
+		return nil, nil
+	}
+	if entry.Scripts.MainScript == "" {
+		return nil, nil
+	}
+	if err := c.Verify(id, entry); err != nil {
+		log.Warn("Ignoring cached script %s from %s: %v", id, c.remote, err)
+		return nil, nil
+	}
+
+	log.Info("Downloaded cached script from %s", c.remote)
+	entry.LastUsed = time.Now()
+	entry.Hits = 0
+	if err := c.write(id, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// push uploads a new entry to the remote backend. Failures are logged since
+// the entry is already in the local cache.
+func (c *Cache) push(id string, entry *CacheEntry) {
+	if c.remote == nil {
+		return
+	}
+	data, err := encodeRemoteEntry(entry)
+	if err == nil {
+		err = c.remote.Put(id+".json", data)
+	}
+	if err != nil {
+		log.Warn("Failed to upload script to remote cache %s: %v", c.remote, err)
+	}
+}
 
-	return scripts, nil
+// Touch records that the entry for a description was used.
+func (c *Cache) Touch(description, settings string) error {
+	id := c.hashKey(description, settings)
+	entry, err := c.read(id)
+	if err != nil {
+		return err
+	}
+	entry.LastUsed = time.Now()
+	entry.Hits++
+	return c.write(id, entry)
 }
 
-// Set stores a successful script pair
-func (c *Cache) Set(description string, scripts llm.ScriptPair) error {
-	hash := c.hashDescription(description)
-	scriptPath := filepath.Join(c.dir, hash+".json")
+// List returns every entry in the cache, most recently used first. Files
+// that can't be parsed are skipped.
+func (c *Cache) List() ([]StoredEntry, error) {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache: %w", err)
+	}
 
-	// Write script pair
-	data, err := json.Marshal(scripts)
+	var entries []StoredEntry
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		entry, err := c.read(id)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, StoredEntry{CacheEntry: *entry, ID: id, Size: info.Size()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Find returns the entry whose ID starts with prefix, which must be
+// unambiguous.
+func (c *Cache) Find(prefix string) (*StoredEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *StoredEntry
+	for i := range entries {
+		if strings.HasPrefix(entries[i].ID, prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("cache entry ID %s is ambiguous", prefix)
+			}
+			found = &entries[i]
+		}
+	}
+	if found == nil || prefix == "" {
+		return nil, fmt.Errorf("no cache entry with ID %s", prefix)
+	}
+	return found, nil
+}
+
+// Remove deletes the entry with the given ID and its lock file.
+func (c *Cache) Remove(id string) error {
+	if err := os.Remove(filepath.Join(c.dir, id+".json")); err != nil {
+		return fmt.Errorf("failed to remove cache entry: %w", err)
+	}
+	c.removeLock(id)
+	return nil
+}
+
+// Clear deletes every entry and any leftover lock files, and returns the
+// number of entries removed.
+func (c *Cache) Clear() (int, error) {
+	entries, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := c.Remove(entry.ID); err != nil {
+			return i, err
+		}
+	}
+	c.sweepLocks()
+	return len(entries), nil
+}
+
+// Prune removes entries not used within maxAge and then, if the cache is
+// still larger than maxSize bytes, the least recently used entries until it
+// fits. A zero maxAge or maxSize disables that policy. It returns the
+// removed entries.
+func (c *Cache) Prune(maxAge time.Duration, maxSize int64) ([]StoredEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []StoredEntry
+	var kept []StoredEntry
+	var size int64
+	for _, e := range entries {
+		if maxAge > 0 && time.Since(e.LastUsed) > maxAge {
+			if err := c.Remove(e.ID); err != nil {
+				return removed, err
+			}
+			removed = append(removed, e)
+			continue
+		}
+		kept = append(kept, e)
+		size += e.Size
+	}
+
+	// Entries are sorted most recently used first, so evict from the end.
+	for i := len(kept) - 1; maxSize > 0 && size > maxSize && i >= 0; i-- {
+		if err := c.Remove(kept[i].ID); err != nil {
+			return removed, err
+		}
+		removed = append(removed, kept[i])
+		size -= kept[i].Size
+	}
+	c.sweepLocks()
+	return removed, nil
+}
+
+func (c *Cache) read(id string) (*CacheEntry, error) {
+	data, err := os.ReadFile(filepath.Join(c.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached script: %w", err)
+	}
+
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse cached scripts: %w", err)
+	}
+	return &entry, nil
+}
+
+func (c *Cache) write(id string, entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("failed to marshal scripts: %w", err)
 	}
-	if err := os.WriteFile(scriptPath, data, 0644); err != nil {
+	if err := writeFileAtomic(filepath.Join(c.dir, id+".json"), data); err != nil {
 		return fmt.Errorf("failed to write cached script: %w", err)
 	}
-
 	return nil
 }
 
-// hashDescription generates a SHA-256 hash of the script description
-func (c *Cache) hashDescription(description string) string {
-	hash := sha256.Sum256([]byte(strings.TrimSpace(description)))
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lockPollInterval is how often Lock retries while another process holds the
+// lock.
+const lockPollInterval = 200 * time.Millisecond
+
+// Lock takes an exclusive advisory lock on the entry for a description, so
+// that concurrent runs generating the same script wait for the first one and
+// then reuse its result instead of racing it. It waits until the lock is
+// free or ctx is done. Call the returned function to release the lock.
+func (c *Cache) Lock(ctx context.Context, description, settings string) (func(), error) {
+	path := filepath.Join(c.dir, c.hashKey(description, settings)+".lock")
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cache lock: %w", err)
+		}
+		locked, err := tryLock(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("failed to lock cache entry: %w", err)
+		}
+		if locked {
+			// The lock file may have been removed while we waited for it,
+			// and another process may then have locked a new one; the lock
+			// only counts if it's still the file at path.
+			if lockedCurrent(f, path) {
+				return func() {
+					_ = unlock(f)
+					_ = f.Close()
+				}, nil
+			}
+			_ = unlock(f)
+			_ = f.Close()
+			continue
+		}
+		_ = f.Close()
+		if !waiting {
+			log.Info("Waiting for another llmscript process generating the same script...")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockedCurrent reports whether the open file f is still the file at path.
+func lockedCurrent(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, current)
+}
+
+// removeLock deletes the lock file of the entry with the given ID unless
+// another process holds it. It's deleted while locked, so a process that
+// opened it in the meantime finds out in Lock and opens the new one. Lock
+// files are only recreated as needed, so a failure to remove one is ignored.
+func (c *Cache) removeLock(id string) {
+	path := filepath.Join(c.dir, id+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if locked, err := tryLock(f); err == nil && locked {
+		_ = os.Remove(path)
+		_ = unlock(f)
+	}
+}
+
+// sweepLocks deletes the lock files of entries that no longer exist, such as
+// those left behind by runs that failed to generate a script.
+func (c *Cache) sweepLocks() {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.lock"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".lock")
+		if _, err := os.Stat(filepath.Join(c.dir, id+".json")); os.IsNotExist(err) {
+			c.removeLock(id)
+		}
+	}
+}
+
+// hashKey generates a SHA-256 hash of the script description and the
+// settings it was generated under
+func (c *Cache) hashKey(description, settings string) string {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(description) + "\x00" + settings))
 	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,202 @@
+package script
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Management(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+
+	scripts := llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\ntrue"}
+	for _, description := range []string{"old", "recent", "newest"} {
+		require.NoError(t, cache.Set(description, "settings", CacheEntry{Scripts: scripts, Provider: "claude", Model: "claude-haiku-4-5"}))
+	}
+
+	// Backdate "old" so it's the least recently used.
+	oldID := cache.hashKey("old", "settings")
+	entry, err := cache.read(oldID)
+	require.NoError(t, err)
+	entry.LastUsed = time.Now().Add(-48 * time.Hour)
+	require.NoError(t, cache.write(oldID, entry))
+
+	require.NoError(t, cache.Touch("recent", "settings"))
+	got, err := cache.Get("recent", "settings")
+	require.NoError(t, err)
+	assert.Equal(t, 1, got.Hits)
+	assert.Equal(t, "claude", got.Provider)
+	assert.Equal(t, "recent", got.Description)
+
+	entries, err := cache.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "recent", entries[0].Description)
+	assert.Equal(t, "old", entries[2].Description)
+
+	found, err := cache.Find(oldID[:8])
+	require.NoError(t, err)
+	assert.Equal(t, "old", found.Description)
+	_, err = cache.Find("zz")
+	assert.Error(t, err)
+
+	// A corrupt file doesn't break listing.
+	require.NoError(t, os.WriteFile(filepath.Join(cache.Dir(), "corrupt.json"), []byte("{"), 0644))
+
+	removed, err := cache.Prune(24*time.Hour, 0)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "old", removed[0].Description)
+
+	// Only room for one entry: the most recently used is kept.
+	removed, err = cache.Prune(0, entries[0].Size)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	entries, err = cache.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "recent", entries[0].Description)
+
+	require.NoError(t, cache.Remove(entries[0].ID))
+	missing, err := cache.Get("recent", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestCache_OldLocation(t *testing.T) {
+	cacheHome := t.TempDir()
+	configHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+
+	oldDir := filepath.Join(configHome, "llmscript", "cache")
+	require.NoError(t, os.MkdirAll(oldDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(oldDir, "abc.json"), []byte(`{"scripts":{"MainScript":"echo old"}}`), 0644))
+
+	cache, err := NewCache()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(cacheHome, "llmscript"), cache.Dir())
+
+	// Old entries could never be used, so they're dropped.
+	entries, err := cache.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = os.Stat(oldDir)
+	assert.True(t, os.IsNotExist(err), "expected the old cache directory to be removed")
+}
+
+func TestCache_Lock(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+
+	unlock, err := cache.Lock(context.Background(), "desc", "settings")
+	require.NoError(t, err)
+
+	// A second lock on the same entry waits, and gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*lockPollInterval)
+	defer cancel()
+	_, err = cache.Lock(ctx, "desc", "settings")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Other entries aren't affected.
+	unlockOther, err := cache.Lock(context.Background(), "other", "settings")
+	require.NoError(t, err)
+	unlockOther()
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := cache.Lock(context.Background(), "desc", "settings")
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not handed over after being released")
+	}
+}
+
+func TestCache_LockRemoved(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+
+	unlock, err := cache.Lock(context.Background(), "desc", "settings")
+	require.NoError(t, err)
+	acquired := make(chan struct{})
+	go func() {
+		release, err := cache.Lock(context.Background(), "desc", "settings")
+		if err == nil {
+			release()
+		}
+		close(acquired)
+	}()
+	time.Sleep(2 * lockPollInterval)
+
+	// Once the lock file is removed, a new one can be locked, and the lock
+	// on the removed file no longer keeps anyone out once released.
+	require.NoError(t, os.Remove(filepath.Join(cache.Dir(), cache.hashKey("desc", "settings")+".lock")))
+	unlockNew, err := cache.Lock(context.Background(), "desc", "settings")
+	require.NoError(t, err)
+	unlock()
+	select {
+	case <-acquired:
+		t.Fatal("lock was taken on a removed lock file")
+	case <-time.After(3 * lockPollInterval):
+	}
+	unlockNew()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not handed over after being released")
+	}
+}
+
+func TestCache_LockFiles(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+	lockFile := func(description string) string {
+		return filepath.Join(cache.Dir(), cache.hashKey(description, "settings")+".lock")
+	}
+
+	scripts := llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\ntrue"}
+	for _, description := range []string{"cached", "failed"} {
+		unlock, err := cache.Lock(context.Background(), description, "settings")
+		require.NoError(t, err)
+		if description == "cached" {
+			require.NoError(t, cache.Set(description, "settings", CacheEntry{Scripts: scripts}))
+		}
+		unlock()
+	}
+	unlock, err := cache.Lock(context.Background(), "running", "settings")
+	require.NoError(t, err)
+	defer unlock()
+
+	// Removing an entry removes its lock, and clearing the cache sweeps the
+	// lock left behind by a run that failed, but not one still held.
+	require.NoError(t, cache.Remove(cache.hashKey("cached", "settings")))
+	assert.NoFileExists(t, lockFile("cached"))
+	assert.FileExists(t, lockFile("failed"))
+	n, err := cache.Clear()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoFileExists(t, lockFile("failed"))
+	assert.FileExists(t, lockFile("running"))
+}
@@ -0,0 +1,261 @@
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
+)
+
+// DefaultParallel is how many candidates are generated or tested at once
+// unless configured otherwise.
+const DefaultParallel = 4
+
+// candidate is one of the script pairs generated for a best-of-N run.
+type candidate struct {
+	index    int
+	scripts  llm.ScriptPair
+	provider string
+	model    string
+	// examplesPassed is set once the main script passed the examples, and
+	// passed[j] once it passed candidate j's test script.
+	examplesPassed bool
+	passed         []bool
+	// cases counts the test cases passed across all test scripts that
+	// report them in TAP, which breaks ties between candidates.
+	cases int
+	// pending counts the runs of the main script that haven't finished.
+	pending int
+}
+
+// score is the number of test scripts the candidate's main script passed.
+func (c *candidate) score() int {
+	var n int
+	for _, ok := range c.passed {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// confirmed reports whether the candidate's main script passed the examples
+// and every test script, which no other candidate can beat.
+func (c *candidate) confirmed() bool {
+	return c.pending == 0 && c.examplesPassed && c.score() == len(c.passed)
+}
+
+// result pairs the candidate's main script with its own test script if it
+// passed that one, or else with the first test script it passed.
+func (c *candidate) result(candidates []*candidate) llm.ScriptPair {
+	if c.passed[c.index] {
+		return c.scripts
+	}
+	for j, ok := range c.passed {
+		if ok {
+			return llm.ScriptPair{MainScript: c.scripts.MainScript, TestScript: candidates[j].scripts.TestScript}
+		}
+	}
+	return c.scripts
+}
+
+// candidateProvider returns the provider that generates candidate i. The
+// candidate providers take turns, and without any the pipeline's own
+// provider generates every candidate.
+func (p *Pipeline) candidateProvider(i int) llm.Provider {
+	if len(p.candidateProviders) == 0 {
+		return p.llm
+	}
+	return p.candidateProviders[i%len(p.candidateProviders)]
+}
+
+// generateCandidates generates p.candidates script pairs concurrently.
+// Candidates that fail to generate are left out; it's only an error if all of
+// them fail.
+func (p *Pipeline) generateCandidates(ctx context.Context, description string) ([]*candidate, error) {
+	log.Info("Generating %d candidate scripts, %d at a time...", p.candidates, p.parallel)
+	generated := make([]*candidate, p.candidates)
+	errs := make([]error, p.candidates)
+	sem := make(chan struct{}, p.parallel)
+	var wg sync.WaitGroup
+	for i := range generated {
+		provider := p.candidateProvider(i)
+		wg.Go(func() {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			scripts, err := provider.GenerateScripts(ctx, description)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			name, model := provider.Name(), ""
+			if reporter, ok := provider.(llm.BackendReporter); ok {
+				name, model = reporter.LastBackend()
+			} else if provider == p.llm {
+				name, model = p.provider, p.model
+			}
+			generated[i] = &candidate{scripts: scripts, provider: name, model: model}
+		})
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var candidates []*candidate
+	for i, c := range generated {
+		if c == nil {
+			log.Warn("Failed to generate candidate %d: %v", i+1, errs[i])
+			continue
+		}
+		c.index = len(candidates)
+		candidates = append(candidates, c)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("failed to generate any candidate scripts: %w", errors.Join(errs...))
+	}
+	log.Debug("Generated %d candidate scripts", len(candidates))
+	return candidates, nil
+}
+
+// crossTest runs each candidate's main script against the examples and
+// against every candidate's test script, each run in its own directory, and
+// returns the main script that passed the most test scripts, and of those,
+// the most test cases. A script that fails the examples is out, and so is one
+// that passed no test script, so the result is nil if no candidate works.
+// Once a script passes everything, the remaining runs are cancelled.
+func (p *Pipeline) crossTest(ctx context.Context, candidates []*candidate, examples []Example) (*candidate, error) {
+	log.Info("Cross-testing %d candidates...", len(candidates))
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		winner   *candidate
+		setupErr error
+	)
+	// record stores the outcome of one run of c's main script; test is the
+	// index of the test script, or -1 for the examples.
+	record := func(c *candidate, test int, result *TAPResult, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if winner != nil || setupErr != nil {
+			return
+		}
+		var sbErr *sandbox.SetupError
+		if errors.As(err, &sbErr) {
+			setupErr = err
+			cancel()
+			return
+		}
+		c.pending--
+		if result != nil {
+			c.cases += result.Passed()
+		}
+		if test < 0 {
+			c.examplesPassed = err == nil
+		} else {
+			c.passed[test] = err == nil
+		}
+		if c.confirmed() {
+			winner = c
+			cancel()
+		}
+	}
+
+	for _, c := range candidates {
+		c.passed = make([]bool, len(candidates))
+		c.pending = len(candidates) + 1
+	}
+	sem := make(chan struct{}, p.parallel)
+	var wg sync.WaitGroup
+	run := func(c *candidate, test int, fn func() (*TAPResult, error)) {
+		wg.Go(func() {
+			select {
+			case sem <- struct{}{}:
+			case <-runCtx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			if runCtx.Err() != nil {
+				return
+			}
+			result, err := fn()
+			record(c, test, result, err)
+		})
+	}
+	for _, c := range candidates {
+		run(c, -1, func() (*TAPResult, error) {
+			return nil, p.runExamples(runCtx, c.scripts.MainScript, examples)
+		})
+		for j, other := range candidates {
+			run(c, j, func() (*TAPResult, error) {
+				return p.runTestScript(runCtx, llm.ScriptPair{MainScript: c.scripts.MainScript, TestScript: other.scripts.TestScript}, false)
+			})
+		}
+	}
+	wg.Wait()
+
+	if setupErr != nil {
+		return nil, setupErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if winner != nil {
+		log.Info("Candidate %d (%s) passed the examples and all %d test scripts", winner.index+1, winner.provider, len(candidates))
+		return winner, nil
+	}
+
+	for _, c := range candidates {
+		log.Debug("Candidate %d (%s): examples passed: %t, test scripts passed: %d/%d, test cases passed: %d", c.index+1, c.provider, c.examplesPassed, c.score(), len(candidates), c.cases)
+		if !c.examplesPassed || c.score() == 0 {
+			continue
+		}
+		if winner == nil || c.score() > winner.score() || c.score() == winner.score() && c.cases > winner.cases {
+			winner = c
+		}
+	}
+	if winner != nil {
+		log.Info("Candidate %d (%s) passed the most test scripts: %d/%d", winner.index+1, winner.provider, winner.score(), len(candidates))
+	}
+	return winner, nil
+}
+
+// bestCandidate generates and cross-tests candidates, or replays their
+// outcome from the journal of a resumed run. It returns the winning scripts,
+// or if no candidate passed, the first candidate's scripts to be fixed.
+func (p *Pipeline) bestCandidate(ctx context.Context, description string, examples []Example) (llm.ScriptPair, bool, error) {
+	if step, ok := p.journal.next(stepCandidates); ok {
+		p.replay(step)
+		return *step.Scripts, step.Won, nil
+	}
+	candidates, err := p.generateCandidates(ctx, description)
+	if err != nil {
+		return llm.ScriptPair{}, false, err
+	}
+	winner, err := p.crossTest(ctx, candidates, examples)
+	if err != nil {
+		return llm.ScriptPair{}, false, err
+	}
+	scripts, won := candidates[0].scripts, winner != nil
+	if won {
+		scripts = winner.result(candidates)
+	} else {
+		log.Info("No candidate passed, fixing the first one")
+		winner = candidates[0]
+	}
+	p.lastProvider, p.lastModel = winner.provider, winner.model
+	p.record(journalStep{Kind: stepCandidates, Scripts: &scripts, Won: won})
+	return scripts, won, nil
+}
@@ -0,0 +1,137 @@
+package script
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/statico/llmscript/internal/fsdiff"
+	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
+)
+
+// maxDryRunCommands caps the number of traced commands kept in a report.
+const maxDryRunCommands = 200
+
+// DryRunReport describes what a script did when run against a copy-on-write
+// view of a directory.
+type DryRunReport struct {
+	ExitCode int
+	// Commands lists the commands bash executed, in order, as printed by its
+	// xtrace option. It's empty for scripts not run by bash.
+	Commands []string
+	// Truncated is set when more than maxDryRunCommands were executed.
+	Truncated bool
+	Changes   fsdiff.Changes
+}
+
+func (r *DryRunReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Dry run finished with exit code %d. Nothing was changed on disk.\n", r.ExitCode)
+
+	sb.WriteString("\nCommands run:\n")
+	if len(r.Commands) == 0 {
+		sb.WriteString("  (none traced; only bash scripts can be traced)\n")
+	}
+	for _, c := range r.Commands {
+		fmt.Fprintf(&sb, "  %s\n", c)
+	}
+	if r.Truncated {
+		sb.WriteString("  ...\n")
+	}
+
+	sb.WriteString("\nFile changes it would make:\n")
+	sb.WriteString(indent(r.Changes.String()))
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// DryRun runs a script in sb, which must use sandbox.ModeNamespace, against a
+// copy-on-write view of dir, and reports the commands it ran, the file
+// changes it would have made and its exit code. The script's standard
+// streams are connected to the terminal as for a real run.
+func DryRun(sb *sandbox.Sandbox, mainScript string, args []string, dir string) (*DryRunReport, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	scratch, err := os.MkdirTemp("", "llmscript-dry-run-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(scratch); err != nil {
+			log.Error("failed to remove scratch directory: %v", err)
+		}
+	}()
+
+	scriptPath := filepath.Join(scratch, "script.sh")
+	if err := os.WriteFile(scriptPath, []byte(mainScript), 0755); err != nil {
+		return nil, fmt.Errorf("failed to write script: %w", err)
+	}
+	trace, err := os.CreateTemp("", "llmscript-trace-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %w", err)
+	}
+	defer func() {
+		_ = trace.Close()
+		_ = os.Remove(trace.Name())
+	}()
+
+	before, err := fsdiff.Take(dir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot %s: %w", dir, err)
+	}
+
+	cmd := exec.Command(scriptPath, args...)
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// SHELLOPTS turns on xtrace in every bash the script starts, and
+	// BASH_XTRACEFD sends the trace to the inherited trace file (fd 3)
+	// rather than mixing it into stderr.
+	cmd.ExtraFiles = []*os.File{trace}
+	cmd.Env = append(os.Environ(), "SHELLOPTS=xtrace", "BASH_XTRACEFD=3", "PS4=+ ")
+
+	report := &DryRunReport{}
+	if err := sb.RunOverlay(cmd, scratch); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, err
+		}
+		report.ExitCode = exitErr.ExitCode()
+	}
+
+	after, err := before.Overlay(filepath.Join(scratch, "upper"))
+	if err != nil {
+		return nil, err
+	}
+	report.Changes = before.Diff(after)
+
+	if _, err := trace.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("failed to read trace: %w", err)
+	}
+	scanner := bufio.NewScanner(trace)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Nested shells repeat the first character of PS4. Lines without
+		// it continue a multi-line command.
+		raw := scanner.Text()
+		line := strings.TrimLeft(raw, "+")
+		if line == raw || !strings.HasPrefix(line, " ") {
+			continue
+		}
+		if len(report.Commands) == maxDryRunCommands {
+			report.Truncated = true
+			break
+		}
+		report.Commands = append(report.Commands, strings.TrimPrefix(line, " "))
+	}
+	return report, nil
+}
@@ -0,0 +1,62 @@
+package script
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/statico/llmscript/internal/sandbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// The namespace sandbox re-executes the test binary as its init process.
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
+func TestDryRun(t *testing.T) {
+	sb, err := sandbox.New(sandbox.Config{Mode: sandbox.ModeNamespace}, sandbox.Limits{})
+	if err != nil {
+		t.Skipf("namespace sandbox unavailable: %v", err)
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("old\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cache"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cache", "old"), nil, 0644))
+
+	mainScript := `#!/bin/bash
+mkdir -p backups
+cp app.log backups/app.log
+rm app.log
+echo more >> notes.txt
+rm -rf cache && mkdir cache && touch cache/new
+exit 3`
+
+	report, err := DryRun(sb, mainScript, nil, dir)
+	var setupErr *sandbox.SetupError
+	if errors.As(err, &setupErr) {
+		t.Skipf("copy-on-write view unavailable: %v", err)
+	}
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, report.ExitCode)
+	assert.Equal(t, []string{"backups/", "backups/app.log", "cache/new"}, report.Changes.Created)
+	assert.Equal(t, []string{"notes.txt"}, report.Changes.Modified)
+	assert.Equal(t, []string{"app.log", "cache/old"}, report.Changes.Deleted)
+	assert.Contains(t, report.Commands, "cp app.log backups/app.log")
+	assert.Contains(t, report.String(), "exit code 3")
+
+	// The real directory is untouched.
+	_, err = os.Stat(filepath.Join(dir, "app.log"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "backups"))
+	assert.True(t, os.IsNotExist(err))
+	notes, err := os.ReadFile(filepath.Join(dir, "notes.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "keep\n", string(notes))
+}
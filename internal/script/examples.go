@@ -0,0 +1,250 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/statico/llmscript/internal/fsdiff"
+	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
+)
+
+// Example is a user-authored test case declared in the script's frontmatter.
+// The pipeline always runs every example against the generated script in
+// addition to the LLM-written test script.
+type Example struct {
+	Name  string   `yaml:"name"`
+	Args  []string `yaml:"args"`
+	Stdin string   `yaml:"stdin"`
+	// Files maps relative paths to the contents of fixture files created in
+	// the working directory before the script runs.
+	Files map[string]string `yaml:"files"`
+	// Stdout, when set, must match the script's standard output, ignoring
+	// trailing whitespace.
+	Stdout   *string `yaml:"stdout"`
+	ExitCode int     `yaml:"exit_code"`
+	// Creates, Modifies and Deletes are glob patterns (e.g. "backups/*") for
+	// paths relative to the working directory. Each pattern must match at
+	// least one file the script created, modified or deleted respectively.
+	Creates  []string `yaml:"creates"`
+	Modifies []string `yaml:"modifies"`
+	Deletes  []string `yaml:"deletes"`
+}
+
+// fileAssertion is one kind of file change an example can require.
+type fileAssertion struct {
+	verb     string   // "create", "modify" or "delete"
+	patterns []string // the example's patterns for this kind of change
+	paths    []string // the paths that changed this way
+}
+
+// fileAssertions pairs each kind of file change with the example's patterns
+// for it.
+func (e Example) fileAssertions(changes fsdiff.Changes) []fileAssertion {
+	return []fileAssertion{
+		{"create", e.Creates, changes.Created},
+		{"modify", e.Modifies, changes.Modified},
+		{"delete", e.Deletes, changes.Deleted},
+	}
+}
+
+// label returns the example's name, falling back to its position.
+func (e Example) label(i int) string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// validate rejects fixture paths that would escape the example's directory
+// and malformed file change patterns.
+func (e Example) validate() error {
+	for name := range e.Files {
+		clean := filepath.Clean(name)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("fixture file %q must be a relative path inside the working directory", name)
+		}
+	}
+	for _, a := range e.fileAssertions(fsdiff.Changes{}) {
+		for _, pattern := range a.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid %s pattern %q: %w", a.verb, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// formatExamples renders examples as a block appended to the description so
+// that both the generate and fix prompts see the exact expected behavior.
+func formatExamples(examples []Example) string {
+	if len(examples) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<examples>\n")
+	sb.WriteString("The script MUST behave exactly as follows for each of these examples, run as ./script.sh from a directory containing only the listed files:\n")
+	for i, e := range examples {
+		fmt.Fprintf(&sb, "\nExample %s:\n", e.label(i))
+		fmt.Fprintf(&sb, "  Arguments: %q\n", e.Args)
+		if e.Stdin != "" {
+			fmt.Fprintf(&sb, "  Standard input:\n%s\n", indent(e.Stdin))
+		}
+		names := make([]string, 0, len(e.Files))
+		for name := range e.Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&sb, "  File %s:\n%s\n", name, indent(e.Files[name]))
+		}
+		if e.Stdout != nil {
+			fmt.Fprintf(&sb, "  Expected standard output:\n%s\n", indent(*e.Stdout))
+		}
+		fmt.Fprintf(&sb, "  Expected exit code: %d\n", e.ExitCode)
+		for _, a := range e.fileAssertions(fsdiff.Changes{}) {
+			for _, pattern := range a.patterns {
+				fmt.Fprintf(&sb, "  Must %s: %s\n", a.verb, pattern)
+			}
+		}
+	}
+	sb.WriteString("</examples>")
+	return sb.String()
+}
+
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "    " + line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// runExamples runs every user-authored example against the main script and
+// returns an error describing all failures, if any.
+func (p *Pipeline) runExamples(ctx context.Context, mainScript string, examples []Example) error {
+	var failures []string
+	for i, e := range examples {
+		log.Debug("Running example %s", e.label(i))
+		if err := p.runExample(ctx, mainScript, e); err != nil {
+			var setupErr *sandbox.SetupError
+			if errors.As(err, &setupErr) {
+				return err
+			}
+			failures = append(failures, fmt.Sprintf("Example %s failed: %v", e.label(i), err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n\n"))
+	}
+	return nil
+}
+
+// runExample runs a single example in its own temporary directory.
+func (p *Pipeline) runExample(ctx context.Context, mainScript string, e Example) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+
+	exampleDir, err := os.MkdirTemp("", "llmscript-example-*")
+	if err != nil {
+		return fmt.Errorf("failed to create example directory: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(exampleDir); err != nil {
+			log.Error("failed to remove example directory: %v", err)
+		}
+	}()
+
+	for name, content := range e.Files {
+		path := filepath.Join(exampleDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create fixture directory: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write fixture file: %w", err)
+		}
+	}
+
+	scriptPath := filepath.Join(exampleDir, "script.sh")
+	if err := os.WriteFile(scriptPath, []byte(mainScript), 0750); err != nil {
+		return fmt.Errorf("failed to write feature script: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, scriptPath, e.Args...)
+	cmd.Dir = exampleDir
+	cmd.Stdin = strings.NewReader(e.Stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	before := p.snapshot(exampleDir)
+	runErr := p.sandbox.Run(cmd)
+	changes, haveChanges := p.changes(before, exampleDir)
+	if haveChanges {
+		log.Debug("Example file changes:\n%s", changes)
+	}
+
+	exitCode := 0
+	if err := runErr; err != nil {
+		var setupErr *sandbox.SetupError
+		if errors.As(err, &setupErr) {
+			return err
+		}
+		var hangErr *sandbox.HangError
+		if errors.As(err, &hangErr) {
+			return fmt.Errorf("script hung: it %w; it must finish within %s and must not leave background processes running\nStderr:\n%s", hangErr, p.timeout, stderr.String())
+		}
+		var limitErr *sandbox.LimitError
+		if errors.As(err, &limitErr) {
+			return fmt.Errorf("script %w; it was stopped by a resource limit and must use fewer resources\nStderr:\n%s", limitErr, stderr.String())
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok || ctx.Err() != nil {
+			return fmt.Errorf("script did not complete: %w\nStderr:\n%s", err, stderr.String())
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	var problems []string
+	if exitCode != e.ExitCode {
+		problems = append(problems, fmt.Sprintf("expected exit code %d, got %d", e.ExitCode, exitCode))
+	}
+	if e.Stdout != nil {
+		want := strings.TrimRight(*e.Stdout, " \t\r\n")
+		got := strings.TrimRight(stdout.String(), " \t\r\n")
+		if want != got {
+			problems = append(problems, fmt.Sprintf("expected stdout:\n%s\ngot stdout:\n%s", want, got))
+		}
+	}
+	for _, a := range e.fileAssertions(changes) {
+		for _, pattern := range a.patterns {
+			if !haveChanges {
+				return fmt.Errorf("failed to check which files the script changed")
+			}
+			if !fsdiff.Match(a.paths, pattern) {
+				problems = append(problems, fmt.Sprintf("expected the script to %s a file matching %s", a.verb, pattern))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		msg := fmt.Sprintf("%s\nStderr:\n%s", strings.Join(problems, "\n"), stderr.String())
+		if haveChanges {
+			msg += "\nFile changes:\n" + changes.String()
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
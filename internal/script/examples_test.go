@@ -0,0 +1,106 @@
+package script
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/statico/llmscript/internal/sandbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_RunExamples(t *testing.T) {
+	sb, err := sandbox.New(sandbox.Config{}, sandbox.Limits{})
+	require.NoError(t, err)
+	p := &Pipeline{timeout: 5 * time.Second, sandbox: sb}
+	mainScript := `#!/bin/bash
+if [ "$1" = "--fail" ]; then
+  echo "bad flag" >&2
+  exit 2
+fi
+tr a-z A-Z < input.txt
+cat`
+
+	greeting := "HELLO\nfrom stdin"
+	passing := []Example{
+		{
+			Name:   "uppercases",
+			Stdin:  "from stdin\n",
+			Files:  map[string]string{"input.txt": "hello\n"},
+			Stdout: &greeting,
+		},
+		{Name: "bad flag", Args: []string{"--fail"}, ExitCode: 2},
+	}
+	require.NoError(t, p.runExamples(context.Background(), mainScript, passing))
+
+	wrong := "nope"
+	failing := []Example{
+		{Files: map[string]string{"input.txt": "hello\n"}, Stdout: &wrong},
+		{Name: "bad flag", Args: []string{"--fail"}},
+	}
+	err = p.runExamples(context.Background(), mainScript, failing)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Example #1 failed")
+	assert.Contains(t, err.Error(), "Example bad flag failed: expected exit code 0, got 2")
+}
+
+func TestPipeline_RunExamplesFileChanges(t *testing.T) {
+	sb, err := sandbox.New(sandbox.Config{}, sandbox.Limits{})
+	require.NoError(t, err)
+	p := &Pipeline{timeout: 5 * time.Second, sandbox: sb}
+	mainScript := `#!/bin/sh
+mkdir -p backups
+cp data.txt backups/data.txt.bak
+rm -f stale.log`
+
+	files := map[string]string{"data.txt": "data\n", "stale.log": "old\n"}
+	passing := []Example{{
+		Files:   files,
+		Creates: []string{"backups/*.bak"},
+		Deletes: []string{"*.log"},
+	}}
+	require.NoError(t, p.runExamples(context.Background(), mainScript, passing))
+
+	failing := []Example{{
+		Name:     "edits",
+		Files:    files,
+		Modifies: []string{"data.txt"},
+	}}
+	err = p.runExamples(context.Background(), mainScript, failing)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected the script to modify a file matching data.txt")
+	assert.Contains(t, err.Error(), "File changes:\nCreated:\n  backups/\n  backups/data.txt.bak\nDeleted:\n  stale.log")
+}
+
+func TestPipeline_RunExamplesHang(t *testing.T) {
+	sb, err := sandbox.New(sandbox.Config{}, sandbox.Limits{})
+	require.NoError(t, err)
+	p := &Pipeline{timeout: 500 * time.Millisecond, sandbox: sb}
+
+	err = p.runExamples(context.Background(), "#!/bin/sh\nsleep 60 &\nwait\n", []Example{{Name: "waits"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Example waits failed: script hung")
+	assert.Contains(t, err.Error(), "sleep 60")
+}
+
+func TestParseSource_Examples(t *testing.T) {
+	src, err := ParseSource(`---
+examples:
+  - name: greets
+    args: [world]
+    stdout: Hello, world!
+---
+Greet the name given as the first argument`)
+	require.NoError(t, err)
+	require.Len(t, src.Frontmatter.Examples, 1)
+	assert.Equal(t, []string{"world"}, src.Frontmatter.Examples[0].Args)
+
+	prompt := src.Prompt()
+	assert.Contains(t, prompt, "Greet the name given as the first argument")
+	assert.Contains(t, prompt, "<examples>")
+	assert.Contains(t, prompt, "Hello, world!")
+
+	_, err = ParseSource("---\nexamples:\n  - files:\n      ../escape: x\n---\nPrint hello")
+	assert.Error(t, err)
+}
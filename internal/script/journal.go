@@ -0,0 +1,402 @@
+package script
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/statico/llmscript/internal/log"
+)
+
+// Statuses of a run.
+const (
+	RunRunning     = "running"
+	RunSucceeded   = "succeeded"
+	RunFailed      = "failed"
+	RunInterrupted = "interrupted"
+)
+
+// maxRuns is how many runs are kept; the oldest ones are removed when a new
+// run starts, succeeded runs first.
+const maxRuns = 50
+
+// Run describes a pipeline run and where it stands. It's stored as run.json
+// in the run's directory.
+type Run struct {
+	ID         string `json:"id"`
+	ScriptFile string `json:"script_file"`
+	// Source is the llmscript file as it was when the run started, so that
+	// resuming it generates the same script even if the file changed.
+	Source string   `json:"source"`
+	Args   []string `json:"args,omitempty"`
+	// Update is set for runs of "llmscript update", which write a lock file
+	// instead of running the script.
+	Update bool `json:"update,omitempty"`
+	// Settings is the config fingerprint the run started with.
+	Settings string    `json:"settings"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	// Steps counts the journaled steps, and Attempt and Fix are those of
+	// the latest one, counting from 1.
+	Steps   int `json:"steps"`
+	Attempt int `json:"attempt"`
+	Fix     int `json:"fix"`
+}
+
+// Kinds of journaled steps.
+const (
+	stepGenerate   = "generate"
+	stepCandidates = "candidates"
+	stepTest       = "test"
+	stepFix        = "fix"
+)
+
+// journalStep is one line of a run's journal: the outcome of an LLM request
+// or a test run.
+type journalStep struct {
+	Kind    string          `json:"kind"`
+	Attempt int             `json:"attempt"`
+	Fix     int             `json:"fix"`
+	Scripts *llm.ScriptPair `json:"scripts,omitempty"`
+	// ExamplesFailure and TestFailure describe how a test step failed, and
+	// Passed and Total count its test cases if they were reported in TAP.
+	ExamplesFailure string `json:"examples_failure,omitempty"`
+	TestFailure     string `json:"test_failure,omitempty"`
+	Passed          int    `json:"passed,omitempty"`
+	Total           int    `json:"total,omitempty"`
+	// Provider and Model identify the backend that produced Scripts, and
+	// Won is set if a candidates step found working scripts.
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	Won      bool   `json:"won,omitempty"`
+	// Usage is the tokens the step's LLM requests used.
+	Usage []llm.ModelUsage `json:"usage,omitempty"`
+	Time  time.Time        `json:"time"`
+}
+
+// Journal records each step of a run in its directory, so that an
+// interrupted run can be resumed without repeating the LLM requests and test
+// runs it already made. A resumed journal replays the recorded steps to the
+// pipeline before it records new ones.
+type Journal struct {
+	dir  string
+	run  Run
+	file *os.File
+	// replay holds the recorded steps of a resumed run, and replayed counts
+	// those handed back to the pipeline so far.
+	replay   []journalStep
+	replayed int
+}
+
+// RunsDir returns the directory runs are journaled in,
+// $XDG_STATE_HOME/llmscript/runs (~/.local/state/llmscript/runs by default).
+func RunsDir() (string, error) {
+	stateDir, err := xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDir, "llmscript", "runs"), nil
+}
+
+// NewJournal starts journaling a new run, removing old runs to keep at most
+// maxRuns.
+func NewJournal(run Run) (*Journal, error) {
+	runsDir, err := RunsDir()
+	if err != nil {
+		return nil, err
+	}
+	pruneRuns(runsDir)
+
+	suffix := make([]byte, 2)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to create run ID: %w", err)
+	}
+	now := time.Now()
+	run.ID = now.Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+	run.Status = RunRunning
+	run.Started, run.Updated = now, now
+
+	dir := filepath.Join(runsDir, run.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create run directory: %w", err)
+	}
+	j := &Journal{dir: dir, run: run}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, j.save()
+}
+
+// OpenJournal resumes journaling the run whose ID starts with prefix. Its
+// recorded steps are replayed before new ones are recorded.
+func OpenJournal(prefix string) (*Journal, error) {
+	run, err := FindRun(prefix)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{dir: run.dir, run: run.Run}
+	path := filepath.Join(j.dir, "journal.jsonl")
+	if j.replay, err = readSteps(path); err != nil {
+		return nil, err
+	}
+	// Rewrite the journal in case its last line was cut short, so that new
+	// steps aren't appended to it.
+	if err := writeSteps(path, j.replay); err != nil {
+		return nil, err
+	}
+	j.run.Steps = len(j.replay)
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	j.run.Status, j.run.Error = RunRunning, ""
+	return j, j.save()
+}
+
+// Run returns the journaled run.
+func (j *Journal) Run() Run {
+	return j.run
+}
+
+// Finish records how the run ended: interrupted if err is a cancellation,
+// failed for any other error, and succeeded otherwise.
+func (j *Journal) Finish(err error) error {
+	switch {
+	case err == nil:
+		j.run.Status = RunSucceeded
+	case errors.Is(err, context.Canceled):
+		j.run.Status = RunInterrupted
+	default:
+		j.run.Status, j.run.Error = RunFailed, err.Error()
+	}
+	if closeErr := j.file.Close(); closeErr != nil {
+		return fmt.Errorf("failed to close run journal: %w", closeErr)
+	}
+	return j.save()
+}
+
+// next returns the next recorded step if it is of the given kind. A step of
+// another kind means the run took a different path this time, for instance
+// because the config changed, so the remaining steps are dropped from the
+// journal and nothing more is replayed. It's safe to call on a nil journal.
+func (j *Journal) next(kind string) (journalStep, bool) {
+	if j == nil || j.replayed >= len(j.replay) {
+		return journalStep{}, false
+	}
+	step := j.replay[j.replayed]
+	if step.Kind == kind {
+		j.replayed++
+		if j.replayed == len(j.replay) {
+			log.Info("Resumed run %s after %d recorded steps", j.run.ID, j.replayed)
+		}
+		return step, true
+	}
+	log.Warn("Run %s took a different path than recorded, dropping its last %d steps", j.run.ID, len(j.replay)-j.replayed)
+	if err := j.truncate(); err != nil {
+		log.Warn("Failed to rewrite run journal: %v", err)
+	}
+	return journalStep{}, false
+}
+
+// record appends a step to the journal. It's safe to call on a nil journal.
+func (j *Journal) record(step journalStep) error {
+	if j == nil {
+		return nil
+	}
+	step.Time = time.Now()
+	data, err := json.Marshal(step)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal step: %w", err)
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write run journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write run journal: %w", err)
+	}
+	j.run.Steps++
+	j.run.Attempt, j.run.Fix = step.Attempt+1, step.Fix+1
+	return j.save()
+}
+
+// open opens the journal file for appending.
+func (j *Journal) open() error {
+	file, err := os.OpenFile(filepath.Join(j.dir, "journal.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open run journal: %w", err)
+	}
+	j.file = file
+	return nil
+}
+
+// truncate rewrites the journal with only the steps replayed so far and
+// stops replaying.
+func (j *Journal) truncate() error {
+	kept := j.replay[:j.replayed]
+	j.replay = nil
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := writeSteps(filepath.Join(j.dir, "journal.jsonl"), kept); err != nil {
+		return err
+	}
+	j.run.Steps = len(kept)
+	return j.open()
+}
+
+// writeSteps replaces the journal file at path with steps.
+func writeSteps(path string, steps []journalStep) error {
+	var data []byte
+	for _, step := range steps {
+		line, err := json.Marshal(step)
+		if err != nil {
+			return fmt.Errorf("failed to encode journal step: %w", err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write run journal: %w", err)
+	}
+	return nil
+}
+
+// save writes run.json.
+func (j *Journal) save() error {
+	j.run.Updated = time.Now()
+	data, err := json.MarshalIndent(j.run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(j.dir, "run.json"), data); err != nil {
+		return fmt.Errorf("failed to write run: %w", err)
+	}
+	return nil
+}
+
+// readSteps reads the steps of a journal file. A last line cut short by a
+// crash is ignored.
+func readSteps(path string) ([]journalStep, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run journal: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var steps []journalStep
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var step journalStep
+		if err := json.Unmarshal(scanner.Bytes(), &step); err != nil {
+			break
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read run journal: %w", err)
+	}
+	return steps, nil
+}
+
+// StoredRun is a run as found on disk.
+type StoredRun struct {
+	Run
+	dir string
+}
+
+// ListRuns returns the journaled runs, most recently updated first. Runs
+// that can't be read are skipped.
+func ListRuns() ([]StoredRun, error) {
+	runsDir, err := RunsDir()
+	if err != nil {
+		return nil, err
+	}
+	return listRuns(runsDir)
+}
+
+func listRuns(runsDir string) ([]StoredRun, error) {
+	files, err := filepath.Glob(filepath.Join(runsDir, "*", "run.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	var runs []StoredRun
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var run Run
+		if err := json.Unmarshal(data, &run); err != nil {
+			continue
+		}
+		runs = append(runs, StoredRun{Run: run, dir: filepath.Dir(file)})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Updated.After(runs[j].Updated)
+	})
+	return runs, nil
+}
+
+// FindRun returns the run whose ID starts with prefix, which must be
+// unambiguous.
+func FindRun(prefix string) (*StoredRun, error) {
+	runs, err := ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	var found *StoredRun
+	for i := range runs {
+		if strings.HasPrefix(runs[i].ID, prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("run ID %s is ambiguous", prefix)
+			}
+			found = &runs[i]
+		}
+	}
+	if found == nil || prefix == "" {
+		return nil, fmt.Errorf("no run with ID %s", prefix)
+	}
+	return found, nil
+}
+
+// pruneRuns removes runs to keep at most maxRuns-1, making room for a new
+// one. Succeeded runs go first, least recently updated first, since they
+// can't be resumed; then the oldest of those that could. Failures are logged
+// since old runs only take up space.
+func pruneRuns(runsDir string) {
+	runs, err := listRuns(runsDir)
+	if err != nil {
+		log.Warn("Failed to prune old runs: %v", err)
+		return
+	}
+	excess := len(runs) - (maxRuns - 1)
+	if excess <= 0 {
+		return
+	}
+	slices.Reverse(runs)
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].Status == RunSucceeded && runs[j].Status != RunSucceeded
+	})
+	for _, run := range runs[:excess] {
+		if err := os.RemoveAll(run.dir); err != nil {
+			log.Warn("Failed to remove old run %s: %v", run.ID, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package script
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_Resume(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	failing := func(version string) llm.ScriptPair {
+		return llm.ScriptPair{MainScript: "#!/bin/bash\necho " + version + "\nexit 1", TestScript: "#!/bin/bash\n./script.sh"}
+	}
+	working := llm.ScriptPair{MainScript: "#!/bin/bash\necho v4", TestScript: "#!/bin/bash\n./script.sh"}
+	cfg := Config{MaxFixes: 5, MaxAttempts: 1, Timeout: 5 * time.Second, NoCache: true}
+
+	// The first run is interrupted while asking for its second fix.
+	journal, err := NewJournal(Run{ScriptFile: "greet", Source: "Greet"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := &mockLLMProvider{
+		generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+			return failing("v1"), nil
+		},
+		fixScriptsFunc: func(ctx context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+			if len(conv.Turns) == 2 {
+				cancel()
+				return llm.ScriptPair{}, ctx.Err()
+			}
+			return failing(fmt.Sprintf("v%d", len(conv.Turns)+1)), nil
+		},
+	}
+	cfg.WorkDir, cfg.Journal = t.TempDir(), journal
+	pipeline, err := NewPipeline(interrupted, cfg)
+	require.NoError(t, err)
+	_, err = pipeline.GenerateAndTest(ctx, &Source{Description: "Greet"})
+	require.Error(t, err)
+	require.NoError(t, journal.Finish(err))
+
+	runs, err := ListRuns()
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, RunInterrupted, runs[0].Status)
+	// Generated, tested, fixed and tested again.
+	assert.Equal(t, 4, runs[0].Steps)
+	assert.Equal(t, 2, runs[0].Fix)
+
+	// Resuming neither regenerates nor re-tests the recorded versions, and
+	// the fixer still sees all of them.
+	journal, err = OpenJournal(runs[0].ID[:8])
+	require.NoError(t, err)
+	var history []string
+	resumed := &mockLLMProvider{
+		generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+			t.Error("resumed run generated new scripts")
+			return failing("v1"), nil
+		},
+		fixScriptsFunc: func(_ context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+			for _, turn := range conv.Turns {
+				history = append(history, turn.MainScript)
+			}
+			return working, nil
+		},
+	}
+	cfg.WorkDir, cfg.Journal = t.TempDir(), journal
+	pipeline, err = NewPipeline(resumed, cfg)
+	require.NoError(t, err)
+	scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+	require.NoError(t, err)
+	require.NoError(t, journal.Finish(nil))
+	assert.Equal(t, working, scripts)
+	assert.Equal(t, []string{failing("v1").MainScript, failing("v2").MainScript}, history)
+
+	run, err := FindRun(journal.Run().ID)
+	require.NoError(t, err)
+	assert.Equal(t, RunSucceeded, run.Status)
+	assert.Equal(t, 6, run.Steps)
+}
+
+func TestOpenJournal_TruncatedLine(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	journal, err := NewJournal(Run{Source: "Greet"})
+	require.NoError(t, err)
+	scripts := llm.ScriptPair{MainScript: "main", TestScript: "test"}
+	require.NoError(t, journal.record(journalStep{Kind: stepGenerate, Scripts: &scripts}))
+	require.NoError(t, journal.Finish(context.Canceled))
+
+	// A crash while writing leaves half a line behind.
+	path := filepath.Join(journal.dir, "journal.jsonl")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"kind":"te`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	journal, err = OpenJournal(journal.Run().ID)
+	require.NoError(t, err)
+	step, ok := journal.next(stepGenerate)
+	require.True(t, ok)
+	assert.Equal(t, scripts, *step.Scripts)
+	require.NoError(t, journal.record(journalStep{Kind: stepTest}))
+	require.NoError(t, journal.Finish(nil))
+
+	steps, err := readSteps(path)
+	require.NoError(t, err)
+	assert.Len(t, steps, 2)
+}
+
+func TestPipeline_JournalOnCacheMiss(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	var generated int
+	provider := &mockLLMProvider{
+		generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+			generated++
+			return llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\n./script.sh"}, nil
+		},
+	}
+
+	// The first run generates the script and is journaled, the second finds
+	// it in the cache and isn't.
+	for i := range 2 {
+		pipeline, err := NewPipeline(provider, Config{MaxFixes: 1, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), Run: &Run{Source: "Greet"}})
+		require.NoError(t, err)
+		_, err = pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+		require.NoError(t, err)
+		if i == 0 {
+			require.NotNil(t, pipeline.Journal())
+			require.NoError(t, pipeline.Journal().Finish(nil))
+		} else {
+			assert.Nil(t, pipeline.Journal())
+		}
+	}
+	assert.Equal(t, 1, generated)
+	runs, err := ListRuns()
+	require.NoError(t, err)
+	assert.Len(t, runs, 1)
+}
+
+func TestPruneRuns(t *testing.T) {
+	runsDir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	for i := range maxRuns {
+		status := RunSucceeded
+		if i < 2 {
+			status = RunInterrupted
+		}
+		run := Run{ID: fmt.Sprintf("run-%02d", i), Status: status, Updated: start.Add(time.Duration(i) * time.Minute)}
+		dir := filepath.Join(runsDir, run.ID)
+		require.NoError(t, os.Mkdir(dir, 0700))
+		data, err := json.Marshal(run)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "run.json"), data, 0600))
+	}
+
+	pruneRuns(runsDir)
+	runs, err := listRuns(runsDir)
+	require.NoError(t, err)
+	require.Len(t, runs, maxRuns-1)
+	// The oldest runs were interrupted, so the oldest succeeded one goes.
+	var ids []string
+	for _, run := range runs {
+		ids = append(ids, run.ID)
+	}
+	assert.Contains(t, ids, "run-00")
+	assert.Contains(t, ids, "run-01")
+	assert.NotContains(t, ids, "run-02")
+}
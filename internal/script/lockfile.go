@@ -0,0 +1,134 @@
+package script
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/statico/llmscript/internal/llm"
+	"gopkg.in/yaml.v3"
+)
+
+// lockfileVersion is the format version written to new lock files.
+const lockfileVersion = 1
+
+// Lockfile pins a generated script next to its llmscript file so that it can
+// be committed and reviewed, and is used instead of generating a new script.
+type Lockfile struct {
+	Version int `yaml:"version"`
+	// DescriptionHash identifies the description, declared interface and
+	// examples the script was generated from, so that editing the llmscript
+	// file is detected.
+	DescriptionHash string    `yaml:"description_hash"`
+	Provider        string    `yaml:"provider"`
+	Model           string    `yaml:"model"`
+	Generated       time.Time `yaml:"generated"`
+	Script          string    `yaml:"script"`
+	TestScript      string    `yaml:"test_script"`
+	// Signer is the public key that signed the lock file, and Signature its
+	// signature over the pinned scripts and where they came from.
+	Signer    string `yaml:"signer"`
+	Signature string `yaml:"signature"`
+}
+
+// signedLockfile is the part of a lock file covered by its signature.
+type signedLockfile struct {
+	DescriptionHash string `json:"description_hash"`
+	Provider        string `json:"provider"`
+	Model           string `json:"model"`
+	Script          string `json:"script"`
+	TestScript      string `json:"test_script"`
+}
+
+func (l *Lockfile) signed() signedLockfile {
+	return signedLockfile{
+		DescriptionHash: l.DescriptionHash,
+		Provider:        l.Provider,
+		Model:           l.Model,
+		Script:          l.Script,
+		TestScript:      l.TestScript,
+	}
+}
+
+// LockfilePath returns the path of the lock file for an llmscript file.
+func LockfilePath(scriptFile string) string {
+	return scriptFile + ".lock"
+}
+
+// NewLockfile pins scripts generated from src by the given provider and model.
+func NewLockfile(src *Source, scripts llm.ScriptPair, provider, model string) *Lockfile {
+	return &Lockfile{
+		Version:         lockfileVersion,
+		DescriptionHash: descriptionHash(src),
+		Provider:        provider,
+		Model:           model,
+		Generated:       time.Now().UTC().Truncate(time.Second),
+		Script:          scripts.MainScript,
+		TestScript:      scripts.TestScript,
+	}
+}
+
+// ReadLockfile reads a lock file. It returns nil if the file doesn't exist.
+func ReadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+
+	var lock Lockfile
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock file %s: %w", path, err)
+	}
+	if lock.Version != lockfileVersion {
+		return nil, fmt.Errorf("unsupported lock file version %d in %s", lock.Version, path)
+	}
+	if lock.Script == "" {
+		return nil, fmt.Errorf("lock file %s has no script", path)
+	}
+	return &lock, nil
+}
+
+// Write saves the lock file atomically.
+func (l *Lockfile) Write(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock file: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return nil
+}
+
+// Sign signs the lock file with the local key.
+func (l *Lockfile) Sign(keys *Keyring) error {
+	var err error
+	l.Signer, l.Signature, err = keys.sign("lock file", l.signed())
+	return err
+}
+
+// Verify checks that the lock file is signed by a trusted key.
+func (l *Lockfile) Verify(keys *Keyring) error {
+	return keys.verify("lock file", l.signed(), l.Signer, l.Signature)
+}
+
+// Matches reports whether the lock file was generated from src as it is now.
+func (l *Lockfile) Matches(src *Source) bool {
+	return l.DescriptionHash == descriptionHash(src)
+}
+
+// Scripts returns the pinned scripts.
+func (l *Lockfile) Scripts() llm.ScriptPair {
+	return llm.ScriptPair{MainScript: l.Script, TestScript: l.TestScript}
+}
+
+func descriptionHash(src *Source) string {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(src.Prompt())))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,51 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockfile(t *testing.T) {
+	dir := t.TempDir()
+	path := LockfilePath(filepath.Join(dir, "hello"))
+	assert.Equal(t, filepath.Join(dir, "hello.lock"), path)
+
+	lock, err := ReadLockfile(path)
+	require.NoError(t, err)
+	assert.Nil(t, lock, "a missing lock file is not an error")
+
+	src, err := ParseSource("Print hello world")
+	require.NoError(t, err)
+	scripts := llm.ScriptPair{
+		MainScript: "#!/bin/bash\necho 'hello world'\n",
+		TestScript: "#!/bin/bash\n[ \"$(./script.sh)\" = 'hello world' ]\n",
+	}
+	require.NoError(t, NewLockfile(src, scripts, "claude", "claude-haiku-4-5").Write(path))
+
+	// Scripts are stored as literal blocks so that lock files diff cleanly
+	// in review.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "script: |\n    #!/bin/bash\n    echo 'hello world'\n")
+
+	lock, err = ReadLockfile(path)
+	require.NoError(t, err)
+	require.NotNil(t, lock)
+	assert.Equal(t, scripts, lock.Scripts())
+	assert.Equal(t, "claude", lock.Provider)
+	assert.Equal(t, "claude-haiku-4-5", lock.Model)
+	assert.True(t, lock.Matches(src))
+
+	edited, err := ParseSource("Print hello there")
+	require.NoError(t, err)
+	assert.False(t, lock.Matches(edited))
+
+	require.NoError(t, os.WriteFile(path, []byte("version: 99\nscript: echo\n"), 0644))
+	_, err = ReadLockfile(path)
+	assert.ErrorContains(t, err, "unsupported lock file version")
+}
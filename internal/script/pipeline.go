@@ -1,125 +1,678 @@
 package script
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/statico/llmscript/internal/fsdiff"
 	"github.com/statico/llmscript/internal/llm"
 	"github.com/statico/llmscript/internal/log"
+	"github.com/statico/llmscript/internal/sandbox"
+)
+
+// Config is the fully-resolved pipeline configuration passed to NewPipeline.
+type Config struct {
+	MaxFixes    int
+	MaxAttempts int
+	Timeout     time.Duration
+	WorkDir     string
+	NoCache     bool
+	// Provider and Model are recorded with cached scripts, unless the LLM
+	// provider reports the backend that actually produced them.
+	Provider string
+	Model    string
+	// CacheSettings describes the settings (provider, model, ...) scripts
+	// are generated under and is part of the cache key.
+	CacheSettings string
+	// Sandbox isolates the generated scripts while they are tested.
+	Sandbox sandbox.Config
+	// Limits bounds the resources each test run may use.
+	Limits sandbox.Limits
+	// Watch lists extra paths, besides the test directory, whose changes are
+	// reported after each test run.
+	Watch []string
+	// PlatformMismatch is PlatformVerify or PlatformRegenerate and decides
+	// whether a script cached on another platform is re-tested or ignored.
+	// Empty means PlatformVerify.
+	PlatformMismatch string
+	// RemoteCache, if set, is a shared backend the cache reads through to.
+	RemoteCache Backend
+	// Pricing maps model names to their price, for estimating what a run
+	// costs.
+	Pricing map[string]llm.Price
+	// MaxCost and MaxTokens, if positive, stop a run that has cost or used
+	// more than that.
+	MaxCost   float64
+	MaxTokens int
+	// Candidates, if more than one, is how many script pairs are generated
+	// concurrently and cross-tested against each other, instead of trying
+	// one attempt at a time. Parallel bounds how many are generated or
+	// tested at once; zero means DefaultParallel.
+	Candidates int
+	Parallel   int
+	// CandidateProviders, if set, take turns generating the candidates, so
+	// they can come from different providers or models.
+	CandidateProviders []llm.Provider
+	// Run, if set, describes the run so that it's journaled once it has to
+	// call the LLM, and can then be resumed. Runs that find a cached script
+	// aren't journaled.
+	Run *Run
+	// Journal, if set, is the journal of a resumed run, whose recorded steps
+	// are replayed before new ones are recorded.
+	Journal *Journal
+}
+
+// platformFingerprint identifies the platform scripts are cached for.
+var platformFingerprint = llm.PlatformFingerprint
+
+// ErrBudgetExceeded is returned when a run stops because it went over its
+// max_cost or max_tokens budget.
+var ErrBudgetExceeded = errors.New("LLM budget exceeded")
+
+// Policies for scripts cached on a different platform.
+const (
+	PlatformVerify     = "verify"
+	PlatformRegenerate = "regenerate"
 )
 
 // Pipeline handles the script generation and testing process
 type Pipeline struct {
-	llm         llm.Provider
-	maxFixes    int
-	maxAttempts int
-	timeout     time.Duration
-	workDir     string
-	cache       *Cache
-	noCache     bool
+	llm           llm.Provider
+	maxFixes      int
+	maxAttempts   int
+	timeout       time.Duration
+	workDir       string
+	cache         *Cache
+	cacheSettings string
+	noCache       bool
+	sandbox       *sandbox.Sandbox
+	watch         []string
+	platform      string
+	regenerate    bool
+	provider      string
+	model         string
+	pricing       map[string]llm.Price
+	maxCost       float64
+	maxTokens     int
+	candidates    int
+	parallel      int
+	// candidateProviders generate candidates instead of llm, if set.
+	candidateProviders []llm.Provider
+	run                *Run
+	journal            *Journal
+	// lastProvider and lastModel identify the backend that produced the
+	// latest scripts.
+	lastProvider string
+	lastModel    string
+	// usage is the tokens used by this run so far, per model.
+	usage []llm.ModelUsage
+	// warnedUnpriced is set once a missing price has been warned about.
+	warnedUnpriced bool
 }
 
 // NewPipeline creates a new script generation pipeline
-func NewPipeline(llm llm.Provider, maxFixes, maxAttempts int, timeout time.Duration, workDir string, noCache bool) (*Pipeline, error) {
-	if err := os.MkdirAll(workDir, 0755); err != nil {
+func NewPipeline(llm llm.Provider, cfg Config) (*Pipeline, error) {
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create work directory: %w", err)
 	}
 
+	switch cfg.PlatformMismatch {
+	case "", PlatformVerify, PlatformRegenerate:
+	default:
+		return nil, fmt.Errorf("unsupported cache platform_mismatch policy: %s", cfg.PlatformMismatch)
+	}
+
+	sb, err := sandbox.New(cfg.Sandbox, cfg.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox: %w", err)
+	}
+
 	var cache *Cache
-	if !noCache {
+	if !cfg.NoCache {
 		var err error
 		cache, err = NewCache()
 		if err != nil {
 			return nil, fmt.Errorf("failed to create cache: %w", err)
 		}
+		if cfg.RemoteCache != nil {
+			cache.SetRemote(cfg.RemoteCache)
+		}
+	}
+
+	parallel := cfg.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
 	}
 
 	return &Pipeline{
-		llm:         llm,
-		maxFixes:    maxFixes,
-		maxAttempts: maxAttempts,
-		timeout:     timeout,
-		workDir:     workDir,
-		cache:       cache,
-		noCache:     noCache,
+		llm:           llm,
+		maxFixes:      cfg.MaxFixes,
+		maxAttempts:   cfg.MaxAttempts,
+		timeout:       cfg.Timeout,
+		workDir:       cfg.WorkDir,
+		cache:         cache,
+		cacheSettings: cfg.CacheSettings,
+		noCache:       cfg.NoCache,
+		sandbox:       sb,
+		watch:         cfg.Watch,
+		platform:      platformFingerprint(),
+		regenerate:    cfg.PlatformMismatch == PlatformRegenerate,
+		provider:      cfg.Provider,
+		model:         cfg.Model,
+		pricing:       cfg.Pricing,
+		maxCost:       cfg.MaxCost,
+		maxTokens:     cfg.MaxTokens,
+		candidates:    cfg.Candidates,
+		parallel:      parallel,
+
+		candidateProviders: cfg.CandidateProviders,
+		run:                cfg.Run,
+		journal:            cfg.Journal,
 	}, nil
 }
 
-// GenerateAndTest generates a script from a natural language description and tests it
-func (p *Pipeline) GenerateAndTest(ctx context.Context, description string) (string, error) {
+// GenerateAndTest generates a script from a parsed llmscript file and tests it
+// against both the generated test script and the user-authored examples. It
+// returns the passing script together with the test script it passed.
+func (p *Pipeline) GenerateAndTest(ctx context.Context, src *Source) (llm.ScriptPair, error) {
+	description := src.Prompt()
+	examples := src.examples()
+
 	// Check cache first if enabled
 	if !p.noCache && p.cache != nil {
+		// Hold the entry's lock until the script is cached, so a concurrent
+		// run for the same description waits and reuses it.
+		unlock, err := p.cache.Lock(ctx, description, p.cacheSettings)
+		if err != nil {
+			return llm.ScriptPair{}, err
+		}
+		defer unlock()
+
 		log.Info("Checking cache...")
-		if scripts, err := p.cache.Get(description); err == nil && scripts.MainScript != "" {
-			// Run test script to verify
-			if err := p.runTestScript(ctx, scripts); err == nil {
+		entry, err := p.cache.Get(description, p.cacheSettings)
+		switch {
+		case err != nil:
+			log.Warn("Failed to read cache: %v", err)
+		case entry == nil:
+		case entry.Platform != p.platform && p.regenerate:
+			log.Info("Cached script was generated on %s, regenerating for %s", entry.Platform, p.platform)
+		default:
+			if entry.Platform != p.platform {
+				log.Info("Cached script was generated on %s, re-verifying on %s", entry.Platform, p.platform)
+			}
+			// Run the examples and test script to verify
+			if err := p.verify(ctx, entry.Scripts, examples); err == nil {
 				log.Success("Cached script found")
-				return scripts.MainScript, nil
+				p.lastProvider, p.lastModel = entry.Provider, entry.Model
+				if err := p.cache.Touch(description, p.cacheSettings); err != nil {
+					log.Warn("Failed to update cache entry: %v", err)
+				}
+				return entry.Scripts, nil
 			}
 			log.Warn("Cached scripts failed verification, generating new scripts")
 		}
 	}
 
-	// Generate initial scripts
-	log.Info("Generating initial scripts with %s...", p.llm.Name())
-	scripts, err := p.llm.GenerateScripts(ctx, description)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate initial scripts: %w", err)
+	defer p.reportUsage()
+	p.startJournal()
+	var scripts llm.ScriptPair
+	if p.candidates > 1 {
+		// Generate several candidates at once and keep the one that passes
+		// the most of their test scripts
+		var won bool
+		var err error
+		scripts, won, err = p.bestCandidate(ctx, description, examples)
+		if err != nil {
+			return llm.ScriptPair{}, err
+		}
+		if won {
+			p.succeed(description, scripts)
+			return scripts, nil
+		}
+	} else {
+		// Generate initial scripts
+		log.Info("Generating initial scripts with %s...", p.llm.Name())
+		var err error
+		scripts, err = p.generate(ctx, description, 0)
+		if err != nil {
+			return llm.ScriptPair{}, fmt.Errorf("failed to generate initial scripts: %w", err)
+		}
+		log.Debug("Initial scripts generated")
 	}
-	log.Debug("Initial scripts generated")
 
 	// Run test script and fix failures
 	for attempt := 0; attempt < p.maxAttempts; attempt++ {
 		if attempt > 0 {
+			if err := p.checkBudget(); err != nil {
+				return llm.ScriptPair{}, err
+			}
 			log.Info("Attempt %d/%d: Generating new scripts...", attempt+1, p.maxAttempts)
-			scripts, err = p.llm.GenerateScripts(ctx, description)
+			var err error
+			scripts, err = p.generate(ctx, description, attempt)
 			if err != nil {
-				return "", fmt.Errorf("failed to generate new scripts: %w", err)
+				return llm.ScriptPair{}, fmt.Errorf("failed to generate new scripts: %w", err)
 			}
 			log.Debug("New scripts generated")
 		}
 
-		// Try to fix any failures
+		// Try to fix any failures, keeping the history of this attempt so
+		// the fixer doesn't go back to a version that already failed
+		conv := llm.Conversation{Description: description}
+		// best is the version of this attempt that did best so far, which
+		// is fixed instead of a version that does worse
+		var best llm.ScriptPair
+		var bestFailure *testFailure
 		for fix := 0; fix < p.maxFixes; fix++ {
-			// Run test script
+			// Run examples and test script
 			log.Info("Testing script (attempt %d/%d)...", attempt+1, p.maxAttempts)
-			err := p.runTestScript(ctx, scripts)
+			err := p.test(ctx, scripts, examples, attempt, fix)
 			if err == nil {
-				// Cache successful scripts if caching is enabled
-				if !p.noCache && p.cache != nil {
-					log.Info("Caching successful scripts...")
-					if err := p.cache.Set(description, scripts); err != nil {
-						log.Warn("Failed to cache successful scripts: %v", err)
-					}
-				}
-				return scripts.MainScript, nil
+				p.succeed(description, scripts)
+				return scripts, nil
+			}
+			var setupErr *sandbox.SetupError
+			if errors.As(err, &setupErr) || ctx.Err() != nil {
+				return llm.ScriptPair{}, err
 			}
 
 			if fix < p.maxFixes-1 { // Don't try to fix on the last iteration
+				if err := p.checkBudget(); err != nil {
+					return llm.ScriptPair{}, err
+				}
 				log.Info("Fix attempt %d/%d...", fix+1, p.maxFixes)
-				scripts, err = p.llm.FixScripts(ctx, scripts, err.Error())
+				var failure *testFailure
+				if errors.As(err, &failure) {
+					if bestFailure != nil && scripts.TestScript == best.TestScript && failure.worseThan(bestFailure) {
+						// The fixer still sees how this version failed, and
+						// is told why the earlier version comes up again
+						log.Info("The fix made things worse, going back to an earlier version that passed more tests")
+						conv.Turns = append(conv.Turns, newTurn(scripts, failure))
+						scripts, err = best, fmt.Errorf("%s\n\n%w", revertedNote, bestFailure)
+					} else {
+						best, bestFailure = scripts, failure
+					}
+				}
+				conv.Turns = append(conv.Turns, newTurn(scripts, err))
+				scripts, err = p.fix(ctx, conv, attempt, fix)
 				if err != nil {
-					return "", fmt.Errorf("failed to fix scripts: %w", err)
+					return llm.ScriptPair{}, err
 				}
 				log.Debug("Scripts fixed")
-				log.Debug("New script:\n%s", scripts.MainScript)
 			}
 		}
 	}
 
-	return "", fmt.Errorf("failed to generate working scripts after %d attempts", p.maxAttempts)
+	return llm.ScriptPair{}, fmt.Errorf("failed to generate working scripts after %d attempts", p.maxAttempts)
+}
+
+// startJournal starts journaling the run, unless it's a resumed one that
+// already has a journal. Journaling is best effort: a run that can't be
+// journaled still goes on.
+func (p *Pipeline) startJournal() {
+	if p.journal != nil || p.run == nil {
+		return
+	}
+	journal, err := NewJournal(*p.run)
+	if err != nil {
+		log.Warn("Failed to journal this run, it won't be resumable: %v", err)
+		return
+	}
+	p.journal = journal
+}
+
+// Journal returns the journal of the run, which is nil if it wasn't
+// journaled, for instance because it found a cached script.
+func (p *Pipeline) Journal() *Journal {
+	return p.journal
+}
+
+// revertedNote introduces the failure of an earlier version that is fixed
+// again because the latest fix did worse.
+const revertedNote = "This is an earlier version again: the latest fix did worse than it, so it was discarded. " +
+	"Fix this version instead, in a different way than before."
+
+// newTurn records a failed version of the scripts for the fixer.
+func newTurn(scripts llm.ScriptPair, err error) llm.Turn {
+	var failure *testFailure
+	examplesFailed := errors.As(err, &failure) && failure.examples != ""
+	return llm.Turn{MainScript: scripts.MainScript, TestScript: scripts.TestScript, Failure: err.Error(), ExamplesFailed: examplesFailed}
+}
+
+// generate generates new scripts for an attempt, or replays them from the
+// journal of a resumed run.
+func (p *Pipeline) generate(ctx context.Context, description string, attempt int) (llm.ScriptPair, error) {
+	if step, ok := p.journal.next(stepGenerate); ok {
+		p.replay(step)
+		return *step.Scripts, nil
+	}
+	scripts, err := p.llm.GenerateScripts(ctx, description)
+	if err != nil {
+		return llm.ScriptPair{}, err
+	}
+	p.lastProvider, p.lastModel = p.backend()
+	p.record(journalStep{Kind: stepGenerate, Attempt: attempt, Scripts: &scripts})
+	return scripts, nil
+}
+
+// test runs the examples and test script like verify, or replays their
+// outcome from the journal of a resumed run.
+func (p *Pipeline) test(ctx context.Context, scripts llm.ScriptPair, examples []Example, attempt, fix int) error {
+	if step, ok := p.journal.next(stepTest); ok {
+		if step.ExamplesFailure == "" && step.TestFailure == "" {
+			return nil
+		}
+		return &testFailure{examples: step.ExamplesFailure, test: step.TestFailure, passed: step.Passed, total: step.Total}
+	}
+	err := p.verify(ctx, scripts, examples)
+	var failure *testFailure
+	switch {
+	case err == nil:
+		p.record(journalStep{Kind: stepTest, Attempt: attempt, Fix: fix})
+	case errors.As(err, &failure):
+		p.record(journalStep{Kind: stepTest, Attempt: attempt, Fix: fix, ExamplesFailure: failure.examples, TestFailure: failure.test, Passed: failure.passed, Total: failure.total})
+	}
+	return err
+}
+
+// fix asks for a fix of the latest scripts of a conversation, checking a
+// fixed test script, or replays the fix from the journal of a resumed run.
+func (p *Pipeline) fix(ctx context.Context, conv llm.Conversation, attempt, fix int) (llm.ScriptPair, error) {
+	if step, ok := p.journal.next(stepFix); ok {
+		p.replay(step)
+		return *step.Scripts, nil
+	}
+	last := conv.Turns[len(conv.Turns)-1]
+	scripts, err := p.llm.FixScripts(ctx, conv)
+	if err != nil {
+		return llm.ScriptPair{}, fmt.Errorf("failed to fix scripts: %w", err)
+	}
+	if scripts.TestScript != last.TestScript {
+		rejected, err := p.rejectWeakenedTest(ctx, scripts.TestScript)
+		if err != nil {
+			return llm.ScriptPair{}, err
+		}
+		if rejected {
+			scripts.TestScript = last.TestScript
+		}
+		// If only the test script was fixed, rejecting it leaves the scripts
+		// that already failed, so the main script has to be fixed instead.
+		if rejected && scripts.MainScript == last.MainScript {
+			log.Info("Fixing the main script instead")
+			conv.FixMain = true
+			if scripts, err = p.llm.FixScripts(ctx, conv); err != nil {
+				return llm.ScriptPair{}, fmt.Errorf("failed to fix scripts: %w", err)
+			}
+			scripts.TestScript = last.TestScript
+		}
+	}
+	p.lastProvider, p.lastModel = p.backend()
+	p.record(journalStep{Kind: stepFix, Attempt: attempt, Fix: fix, Scripts: &scripts})
+	return scripts, nil
+}
+
+// record journals a step together with the tokens used since the last one.
+// Journaling is best effort: a run that can't be journaled still goes on.
+func (p *Pipeline) record(step journalStep) {
+	used := p.takeUsage()
+	p.addUsage(used)
+	step.Usage = used
+	step.Provider, step.Model = p.lastProvider, p.lastModel
+	if err := p.journal.record(step); err != nil {
+		log.Warn("%v", err)
+	}
+}
+
+// replay restores the backend and token usage of a step replayed from the
+// journal.
+func (p *Pipeline) replay(step journalStep) {
+	p.addUsage(step.Usage)
+	p.lastProvider, p.lastModel = step.Provider, step.Model
+}
+
+// succeed records working scripts and caches them if caching is enabled.
+func (p *Pipeline) succeed(description string, scripts llm.ScriptPair) {
+	provider, model := p.lastProvider, p.lastModel
+	log.Info("Working scripts generated by %s (%s)", provider, model)
+	if !p.noCache && p.cache != nil {
+		log.Info("Caching successful scripts...")
+		entry := CacheEntry{Scripts: scripts, Platform: p.platform, Provider: provider, Model: model}
+		if err := p.cache.Set(description, p.cacheSettings, entry); err != nil {
+			log.Warn("Failed to cache successful scripts: %v", err)
+		}
+	}
+}
+
+// LastBackend returns the provider and model that produced the scripts
+// GenerateAndTest last returned, as recorded with cached scripts.
+func (p *Pipeline) LastBackend() (string, string) {
+	return p.lastProvider, p.lastModel
+}
+
+// backend returns the provider and model that produced the latest scripts.
+func (p *Pipeline) backend() (string, string) {
+	if reporter, ok := p.llm.(llm.BackendReporter); ok {
+		return reporter.LastBackend()
+	}
+	return p.provider, p.model
+}
+
+// collectUsage adds the tokens the providers used since the last call to the
+// run's usage.
+func (p *Pipeline) collectUsage() {
+	p.addUsage(p.takeUsage())
+}
+
+// takeUsage returns the tokens the providers used since they were last
+// asked.
+func (p *Pipeline) takeUsage() []llm.ModelUsage {
+	var usage []llm.ModelUsage
+	for _, provider := range append([]llm.Provider{p.llm}, p.candidateProviders...) {
+		if reporter, ok := provider.(llm.UsageReporter); ok {
+			usage = append(usage, reporter.TakeUsage()...)
+		}
+	}
+	return usage
+}
+
+// addUsage adds tokens to the run's usage.
+func (p *Pipeline) addUsage(usage []llm.ModelUsage) {
+	for _, used := range usage {
+		i := slices.IndexFunc(p.usage, func(u llm.ModelUsage) bool {
+			return u.Provider == used.Provider && u.Model == used.Model
+		})
+		if i < 0 {
+			p.usage = append(p.usage, used)
+		} else {
+			p.usage[i].Add(used.Usage)
+		}
+	}
+}
+
+// cost estimates what the run has cost so far. The second return value
+// lists the models without a price, whose usage isn't included.
+func (p *Pipeline) cost() (float64, []string) {
+	var cost float64
+	var unpriced []string
+	for _, u := range p.usage {
+		price, ok := p.pricing[u.Model]
+		if !ok {
+			unpriced = append(unpriced, u.Model)
+			continue
+		}
+		cost += price.Cost(u.Usage)
+	}
+	return cost, unpriced
+}
+
+// checkBudget returns ErrBudgetExceeded if the run has already used its
+// max_tokens or max_cost budget. It's checked before each LLM request, so a
+// run can go over its budget by the cost of one request.
+func (p *Pipeline) checkBudget() error {
+	p.collectUsage()
+	if p.maxTokens > 0 {
+		var total llm.Usage
+		for _, u := range p.usage {
+			total.Add(u.Usage)
+		}
+		if total.Total() >= p.maxTokens {
+			return fmt.Errorf("%w: used %d of max_tokens %d", ErrBudgetExceeded, total.Total(), p.maxTokens)
+		}
+	}
+	if p.maxCost > 0 {
+		cost, unpriced := p.cost()
+		if len(unpriced) > 0 && !p.warnedUnpriced {
+			p.warnedUnpriced = true
+			log.Warn("No price is configured for %s, so max_cost only counts other models", strings.Join(unpriced, ", "))
+		}
+		if cost >= p.maxCost {
+			return fmt.Errorf("%w: spent an estimated %s of max_cost %s", ErrBudgetExceeded, llm.FormatCost(cost), llm.FormatCost(p.maxCost))
+		}
+	}
+	return nil
+}
+
+// reportUsage logs the tokens the run used per model and, for models with a
+// price, what they cost.
+func (p *Pipeline) reportUsage() {
+	p.collectUsage()
+	if len(p.usage) == 0 {
+		return
+	}
+	for _, u := range p.usage {
+		line := fmt.Sprintf("%s (%s): %s", u.Provider, u.Model, u.Usage)
+		if price, ok := p.pricing[u.Model]; ok {
+			line += ", about " + llm.FormatCost(price.Cost(u.Usage))
+		}
+		log.Info("LLM usage: %s", line)
+	}
+	if cost, unpriced := p.cost(); len(unpriced) < len(p.usage) {
+		note := ""
+		if len(unpriced) > 0 {
+			note = " (not counting unpriced models: " + strings.Join(unpriced, ", ") + ")"
+		}
+		log.Info("Estimated cost of this run: %s%s", llm.FormatCost(cost), note)
+	}
+}
+
+// failingScript stands in for the main script to check that a test script
+// actually tests something.
+const failingScript = "#!/bin/sh\nexit 1\n"
+
+// rejectWeakenedTest reports whether a fixed test script must not be used
+// because it passes even when the main script does nothing but fail, which
+// means the test was weakened until it tests nothing.
+func (p *Pipeline) rejectWeakenedTest(ctx context.Context, fixed string) (bool, error) {
+	_, err := p.runTestScript(ctx, llm.ScriptPair{MainScript: failingScript, TestScript: fixed}, false)
+	var setupErr *sandbox.SetupError
+	switch {
+	case errors.As(err, &setupErr) || ctx.Err() != nil:
+		return true, err
+	case err == nil:
+		log.Warn("Rejected the fixed test script: it passes even when the script fails")
+		return true, nil
+	}
+	log.Info("Using the fixed test script")
+	return false, nil
+}
+
+// testFailure describes how scripts failed the user-authored examples and
+// the generated test script.
+type testFailure struct {
+	examples string
+	test     string
+	// passed and total count the test cases if the test script reported
+	// them in TAP; total is zero otherwise.
+	passed int
+	total  int
 }
 
-// runTestScript executes the test script in a controlled environment
-func (p *Pipeline) runTestScript(ctx context.Context, scripts llm.ScriptPair) error {
+// worseThan reports whether f is clearly worse than other, a failure of the
+// same test script: it fails the examples when other passes them, or it
+// passes fewer test cases.
+func (f *testFailure) worseThan(other *testFailure) bool {
+	if (f.examples == "") != (other.examples == "") {
+		return f.examples != ""
+	}
+	return f.total > 0 && f.total == other.total && f.passed < other.passed
+}
+
+func (f *testFailure) Error() string {
+	var failures []string
+	for _, failure := range []string{f.examples, f.test} {
+		if failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	return strings.Join(failures, "\n\n")
+}
+
+// Verify runs the examples and test script against scripts, for instance
+// after the user edited a generated script.
+func (p *Pipeline) Verify(ctx context.Context, src *Source, scripts llm.ScriptPair) error {
+	return p.verify(ctx, scripts, src.examples())
+}
+
+// VerifyCached re-runs a cached entry's test script. The examples of the
+// script it was generated from aren't stored, so only the test script runs.
+func (p *Pipeline) VerifyCached(ctx context.Context, entry *CacheEntry) error {
+	_, err := p.runTestScript(ctx, entry.Scripts, false)
+	return err
+}
+
+// verify runs the user-authored examples and the generated test script. Both
+// always run so the fixer sees every failure at once; the scripts only pass
+// when both succeed.
+func (p *Pipeline) verify(ctx context.Context, scripts llm.ScriptPair, examples []Example) error {
+	var failure testFailure
+	var setupErr *sandbox.SetupError
+	if err := p.runExamples(ctx, scripts.MainScript, examples); err != nil {
+		if errors.As(err, &setupErr) {
+			return err
+		}
+		failure.examples = err.Error()
+	}
+	// An interrupted run isn't a script failure; don't go on to the fixer.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result, err := p.runTestScript(ctx, scripts, true)
+	if result != nil {
+		log.Info("%s", result.Progress())
+		failure.passed, failure.total = result.Passed(), result.Total()
+	}
+	if err != nil {
+		if errors.As(err, &setupErr) {
+			return err
+		}
+		failure.test = err.Error()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failure.examples != "" || failure.test != "" {
+		return &failure
+	}
+	return nil
+}
+
+// runTestScript executes the test script in a controlled environment. If the
+// test script reports its test cases in TAP, their results are returned too,
+// and a failure lists only the failing test cases rather than all output.
+// With progress set, the test cases passed so far are shown in the spinner
+// while the test script runs.
+func (p *Pipeline) runTestScript(ctx context.Context, scripts llm.ScriptPair, progress bool) (*TAPResult, error) {
 	// Create a secure temporary directory for this test
 	testDir, err := os.MkdirTemp("", "llmscript-test-*")
 	if err != nil {
-		return fmt.Errorf("failed to create test directory: %w", err)
+		return nil, fmt.Errorf("failed to create test directory: %w", err)
 	}
 	defer func() {
 		if err := os.RemoveAll(testDir); err != nil {
@@ -132,28 +685,88 @@ func (p *Pipeline) runTestScript(ctx context.Context, scripts llm.ScriptPair) er
 	testScriptPath := filepath.Join(testDir, "test.sh")
 
 	if err := os.WriteFile(featureScriptPath, []byte(scripts.MainScript), 0750); err != nil {
-		return fmt.Errorf("failed to write feature script: %w", err)
+		return nil, fmt.Errorf("failed to write feature script: %w", err)
 	}
 	if err := os.WriteFile(testScriptPath, []byte(scripts.TestScript), 0750); err != nil {
-		return fmt.Errorf("failed to write test script: %w", err)
+		return nil, fmt.Errorf("failed to write test script: %w", err)
 	}
 
 	// Run the test script with timeout
 	ctx, cancel := context.WithTimeout(ctx, p.timeout)
 	defer cancel()
 
+	var output bytes.Buffer
 	cmd := exec.CommandContext(ctx, testScriptPath)
 	cmd.Dir = testDir
+	cmd.Stdout = &output
+	if progress {
+		cmd.Stdout = &tapProgress{w: &output}
+	}
+	cmd.Stderr = cmd.Stdout
 
-	output, err := cmd.CombinedOutput()
-	log.Debug("Test script output:\n%s", output)
+	before := p.snapshot(testDir)
+	err = p.sandbox.Run(cmd)
+	log.Debug("Test script output:\n%s", output.String())
+	var setupErr *sandbox.SetupError
+	if errors.As(err, &setupErr) {
+		return nil, err
+	}
+	var report string
+	if changes, ok := p.changes(before, testDir); ok {
+		log.Debug("Test run file changes:\n%s", changes)
+		report = "\nFile changes:\n" + changes.String()
+	}
+	var hangErr *sandbox.HangError
+	if errors.As(err, &hangErr) {
+		log.Debug("Test script hung: %v", hangErr)
+		return nil, fmt.Errorf("test hung: the test script %w; the scripts must finish within %s and must not leave background processes running\nOutput:\n%s%s", hangErr, p.timeout, output.String(), report)
+	}
+	var limitErr *sandbox.LimitError
+	if errors.As(err, &limitErr) {
+		log.Debug("Test script stopped by resource limit: %v", limitErr)
+		return nil, fmt.Errorf("test %w; the scripts were stopped by a resource limit and must use fewer resources\nOutput:\n%s%s", limitErr, output.String(), report)
+	}
+	result, ok := ParseTAP(output.String())
+	if !ok {
+		result = nil
+	}
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			log.Debug("Test script exited with code: %d", exitErr.ExitCode())
 		}
-		return fmt.Errorf("test script failed: %w\nOutput:\n%s", err, output)
+		if result != nil && !result.OK() {
+			return result, fmt.Errorf("test script failed: %w\n%s%s", err, result.Failures(), report)
+		}
+		return result, fmt.Errorf("test script failed: %w\nOutput:\n%s%s", err, output.String(), report)
 	}
 	log.Debug("Test script exited with code: 0")
+	if result != nil && !result.OK() {
+		return result, fmt.Errorf("test script failed: it exited with code 0 but reported failing test cases\n%s%s", result.Failures(), report)
+	}
 
-	return nil
+	return result, nil
+}
+
+// snapshot records the state of dir and the watched paths before a run. It
+// returns nil if that fails, in which case no change report is produced.
+func (p *Pipeline) snapshot(dir string) *fsdiff.Snapshot {
+	snap, err := fsdiff.Take(dir, p.watch)
+	if err != nil {
+		log.Warn("Failed to snapshot files: %v", err)
+		return nil
+	}
+	return snap
+}
+
+// changes compares dir and the watched paths against a snapshot taken before
+// the run.
+func (p *Pipeline) changes(before *fsdiff.Snapshot, dir string) (fsdiff.Changes, bool) {
+	if before == nil {
+		return fsdiff.Changes{}, false
+	}
+	after := p.snapshot(dir)
+	if after == nil {
+		return fsdiff.Changes{}, false
+	}
+	return before.Diff(after), true
 }
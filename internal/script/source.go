@@ -0,0 +1,170 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/statico/llmscript/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// frontmatterDelimiter opens and closes the optional YAML block at the top of
+// an llmscript file.
+const frontmatterDelimiter = "---"
+
+// Source is a parsed llmscript file: the natural language description that is
+// sent to the LLM, plus any per-script settings from the frontmatter.
+type Source struct {
+	Description string
+	Frontmatter Frontmatter
+}
+
+// FrontmatterLLM holds the LLM settings a script may override.
+type FrontmatterLLM struct {
+	Provider *string `yaml:"provider"`
+	Model    *string `yaml:"model"`
+}
+
+// UnmarshalYAML accepts a fallback chain of providers as a list, like the
+// config file does. The node is decoded again with its own decoder since
+// Node.Decode doesn't reject unknown keys.
+func (f *FrontmatterLLM) UnmarshalYAML(node *yaml.Node) error {
+	config.FlattenProviders(node)
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	type plain FrontmatterLLM
+	return decoder.Decode((*plain)(f))
+}
+
+// Frontmatter holds the per-script settings declared between "---" lines at
+// the top of an llmscript file. Every setting is a pointer so that only keys
+// the script actually sets override the loaded config.
+type Frontmatter struct {
+	LLM         FrontmatterLLM `yaml:"llm"`
+	Timeout     *time.Duration `yaml:"timeout"`
+	MaxFixes    *int           `yaml:"max_fixes"`
+	MaxAttempts *int           `yaml:"max_attempts"`
+	ExtraPrompt *string        `yaml:"additional_prompt"`
+	Examples    []Example      `yaml:"examples"`
+	Arguments   []Argument     `yaml:"arguments"`
+	Options     []Argument     `yaml:"options"`
+	Watch       []string       `yaml:"watch"`
+	Lockfile    *bool          `yaml:"lockfile"`
+}
+
+// Apply merges the settings explicitly declared in the frontmatter over cfg.
+// The provider is applied before the model so that the model lands on the
+// provider the script selected.
+func (f *Frontmatter) Apply(cfg *config.Config) {
+	if f.LLM.Provider != nil {
+		cfg.LLM.Provider = *f.LLM.Provider
+	}
+	if f.LLM.Model != nil {
+		cfg.LLM.SetModel(*f.LLM.Model)
+	}
+	if f.Timeout != nil {
+		cfg.Timeout = *f.Timeout
+	}
+	if f.MaxFixes != nil {
+		cfg.MaxFixes = *f.MaxFixes
+	}
+	if f.MaxAttempts != nil {
+		cfg.MaxAttempts = *f.MaxAttempts
+	}
+	if f.ExtraPrompt != nil {
+		cfg.ExtraPrompt = *f.ExtraPrompt
+	}
+	if f.Watch != nil {
+		cfg.Watch = f.Watch
+	}
+	if f.Lockfile != nil {
+		cfg.Lockfile = *f.Lockfile
+	}
+}
+
+// Prompt returns the description as sent to the LLM, including the declared
+// command-line interface and the user-authored examples the script must
+// satisfy.
+func (s *Source) Prompt() string {
+	prompt := s.Description
+	for _, block := range []string{formatArgSchema(&s.Frontmatter), formatExamples(s.examples())} {
+		if block != "" {
+			prompt += "\n\n" + block
+		}
+	}
+	return prompt
+}
+
+// examples returns the user-authored examples with their arguments converted
+// to the canonical form the script is invoked with. ParseSource has already
+// checked that every example's arguments are valid.
+func (s *Source) examples() []Example {
+	examples := make([]Example, len(s.Frontmatter.Examples))
+	for i, e := range s.Frontmatter.Examples {
+		if args, err := s.ParseArgs(e.Args); err == nil {
+			e.Args = args
+		}
+		examples[i] = e
+	}
+	return examples
+}
+
+// ParseSource splits an llmscript file into its frontmatter and description.
+// A leading "#!" shebang line is dropped, and if the next non-blank line is
+// "---" everything up to the closing "---" is decoded as YAML frontmatter.
+// Unknown frontmatter keys are rejected so typos don't silently fall back to
+// the config file.
+func ParseSource(content string) (*Source, error) {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#!") {
+		lines = lines[1:]
+	}
+
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+
+	src := &Source{}
+	if start < len(lines) && strings.TrimSpace(lines[start]) == frontmatterDelimiter {
+		end := -1
+		for i := start + 1; i < len(lines); i++ {
+			if strings.TrimSpace(lines[i]) == frontmatterDelimiter {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("frontmatter is missing its closing %q line", frontmatterDelimiter)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader([]byte(strings.Join(lines[start+1:end], "\n"))))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&src.Frontmatter); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse frontmatter: %w", err)
+		}
+		if err := src.Frontmatter.validateArgSchema(); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %w", err)
+		}
+		for i, e := range src.Frontmatter.Examples {
+			if err := e.validate(); err != nil {
+				return nil, fmt.Errorf("invalid example %s: %w", e.label(i), err)
+			}
+			if _, err := src.ParseArgs(e.Args); err != nil {
+				return nil, fmt.Errorf("invalid example %s: %w", e.label(i), err)
+			}
+		}
+		start = end + 1
+	}
+
+	src.Description = strings.TrimSpace(strings.Join(lines[start:], "\n"))
+	return src, nil
+}
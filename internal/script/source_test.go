@@ -0,0 +1,84 @@
+package script
+
+import (
+	"testing"
+	"time"
+
+	"github.com/statico/llmscript/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSource(t *testing.T) {
+	t.Run("plain description", func(t *testing.T) {
+		src, err := ParseSource("#!/usr/bin/env llmscript\n\nPrint \"Hello, world!\"\n")
+		require.NoError(t, err)
+		assert.Equal(t, `Print "Hello, world!"`, src.Description)
+		assert.Nil(t, src.Frontmatter.LLM.Provider)
+		assert.Nil(t, src.Frontmatter.Timeout)
+	})
+
+	t.Run("frontmatter", func(t *testing.T) {
+		src, err := ParseSource(`#!/usr/bin/env llmscript
+---
+llm:
+  provider: claude
+  model: claude-haiku-4-5
+timeout: 10s
+max_fixes: 2
+---
+
+Print hello world
+`)
+		require.NoError(t, err)
+		assert.Equal(t, "Print hello world", src.Description)
+		require.NotNil(t, src.Frontmatter.LLM.Provider)
+		assert.Equal(t, "claude", *src.Frontmatter.LLM.Provider)
+		require.NotNil(t, src.Frontmatter.Timeout)
+		assert.Equal(t, 10*time.Second, *src.Frontmatter.Timeout)
+		require.NotNil(t, src.Frontmatter.MaxFixes)
+		assert.Equal(t, 2, *src.Frontmatter.MaxFixes)
+		assert.Nil(t, src.Frontmatter.MaxAttempts)
+	})
+
+	t.Run("unterminated frontmatter", func(t *testing.T) {
+		_, err := ParseSource("---\ntimeout: 10s\nPrint hello\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := ParseSource("---\ntimeuot: 10s\n---\nPrint hello\n")
+		assert.Error(t, err)
+		_, err = ParseSource("---\nllm:\n  modle: gpt-5.5\n---\nPrint hello\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("provider fallback chain", func(t *testing.T) {
+		src, err := ParseSource("---\nllm:\n  provider: [claude, ollama]\n---\nPrint hello\n")
+		require.NoError(t, err)
+		require.NotNil(t, src.Frontmatter.LLM.Provider)
+		assert.Equal(t, "claude, ollama", *src.Frontmatter.LLM.Provider)
+	})
+}
+
+func TestFrontmatter_Apply(t *testing.T) {
+	src, err := ParseSource(`---
+llm:
+  provider: openai
+  model: gpt-5.4-mini
+max_attempts: 1
+---
+Print hello world`)
+	require.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	src.Frontmatter.Apply(cfg)
+
+	assert.Equal(t, "openai", cfg.LLM.Provider)
+	assert.Equal(t, "gpt-5.4-mini", cfg.LLM.OpenAI.Model)
+	assert.Equal(t, 1, cfg.MaxAttempts)
+	// Keys the frontmatter doesn't mention keep their configured values.
+	assert.Equal(t, 10, cfg.MaxFixes)
+	assert.Equal(t, 30*time.Second, cfg.Timeout)
+	assert.Equal(t, config.DefaultConfig().ExtraPrompt, cfg.ExtraPrompt)
+}
@@ -0,0 +1,212 @@
+package script
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/statico/llmscript/internal/log"
+)
+
+var (
+	tapPlan      = regexp.MustCompile(`^1\.\.(\d+)`)
+	tapTestPoint = regexp.MustCompile(`^(not )?ok (\d+)\b\s*(?:-\s*)?([^#]*)(?:#\s*(.*))?$`)
+)
+
+// TAPResult is what a test script reported in TAP (the Test Anything
+// Protocol), which the test script prompt asks for.
+type TAPResult struct {
+	// Planned is the number of test cases announced by the plan line, or
+	// zero without one.
+	Planned int
+	Tests   []TAPTest
+	// BailedOut is set if the test script gave up with "Bail out!".
+	BailedOut bool
+	// Trailing holds the output after the last test case.
+	Trailing []string
+}
+
+// TAPTest is a single test case of a TAPResult.
+type TAPTest struct {
+	Number      int
+	OK          bool
+	Description string
+	// Directive is "SKIP" or "TODO" and Reason its explanation, if given.
+	Directive string
+	Reason    string
+	// Diagnostics holds the output printed while the test case ran and the
+	// comment lines that followed its result.
+	Diagnostics []string
+}
+
+// Passed reports whether the test case counts as passing. Skipped test
+// cases do, and so do failures of TODO test cases, which are expected.
+func (t TAPTest) Passed() bool {
+	return t.OK || t.Directive == "SKIP" || t.Directive == "TODO"
+}
+
+func (t TAPTest) String() string {
+	s := "not ok"
+	if t.OK {
+		s = "ok"
+	}
+	s += " " + strconv.Itoa(t.Number)
+	if t.Description != "" {
+		s += " - " + t.Description
+	}
+	if t.Directive != "" {
+		s += " # " + strings.TrimSpace(t.Directive+" "+t.Reason)
+	}
+	return s
+}
+
+// ParseTAP parses the output of a test script. The second return value is
+// false if the output has neither a plan nor a numbered test point, in which
+// case the test script doesn't speak TAP and only its exit code counts.
+// Lines that aren't TAP, such as the output of the script under test, are
+// kept as diagnostics of the test case they were printed in.
+func ParseTAP(output string) (*TAPResult, bool) {
+	result := &TAPResult{}
+	var found, inYAML bool
+	var pending []string
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		last := len(result.Tests) - 1
+
+		// A YAML block of diagnostics follows its test point, indented.
+		if inYAML {
+			if trimmed == "..." {
+				inYAML = false
+			} else if last >= 0 {
+				result.Tests[last].Diagnostics = append(result.Tests[last].Diagnostics, line)
+			}
+			continue
+		}
+
+		switch {
+		case result.Planned == 0 && tapPlan.MatchString(line):
+			result.Planned, _ = strconv.Atoi(tapPlan.FindStringSubmatch(line)[1])
+			found = true
+		case tapTestPoint.MatchString(line):
+			test := parseTestPoint(line)
+			test.Diagnostics = pending
+			result.Tests = append(result.Tests, test)
+			pending = nil
+			found = true
+		case strings.HasPrefix(line, "Bail out!"):
+			result.BailedOut = true
+			pending = append(pending, line)
+		case trimmed == "---" && last >= 0 && line != trimmed:
+			inYAML = true
+		case strings.HasPrefix(trimmed, "#") && last >= 0 && pending == nil:
+			result.Tests[last].Diagnostics = append(result.Tests[last].Diagnostics, line)
+		case trimmed != "":
+			pending = append(pending, line)
+		}
+	}
+	result.Trailing = pending
+	return result, found
+}
+
+// parseTestPoint parses a line matching tapTestPoint.
+func parseTestPoint(line string) TAPTest {
+	m := tapTestPoint.FindStringSubmatch(line)
+	test := TAPTest{OK: m[1] == "", Description: strings.TrimSpace(m[3])}
+	test.Number, _ = strconv.Atoi(m[2])
+	if directive, reason, _ := strings.Cut(strings.TrimSpace(m[4]), " "); directive != "" {
+		switch strings.ToUpper(directive) {
+		case "SKIP", "TODO":
+			test.Directive, test.Reason = strings.ToUpper(directive), strings.TrimSpace(reason)
+		}
+	}
+	return test
+}
+
+// tapProgress passes a test script's output through to w and shows the
+// test cases passed so far in the spinner as their TAP lines arrive.
+type tapProgress struct {
+	w      io.Writer
+	line   []byte
+	result TAPResult
+}
+
+func (t *tapProgress) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	t.line = append(t.line, p[:n]...)
+	for {
+		i := bytes.IndexByte(t.line, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(t.line[:i])
+		t.line = t.line[i+1:]
+		switch {
+		case t.result.Planned == 0 && tapPlan.MatchString(line):
+			t.result.Planned, _ = strconv.Atoi(tapPlan.FindStringSubmatch(line)[1])
+		case tapTestPoint.MatchString(line):
+			t.result.Tests = append(t.result.Tests, parseTestPoint(line))
+			log.Progress("Testing script... %s so far", t.result.Progress())
+		}
+	}
+	return n, err
+}
+
+// Total is the number of test cases, as planned or, without a plan or if
+// more ran than planned, as reported.
+func (r *TAPResult) Total() int {
+	return max(r.Planned, len(r.Tests))
+}
+
+// Passed counts the passing test cases.
+func (r *TAPResult) Passed() int {
+	var n int
+	for _, t := range r.Tests {
+		if t.Passed() {
+			n++
+		}
+	}
+	return n
+}
+
+// OK reports whether every planned test case ran and passed.
+func (r *TAPResult) OK() bool {
+	return !r.BailedOut && r.Passed() == r.Total()
+}
+
+// Progress summarizes the result, like "7/9 tests passing".
+func (r *TAPResult) Progress() string {
+	return fmt.Sprintf("%d/%d tests passing", r.Passed(), r.Total())
+}
+
+// Failures describes only the failing test cases with their diagnostics,
+// and the planned ones that never reported a result, for the fix prompt.
+func (r *TAPResult) Failures() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d test cases failed:\n", r.Total()-r.Passed(), r.Total())
+	for _, t := range r.Tests {
+		if t.Passed() {
+			continue
+		}
+		b.WriteString("\n" + t.String() + "\n")
+		for _, line := range t.Diagnostics {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+	if missing := r.Planned - len(r.Tests); missing > 0 || r.BailedOut {
+		fmt.Fprintf(&b, "\n%d planned test cases reported no result", max(missing, 0))
+		if r.BailedOut {
+			b.WriteString(" since the test script bailed out")
+		}
+		if len(r.Trailing) > 0 {
+			b.WriteString(", output after the last result:")
+		}
+		b.WriteString("\n")
+		for _, line := range r.Trailing {
+			b.WriteString("  " + line + "\n")
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,86 @@
+package script
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTAP(t *testing.T) {
+	output := `1..5
+ok 1 - prints the date
+date: illegal option -- d
+not ok 2 - accepts a relative date
+# expected: 2026-10-15
+# got:
+ok 3 - rejects bad input # SKIP needs GNU date
+not ok 4 - handles time zones # TODO not implemented
+not ok 5 no description
+  ---
+  exit_code: 2
+  ...
+`
+	result, ok := ParseTAP(output)
+	require.True(t, ok)
+	assert.Equal(t, 5, result.Planned)
+	require.Len(t, result.Tests, 5)
+	assert.Equal(t, 5, result.Total())
+	assert.Equal(t, 3, result.Passed())
+	assert.False(t, result.OK())
+	assert.Equal(t, "3/5 tests passing", result.Progress())
+
+	assert.Equal(t, TAPTest{Number: 1, OK: true, Description: "prints the date"}, result.Tests[0])
+	assert.Equal(t, []string{"date: illegal option -- d", "# expected: 2026-10-15", "# got:"}, result.Tests[1].Diagnostics)
+	assert.Equal(t, "SKIP", result.Tests[2].Directive)
+	assert.Equal(t, "needs GNU date", result.Tests[2].Reason)
+	assert.True(t, result.Tests[3].Passed())
+	assert.Equal(t, "no description", result.Tests[4].Description)
+	assert.Equal(t, []string{"  exit_code: 2"}, result.Tests[4].Diagnostics)
+
+	failures := result.Failures()
+	assert.Contains(t, failures, "2 of 5 test cases failed")
+	assert.Contains(t, failures, "not ok 2 - accepts a relative date\n  date: illegal option -- d\n  # expected: 2026-10-15")
+	assert.Contains(t, failures, "not ok 5 - no description")
+	assert.NotContains(t, failures, "prints the date")
+	assert.NotContains(t, failures, "handles time zones")
+}
+
+func TestParseTAP_Missing(t *testing.T) {
+	result, ok := ParseTAP("1..3\nok 1 - first\nBail out! no network\n")
+	require.True(t, ok)
+	assert.True(t, result.BailedOut)
+	assert.Equal(t, 3, result.Total())
+	assert.Equal(t, 1, result.Passed())
+	assert.Contains(t, result.Failures(), "2 planned test cases reported no result since the test script bailed out")
+	assert.Contains(t, result.Failures(), "Bail out! no network")
+
+	// Without a plan, the reported test cases are all there is.
+	result, ok = ParseTAP("ok 1\nok 2 - second\n")
+	require.True(t, ok)
+	assert.True(t, result.OK())
+	assert.Equal(t, 2, result.Total())
+}
+
+func TestParseTAP_NotTAP(t *testing.T) {
+	for _, output := range []string{"", "Hello, World!\n", "ok\nall good\n", "tests ok 1\n"} {
+		_, ok := ParseTAP(output)
+		assert.False(t, ok, "%q isn't TAP", output)
+	}
+}
+
+func TestTAPProgress(t *testing.T) {
+	var out strings.Builder
+	progress := &tapProgress{w: &out}
+	for _, chunk := range []string{"1..3\nok 1 - fir", "st\nnot ok 2\n", "# diagnostics\nok 3 # SKIP later"} {
+		n, err := progress.Write([]byte(chunk))
+		require.NoError(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+	assert.Equal(t, "1..3\nok 1 - first\nnot ok 2\n# diagnostics\nok 3 # SKIP later", out.String())
+	// The last line isn't complete yet.
+	assert.Equal(t, 3, progress.result.Planned)
+	assert.Len(t, progress.result.Tests, 2)
+	assert.Equal(t, "1/3 tests passing", progress.result.Progress())
+}